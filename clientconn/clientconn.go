@@ -3,10 +3,11 @@ package clientconn
 import (
 	"bufio"
 	"container/list"
-	"encoding/binary"
+	"context"
 	"errors"
 	"io"
-	"log"
+	"mycp/mycplog"
+	"mycp/mycpproto"
 	"net"
 	"strings"
 	"sync"
@@ -15,16 +16,36 @@ import (
 )
 
 var (
-	ErrClientConnRequestChFull  = errors.New("ErrClientConnRequestChFull")
 	ErrClientConnClosed         = errors.New("ErrClientConnClosed")
 	ErrClientConnRequestTimeout = errors.New("ErrClientConnRequestTimeout")
 )
 
+type Options struct {
+	PingInterval time.Duration // 发送 ping 的间隔, 0 表示不发送
+	IdleTimeout  time.Duration // 超过这个时间没有收到任何帧则认为对端已死并关闭连接, 0 表示不检测
+	MaxFrameSize uint64        // 单个帧 body 的最大字节数
+
+	RequestTimeout time.Duration // 单个请求从发出到收到响应的最长时间
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		PingInterval: 5 * time.Second,
+		IdleTimeout:  20 * time.Second,
+		MaxFrameSize: 1 << 30,
+
+		RequestTimeout: 30 * time.Second,
+	}
+}
+
 type ClientConn struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	opts   *Options
 
 	requestCh chan *Request
+	pongCh    chan struct{}
+	creditCh  chan struct{} // 服务端授予的额度, 每发一个请求消耗一个
 
 	seq uint64
 
@@ -33,7 +54,11 @@ type ClientConn struct {
 	rList               *list.List // list.Element.Value 就是 *Request
 	seq2requestElement  map[uint64]*list.Element
 
-	closed uint64
+	connID  uint64       // 服务端在 Hello 的响应中给出的连接 ID, 用于日志
+	session atomic.Value // 认证时调用方在这个连接上保存的状态, 比如这个连接的会话密钥
+
+	closed   uint64
+	closedCh chan struct{}
 }
 
 type Request struct {
@@ -41,18 +66,48 @@ type Request struct {
 	Pkg        []byte
 	Err        error
 
+	// 连接断开时是否可以在新连接上重发, 只对 ReconnectClientConn 有效
+	Idempotent bool
+
+	// 不为 nil 时 ReconnectClientConn 每次 (重新) 发送前用它得到发往 clientConn 的 Pkg,
+	// 用于每个连接的密钥不同的情况
+	Encode func(clientConn *ClientConn) []byte
+
+	// 为 true 表示这是一个中间响应, 同一个请求之后还会有响应. 中间响应是新的 *Request,
+	// 只有 Pkg 和 More 有意义, 调用方应该继续从 ResponseCh 读, 直到 More 为 false.
+	More bool
+
 	timeSend time.Time
 	seq      uint64
+	connID   uint64
+
+	// 发出时创建, Cancel 时被 close, 之后这个请求的中间响应和最终响应都被丢弃
+	cancelCh chan struct{}
+	canceled bool // 由 pendingRequestMutex 保护
+	// 中间响应所在连接的 closedCh, 连接关闭后不再投递中间响应
+	connClosedCh chan struct{}
 }
 
 const (
-	HeadSize = 16
+	HeadSize = mycpproto.HeadSize
+
+	maxCredit = 4096
 )
 
+// refreshReadDeadline 在每次 Read 前调用, IdleTimeout 内读不到数据则 Read 返回超时错误
+func (clientConn *ClientConn) refreshReadDeadline() (err error) {
+	if clientConn.opts.IdleTimeout <= 0 {
+		return nil
+	}
+	return clientConn.conn.SetReadDeadline(time.Now().Add(clientConn.opts.IdleTimeout))
+}
+
 func (clientConn *ClientConn) GoReceive() {
 	defer clientConn.Close()
 
 	var headPkg = make([]byte, HeadSize)
+	var frameType mycpproto.FrameType
+	var bodyLen uint64
 	var pkgLen int
 	var totalCnt = 0
 	var thisCnt = 0
@@ -65,38 +120,91 @@ func (clientConn *ClientConn) GoReceive() {
 		// read head
 		totalCnt = 0
 		for totalCnt < HeadSize {
+			err = clientConn.refreshReadDeadline()
+			if err != nil {
+				clientConn.logger().Warnf("SetReadDeadline fail=>%v", err)
+				return
+			}
 			thisCnt, err = clientConn.reader.Read(headPkg[totalCnt:])
 			if err != nil {
 				if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
 					return
 				}
-				log.Printf("Read fail=>%v", err)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					clientConn.logger().Warnf("no frame from peer in %v, close dead conn", clientConn.opts.IdleTimeout)
+					return
+				}
+				clientConn.logger().Warnf("Read fail=>%v", err)
 				return
 			}
 			totalCnt += thisCnt
 		}
 		// read body
-		pkgLen = int(binary.BigEndian.Uint64(headPkg))
+		frameType, bodyLen, seq = mycpproto.ParseHead(headPkg)
+		err = mycpproto.CheckHead(frameType, bodyLen, clientConn.opts.MaxFrameSize)
+		if err != nil {
+			clientConn.logger().Warnf("bad frame, close conn. err=>%v", err)
+			return
+		}
+		pkgLen = int(bodyLen)
 		var pkg = make([]byte, pkgLen)
 		totalCnt = 0
 		for totalCnt < pkgLen {
+			err = clientConn.refreshReadDeadline()
+			if err != nil {
+				clientConn.logger().Warnf("SetReadDeadline fail=>%v", err)
+				return
+			}
 			thisCnt, err = clientConn.reader.Read(pkg[totalCnt:])
 			if err != nil {
-				log.Printf("Read fail=>%v", err)
+				clientConn.logger().Warnf("Read fail=>%v", err)
 				return
 			}
 			totalCnt += thisCnt
 		}
+
+		switch frameType {
+		case mycpproto.FrameTypePing:
+			select {
+			case clientConn.pongCh <- struct{}{}:
+			default:
+				// 已经有一个 pong 待发送
+			}
+			continue
+		case mycpproto.FrameTypePong:
+			// 收到任何帧都已经刷新了 read deadline, 无需其他处理
+			continue
+		case mycpproto.FrameTypeCredit:
+			clientConn.addCredit(seq)
+			continue
+		}
+
 		// 取 Request
-		seq = binary.BigEndian.Uint64(headPkg[8:])
 
 		clientConn.pendingRequestMutex.Lock()
 		element, ok = clientConn.seq2requestElement[seq]
 		if !ok {
-			log.Printf("miss request. drop this msg.")
+			clientConn.logger().With("seq", seq).Debugf("miss request. drop this msg.")
 			clientConn.pendingRequestMutex.Unlock()
 			continue
 		}
+		if frameType == mycpproto.FrameTypeDataMore {
+			// 中间响应: 请求继续等待, 并重新计算超时
+			request = element.Value.(*Request)
+			request.timeSend = time.Now()
+			clientConn.rList.MoveToBack(element)
+			var partial = &Request{
+				ResponseCh:   request.ResponseCh,
+				Pkg:          pkg,
+				More:         true,
+				cancelCh:     request.cancelCh,
+				connClosedCh: clientConn.closedCh,
+			}
+			clientConn.pendingRequestMutex.Unlock()
+
+			partial.Done()
+			continue
+		}
 		request = element.Value.(*Request)
 		clientConn.rList.Remove(element)
 		delete(clientConn.seq2requestElement, seq)
@@ -113,72 +221,86 @@ func (clientConn *ClientConn) GoSend() {
 	defer clientConn.Close()
 
 	var request *Request
-	var ok bool
 	var pkgLen int
-	var n int
 	var err error
 	var ticker100ms = time.NewTicker(100 * time.Millisecond)
+	defer ticker100ms.Stop()
+	var pingCh <-chan time.Time
+	if clientConn.opts.PingInterval > 0 {
+		pingTicker := time.NewTicker(clientConn.opts.PingInterval)
+		defer pingTicker.Stop()
+		pingCh = pingTicker.C
+	}
+	var controlPkg = make([]byte, HeadSize)
 	var elementAdded *list.Element
 FOR:
 	for !clientConn.IsClosed() {
 		select {
-		case request, ok = <-clientConn.requestCh:
-			if !ok {
-				//log.Printf("requestCh has closed. be to close clientConn")
-				break FOR
-			}
-
+		case <-clientConn.closedCh:
+			break FOR
+		case request = <-clientConn.requestCh:
+			// seq 等字段在锁内赋值, Cancel 和 Timeout 会在其他协程中读取
+			clientConn.pendingRequestMutex.Lock()
 			request.timeSend = time.Now()
 			request.seq = clientConn.seq
+			request.connID = clientConn.ConnID()
+			request.cancelCh = make(chan struct{})
 			clientConn.seq += 1
-
-			clientConn.pendingRequestMutex.Lock()
 			elementAdded = clientConn.rList.PushBack(request)
 			clientConn.seq2requestElement[request.seq] = elementAdded
 			clientConn.pendingRequestMutex.Unlock()
 
 			pkgLen = HeadSize + len(request.Pkg)
 			pkg := make([]byte, pkgLen)
-			n = 0
-			binary.BigEndian.PutUint64(pkg[n:], uint64(len(request.Pkg)))
-			n += 8
-			binary.BigEndian.PutUint64(pkg[n:], request.seq)
-			n += 8
-			copy(pkg[n:], request.Pkg)
+			mycpproto.PutHead(pkg, mycpproto.FrameTypeData, len(request.Pkg), request.seq)
+			copy(pkg[HeadSize:], request.Pkg)
 			//log.Printf("be to write=>%s", pkg)
 			m, err := clientConn.conn.Write(pkg)
 			if err != nil {
-				log.Printf("Write fail=>%v", err)
+				clientConn.logger().Warnf("Write fail=>%v", err)
 				break FOR
 			}
 			//log.Printf("Write total %d Bytes", m)
 			_ = m
+		case <-pingCh:
+			mycpproto.PutHead(controlPkg, mycpproto.FrameTypePing, 0, 0)
+			_, err = clientConn.conn.Write(controlPkg)
+			if err != nil {
+				clientConn.logger().Warnf("Write ping fail=>%v", err)
+				break FOR
+			}
+		case <-clientConn.pongCh:
+			mycpproto.PutHead(controlPkg, mycpproto.FrameTypePong, 0, 0)
+			_, err = clientConn.conn.Write(controlPkg)
+			if err != nil {
+				clientConn.logger().Warnf("Write pong fail=>%v", err)
+				break FOR
+			}
 		case <-ticker100ms.C:
 			err = clientConn.conn.SetWriteDeadline(time.Now().Add(30_100 * time.Millisecond))
 			if err != nil {
-				log.Printf("SetWriteDeadline fail=>%v", err)
+				clientConn.logger().Warnf("SetWriteDeadline fail=>%v", err)
 				break FOR
 			}
 			clientConn.Timeout()
 		}
 	}
 
-	// 排空还未返回的请求
+	// 排空还在 requestCh 中的请求
+	clientConn.Close()
+	clientConn.drainRequestCh()
+
+	// 排空还未返回的请求. Done 可能阻塞, 所以在锁外调用
 	clientConn.pendingRequestMutex.Lock()
-	defer clientConn.pendingRequestMutex.Unlock()
-	if clientConn.rList == nil {
-		return
-	}
-	var nextElement *list.Element
-	for e := clientConn.rList.Front(); e != nil; {
+	pendingRequests := clientConn.rList
+	clientConn.rList = list.New()
+	clientConn.seq2requestElement = make(map[uint64]*list.Element)
+	clientConn.pendingRequestMutex.Unlock()
+	for e := pendingRequests.Front(); e != nil; e = e.Next() {
 		request = e.Value.(*Request)
-		delete(clientConn.seq2requestElement, request.seq) // TODO: 不删会内存泄漏吗?
 		request.Err = ErrClientConnClosed
-		log.Printf("GoSend->Done()")
+		clientConn.logger().Debugf("GoSend->Done()")
 		request.Done()
-		nextElement = e.Next()
-		clientConn.rList.Remove(e)
-		e = nextElement
 	}
 }
 
@@ -222,36 +344,134 @@ func (clientConn *ClientConn) Timeout() {
 	}
 }
 
-func (clientConn *ClientConn) Send(request *Request) {
-	defer func() {
-		if r := recover(); r != nil {
+// Cancel 放弃一个已经发出的请求, 之后到达的中间响应和最终响应, 包括已经在投递中的, 都会被丢弃.
+// 调用之后不必再从 ResponseCh 读. request 还没发出时什么都不做.
+func (clientConn *ClientConn) Cancel(request *Request) {
+	clientConn.pendingRequestMutex.Lock()
+	defer clientConn.pendingRequestMutex.Unlock()
+	if request.cancelCh != nil && !request.canceled {
+		request.canceled = true
+		close(request.cancelCh)
+	}
+	element, ok := clientConn.seq2requestElement[request.seq]
+	if !ok || element.Value.(*Request) != request {
+		return
+	}
+	clientConn.rList.Remove(element)
+	delete(clientConn.seq2requestElement, request.seq)
+}
+
+func (clientConn *ClientConn) drainRequestCh() {
+	var request *Request
+	for {
+		select {
+		case request = <-clientConn.requestCh:
 			request.Err = ErrClientConnClosed
-			log.Printf("Send->Done()")
 			request.Done()
-			log.Print("ClientConn has closed")
+		default:
+			return
 		}
-	}()
+	}
+}
 
+func (clientConn *ClientConn) addCredit(n uint64) {
+	for ; n > 0; n-- {
+		select {
+		case clientConn.creditCh <- struct{}{}:
+		default:
+			// 超过 maxCredit 的额度直接忽略
+			return
+		}
+	}
+}
+
+// Send 等到有额度后发送请求, 最多等待 timeoutDur. 结果 (包括错误) 都通过 request.ResponseCh 返回.
+func (clientConn *ClientConn) Send(request *Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientConn.timeoutDur)
+	defer cancel()
+	clientConn.SendContext(ctx, request)
+}
+
+// SendContext 与 Send 相同, 但等待额度的时间由 ctx 控制.
+// 等待超时时 request.Err 为 ErrClientConnRequestTimeout, ctx 被取消时为 ctx.Err().
+func (clientConn *ClientConn) SendContext(ctx context.Context, request *Request) {
+	select {
+	case <-clientConn.creditCh:
+	case <-clientConn.closedCh:
+		request.Err = ErrClientConnClosed
+		request.Done()
+		return
+	case <-ctx.Done():
+		request.Err = ctx.Err()
+		if request.Err == context.DeadlineExceeded {
+			request.Err = ErrClientConnRequestTimeout
+		}
+		request.Done()
+		return
+	}
+
+	// 有额度时 requestCh 一定有空位
 	select {
 	case clientConn.requestCh <- request:
-	default:
-		request.Err = ErrClientConnRequestChFull
-		log.Printf("Send-full->Done()")
+	case <-clientConn.closedCh:
+		request.Err = ErrClientConnClosed
 		request.Done()
-		log.Print("requestCh full")
+		return
 	}
+	if clientConn.IsClosed() {
+		// GoSend 可能已经排空过 requestCh 了
+		clientConn.drainRequestCh()
+	}
+}
+
+// SetConnID 记下服务端给出的连接 ID, 之后这个连接的日志和请求都带有它
+func (clientConn *ClientConn) SetConnID(connID uint64) {
+	atomic.StoreUint64(&clientConn.connID, connID)
+}
+
+func (clientConn *ClientConn) ConnID() uint64 {
+	return atomic.LoadUint64(&clientConn.connID)
+}
+
+// SetSession 在连接上保存认证得到的状态, v 不能为 nil, 每次调用的类型必须相同
+func (clientConn *ClientConn) SetSession(v interface{}) {
+	clientConn.session.Store(v)
 }
 
-func NewClientConn(conn net.Conn) (clientConn *ClientConn, err error) {
+// Session 返回 SetSession 保存的状态, 没有时返回 nil
+func (clientConn *ClientConn) Session() interface{} {
+	return clientConn.session.Load()
+}
+
+func (clientConn *ClientConn) logger() *mycplog.Logger {
+	return mycplog.With("conn", clientConn.ConnID(), "remote", clientConn.conn.RemoteAddr())
+}
+
+// Seq 返回请求最后一次发送时的序号, 与服务端日志中的 seq 相同
+func (request *Request) Seq() uint64 {
+	return request.seq
+}
+
+// ConnID 返回请求最后一次发送时所在连接的 ID, 与服务端日志中的 conn 相同
+func (request *Request) ConnID() uint64 {
+	return request.connID
+}
+
+// opts 为 nil 时使用 DefaultOptions()
+func NewClientConn(conn net.Conn, opts *Options) (clientConn *ClientConn, err error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		err = tcpConn.SetKeepAlive(true)
 		if err != nil {
-			log.Printf("SetKeepAlive fail=>%v", err)
+			mycplog.Warnf("SetKeepAlive fail=>%v", err)
 			return
 		}
 		err = tcpConn.SetKeepAlivePeriod(10 * time.Second)
 		if err != nil {
-			log.Printf("SetKeepAlivePeriod fail=>%v", err)
+			mycplog.Warnf("SetKeepAlivePeriod fail=>%v", err)
 			return
 		}
 	}
@@ -259,11 +479,15 @@ func NewClientConn(conn net.Conn) (clientConn *ClientConn, err error) {
 	clientConn = &ClientConn{
 		conn:   conn,
 		reader: bufio.NewReader(conn),
+		opts:   opts,
 
-		requestCh:          make(chan *Request, 4096),
-		timeoutDur:         30 * time.Second,
+		requestCh:          make(chan *Request, maxCredit),
+		pongCh:             make(chan struct{}, 1),
+		creditCh:           make(chan struct{}, maxCredit),
+		timeoutDur:         opts.RequestTimeout,
 		rList:              list.New(),
 		seq2requestElement: make(map[uint64]*list.Element),
+		closedCh:           make(chan struct{}),
 	}
 
 	go clientConn.GoReceive()
@@ -274,26 +498,27 @@ func NewClientConn(conn net.Conn) (clientConn *ClientConn, err error) {
 
 func (clientConn *ClientConn) Close() {
 	if atomic.CompareAndSwapUint64(&clientConn.closed, 0, 1) {
-		close(clientConn.requestCh)
-		clientConn.rList = nil // 不做会 memory leak 吗?
 		_ = clientConn.conn.Close()
+		close(clientConn.closedCh)
 	}
 }
 
+// Done 返回的 chan 在 ClientConn 关闭后被 close
+func (clientConn *ClientConn) Done() <-chan struct{} {
+	return clientConn.closedCh
+}
+
 func (clientConn *ClientConn) IsClosed() bool {
 	return atomic.LoadUint64(&clientConn.closed) == 1
 }
 
+// Done 把结果交给调用方. 调用方没有及时从 ResponseCh 取走时会阻塞, 直到请求被 Cancel.
+// 中间响应在连接关闭后也被丢弃, 调用方之后会收到 ErrClientConnClosed 的最终响应;
+// 最终响应不能因为连接关闭而丢弃, 否则调用方会一直等下去.
 func (request *Request) Done() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("ResponseCh have closed so drop this rsp")
-		}
-	}()
-
 	select {
 	case request.ResponseCh <- request:
-	default:
-		log.Printf("ResponseCh full so drop this rsp")
+	case <-request.cancelCh:
+	case <-request.connClosedCh:
 	}
 }
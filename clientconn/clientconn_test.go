@@ -0,0 +1,247 @@
+package clientconn
+
+import (
+	"context"
+	"mycp/serverconn"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newLoopback 建立一对本机 TCP 连接, 服务端收到的请求写入 requestCh
+func newLoopback(t *testing.T, serverOpts *serverconn.Options, requestCh chan *serverconn.Request) (clientConn *ClientConn, serverConn *serverconn.ServerConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen fail=>%v", err)
+	}
+	defer ln.Close()
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(acceptedCh)
+			return
+		}
+		acceptedCh <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial fail=>%v", err)
+	}
+	accepted, ok := <-acceptedCh
+	if !ok {
+		t.Fatalf("Accept fail")
+	}
+	serverConn, err = serverconn.NewServerConn(context.Background(), accepted, requestCh, serverOpts)
+	if err != nil {
+		t.Fatalf("NewServerConn fail=>%v", err)
+	}
+	clientConn, err = NewClientConn(conn, &Options{MaxFrameSize: 1 << 20, RequestTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("NewClientConn fail=>%v", err)
+	}
+	return clientConn, serverConn
+}
+
+// TestCreditBackpressure 检查服务端不回响应时客户端最多发出 MaxInFlight 个请求, 每回一个响应才能再发一个.
+// 客户端超过额度时服务端会关闭连接, 之后的请求都会失败.
+func TestCreditBackpressure(t *testing.T) {
+	const maxInFlight = 2
+	const total = 10
+	requestCh := make(chan *serverconn.Request, total)
+	clientConn, serverConn := newLoopback(t, &serverconn.Options{
+		MaxInFlight:         maxInFlight,
+		MaxFrameSize:        1 << 20,
+		MaxPreAuthFrameSize: 1 << 20,
+	}, requestCh)
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	responseCh := make(chan *Request, total)
+	for idx := 0; idx < total; idx++ {
+		go clientConn.Send(&Request{ResponseCh: responseCh, Pkg: []byte(strconv.Itoa(idx))})
+	}
+
+	receive := func() *serverconn.Request {
+		select {
+		case request := <-requestCh:
+			return request
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no request within credit")
+			return nil
+		}
+	}
+	var held []*serverconn.Request
+	for len(held) < maxInFlight {
+		held = append(held, receive())
+	}
+	select {
+	case request := <-requestCh:
+		t.Fatalf("got request %q beyond %d credits", request.Pkg, maxInFlight)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	received := maxInFlight
+	seen := make(map[string]bool)
+	for responded := 0; responded < total; responded++ {
+		if !held[0].Done() {
+			t.Fatalf("server conn closed")
+		}
+		held = held[1:]
+		select {
+		case response := <-responseCh:
+			if response.Err != nil {
+				t.Fatalf("response.Err=>%v", response.Err)
+			}
+			seen[string(response.Pkg)] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no response")
+		}
+		if received < total {
+			held = append(held, receive())
+			received++
+		}
+		if len(held) > maxInFlight {
+			t.Fatalf("%d requests in flight, credit is %d", len(held), maxInFlight)
+		}
+	}
+	if len(seen) != total {
+		t.Fatalf("got %d distinct responses, want %d", len(seen), total)
+	}
+	if clientConn.IsClosed() || serverConn.IsClosed() {
+		t.Fatalf("conn closed")
+	}
+}
+
+// serveStream 处理 requestCh 中的请求直到 stopCh 被 close: Pkg 为 "stream" 的请求先回 partials 个中间响应, 其他请求原样返回
+func serveStream(requestCh chan *serverconn.Request, stopCh chan struct{}, partials int) {
+	for {
+		var request *serverconn.Request
+		select {
+		case request = <-requestCh:
+		case <-stopCh:
+			return
+		}
+		go func(request *serverconn.Request) {
+			if string(request.Pkg) == "stream" {
+				for idx := 0; idx < partials; idx++ {
+					if !request.Stream([]byte(strconv.Itoa(idx))) {
+						return
+					}
+				}
+			}
+			request.Done()
+		}(request)
+	}
+}
+
+// TestCancelStream 检查放弃一个正在接收中间响应的请求后, 之后的中间响应不会卡住连接, 同一个连接上的其他请求仍然能完成
+func TestCancelStream(t *testing.T) {
+	requestCh := make(chan *serverconn.Request, 16)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	clientConn, serverConn := newLoopback(t, &serverconn.Options{
+		MaxInFlight:         16,
+		MaxFrameSize:        1 << 20,
+		MaxPreAuthFrameSize: 1 << 20,
+	}, requestCh)
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go serveStream(requestCh, stopCh, 100)
+
+	stream := &Request{ResponseCh: make(chan *Request, 1), Pkg: []byte("stream")}
+	clientConn.Send(stream)
+	select {
+	case response := <-stream.ResponseCh:
+		if !response.More {
+			t.Fatalf("got final response %q, err=>%v", response.Pkg, response.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no partial response")
+	}
+	// 放弃之后不再读 stream.ResponseCh
+	clientConn.Cancel(stream)
+
+	request := &Request{ResponseCh: make(chan *Request, 1), Pkg: []byte("ping")}
+	clientConn.Send(request)
+	select {
+	case response := <-request.ResponseCh:
+		if response.Err != nil || string(response.Pkg) != "ping" {
+			t.Fatalf("response=>%q, err=>%v", response.Pkg, response.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request after Cancel not completed")
+	}
+	if clientConn.IsClosed() {
+		t.Fatalf("conn closed")
+	}
+}
+
+// TestReconnectCancelStream 与 TestCancelStream 相同, 但经过 ReconnectClientConn, 由 ctx 放弃请求
+func TestReconnectCancelStream(t *testing.T) {
+	requestCh := make(chan *serverconn.Request, 16)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen fail=>%v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := serverconn.NewServerConn(context.Background(), conn, requestCh, &serverconn.Options{
+				MaxInFlight:         16,
+				MaxFrameSize:        1 << 20,
+				MaxPreAuthFrameSize: 1 << 20,
+			})
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			t.Cleanup(serverConn.Close)
+		}
+	}()
+	go serveStream(requestCh, stopCh, 100)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", ln.Addr().String())
+	}
+	rc, err := NewReconnectClientConn(context.Background(), dial, nil, nil, &Options{MaxFrameSize: 1 << 20, RequestTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("NewReconnectClientConn fail=>%v", err)
+	}
+	defer rc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &Request{ResponseCh: make(chan *Request, 1), Pkg: []byte("stream")}
+	rc.SendContext(ctx, stream)
+	select {
+	case response := <-stream.ResponseCh:
+		if !response.More {
+			t.Fatalf("got final response %q, err=>%v", response.Pkg, response.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no partial response")
+	}
+	// 像 mycp --dst=- | head 一样放弃请求后不再读 stream.ResponseCh
+	cancel()
+
+	request := &Request{ResponseCh: make(chan *Request, 1), Pkg: []byte("ping")}
+	rc.Send(request)
+	select {
+	case response := <-request.ResponseCh:
+		if response.Err != nil || string(response.Pkg) != "ping" {
+			t.Fatalf("response=>%q, err=>%v", response.Pkg, response.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request after cancel not completed")
+	}
+	if rc.State() != ConnStateReady {
+		t.Fatalf("state=>%v", rc.State())
+	}
+}
@@ -0,0 +1,388 @@
+package clientconn
+
+import (
+	"context"
+	"math/rand"
+	"mycp/mycplog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ConnState int
+
+const (
+	ConnStateConnecting ConnState = iota
+	ConnStateReady
+	ConnStateTransientFailure
+	ConnStateClosed
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case ConnStateConnecting:
+		return "CONNECTING"
+	case ConnStateReady:
+		return "READY"
+	case ConnStateTransientFailure:
+		return "TRANSIENT_FAILURE"
+	case ConnStateClosed:
+		return "CLOSED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// DialFunc 建立一条新的底层连接
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// AuthFunc 在每次建连成功后调用, 返回错误则视为这次建连失败
+type AuthFunc func(ctx context.Context, clientConn *ClientConn) error
+
+// ReconnectClientConn 在 ClientConn 断开后自动重连 (指数退避), 重新认证,
+// 并把 Idempotent 的未完成请求在新连接上重发.
+type ReconnectClientConn struct {
+	dial          DialFunc
+	auth          AuthFunc
+	onStateChange func(state ConnState)
+	opts          *Options
+
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxResubmit int
+
+	mutex      sync.Mutex
+	clientConn *ClientConn
+	state      ConnState
+	readyCh    chan struct{} // 连接可用时被 close, 断开后换成新的 chan
+
+	timeoutDur time.Duration
+
+	// 所有请求按 SendContext 的调用顺序排队, 由 GoSend 一个协程依次发送
+	sendCh chan *queuedRequest
+
+	closed   uint64
+	closedCh chan struct{}
+}
+
+type queuedRequest struct {
+	ctx       context.Context
+	request   *Request
+	submitCnt int
+}
+
+// NewReconnectClientConn 在 ctx 内同步地完成第一次建连和认证, 失败直接返回错误, 之后的断开才会自动重连.
+// onStateChange 可以为 nil, opts 用于每次新建的 ClientConn.
+func NewReconnectClientConn(ctx context.Context, dial DialFunc, auth AuthFunc, onStateChange func(state ConnState), opts *Options) (rc *ReconnectClientConn, err error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	rc = &ReconnectClientConn{
+		dial:          dial,
+		auth:          auth,
+		onStateChange: onStateChange,
+		opts:          opts,
+
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  10 * time.Second,
+		MaxResubmit: 3,
+
+		readyCh:    make(chan struct{}),
+		timeoutDur: opts.RequestTimeout,
+		sendCh:     make(chan *queuedRequest, maxCredit),
+		closedCh:   make(chan struct{}),
+	}
+
+	rc.setState(ConnStateConnecting)
+	var clientConn *ClientConn
+	clientConn, err = rc.connect(ctx)
+	if err != nil {
+		rc.setState(ConnStateClosed)
+		return nil, err
+	}
+	rc.setReady(clientConn)
+
+	go rc.GoReconnect()
+	go rc.GoSend()
+	return
+}
+
+func (rc *ReconnectClientConn) connect(ctx context.Context) (clientConn *ClientConn, err error) {
+	var conn net.Conn
+	conn, err = rc.dial(ctx)
+	if err != nil {
+		return
+	}
+	clientConn, err = NewClientConn(conn, rc.opts)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if rc.auth != nil {
+		err = rc.auth(ctx, clientConn)
+		if err != nil {
+			clientConn.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+func (rc *ReconnectClientConn) setState(state ConnState) {
+	rc.mutex.Lock()
+	changed := rc.state != state
+	rc.state = state
+	rc.mutex.Unlock()
+	if changed && rc.onStateChange != nil {
+		rc.onStateChange(state)
+	}
+}
+
+func (rc *ReconnectClientConn) setReady(clientConn *ClientConn) {
+	rc.mutex.Lock()
+	rc.clientConn = clientConn
+	close(rc.readyCh)
+	rc.mutex.Unlock()
+	rc.setState(ConnStateReady)
+}
+
+func (rc *ReconnectClientConn) State() ConnState {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.state
+}
+
+func (rc *ReconnectClientConn) GoReconnect() {
+	for !rc.IsClosed() {
+		rc.mutex.Lock()
+		clientConn := rc.clientConn
+		rc.mutex.Unlock()
+
+		select {
+		case <-clientConn.Done():
+		case <-rc.closedCh:
+			return
+		}
+		if rc.IsClosed() {
+			return
+		}
+
+		rc.mutex.Lock()
+		rc.readyCh = make(chan struct{})
+		rc.mutex.Unlock()
+		rc.setState(ConnStateTransientFailure)
+		clientConn.logger().Warnf("connection lost, be to reconnect")
+
+		backoff := rc.MinBackoff
+		for !rc.IsClosed() {
+			rc.setState(ConnStateConnecting)
+			ctx, cancel := context.WithTimeout(context.Background(), rc.timeoutDur)
+			newClientConn, err := rc.connect(ctx)
+			cancel()
+			if err == nil {
+				rc.setReady(newClientConn)
+				newClientConn.logger().Infof("reconnect succ")
+				break
+			}
+			mycplog.Warnf("reconnect fail=>%v, retry after %v", err, backoff)
+			rc.setState(ConnStateTransientFailure)
+
+			// 加一点抖动, 避免多个客户端同时重连
+			sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-time.After(sleep):
+			case <-rc.closedCh:
+				return
+			}
+			backoff *= 2
+			if backoff > rc.MaxBackoff {
+				backoff = rc.MaxBackoff
+			}
+		}
+	}
+}
+
+// Send 与 ClientConn.Send 语义相同, 响应写回 request.ResponseCh.
+// 如果请求因连接断开失败且 request.Idempotent, 则等重连成功后重发, 最多 MaxResubmit 次.
+func (rc *ReconnectClientConn) Send(request *Request) {
+	rc.SendContext(context.Background(), request)
+}
+
+// SendContext 与 Send 相同, ctx 被取消时放弃请求, request.Err 为 ctx.Err().
+// 请求按调用 SendContext 的顺序发送; 排队的请求太多时阻塞, 直到 ctx 被取消.
+func (rc *ReconnectClientConn) SendContext(ctx context.Context, request *Request) {
+	rc.enqueue(&queuedRequest{ctx: ctx, request: request})
+}
+
+func (rc *ReconnectClientConn) enqueue(queued *queuedRequest) {
+	select {
+	case rc.sendCh <- queued:
+	case <-rc.closedCh:
+		queued.request.Err = ErrClientConnClosed
+		queued.request.Done()
+		return
+	case <-queued.ctx.Done():
+		queued.request.Err = queued.ctx.Err()
+		queued.request.Done()
+		return
+	}
+	if rc.IsClosed() {
+		// GoSend 可能已经排空过 sendCh 了
+		rc.drainSendCh()
+	}
+}
+
+// GoSend 依次发送排队的请求. 每个请求要先等到连接可用并拿到服务端授予的额度,
+// 所以同时在等响应的请求 (每个一个协程) 不会超过服务端的额度.
+func (rc *ReconnectClientConn) GoSend() {
+	for {
+		select {
+		case queued := <-rc.sendCh:
+			rc.submit(queued)
+		case <-rc.closedCh:
+			rc.drainSendCh()
+			return
+		}
+	}
+}
+
+func (rc *ReconnectClientConn) drainSendCh() {
+	for {
+		select {
+		case queued := <-rc.sendCh:
+			queued.request.Err = ErrClientConnClosed
+			queued.request.Done()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *ReconnectClientConn) submit(queued *queuedRequest) {
+	ctx, request := queued.ctx, queued.request
+	err := ctx.Err()
+	if err != nil {
+		request.Err = err
+		request.Done()
+		return
+	}
+	clientConn, err := rc.waitReady(ctx, time.Now().Add(rc.timeoutDur))
+	if err != nil {
+		request.Err = err
+		request.Done()
+		return
+	}
+
+	var inner = &Request{
+		ResponseCh: make(chan *Request, 1),
+		Pkg:        request.Pkg,
+	}
+	if request.Encode != nil {
+		inner.Pkg = request.Encode(clientConn)
+	}
+	// 等到有额度才返回, 失败时 inner 已经带着错误写进了 inner.ResponseCh
+	clientConn.SendContext(ctx, inner)
+	go rc.wait(queued, clientConn, inner)
+}
+
+// wait 等待已经发出的请求的响应, 连接断开时把可以重发的请求重新排队
+func (rc *ReconnectClientConn) wait(queued *queuedRequest, clientConn *ClientConn, inner *Request) {
+	ctx, request := queued.ctx, queued.request
+	var gotPartial = false
+WAIT:
+	for {
+		select {
+		case response := <-inner.ResponseCh:
+			if response.More {
+				// 中间响应直接转给调用方. 已经有输出的请求不能再重发
+				gotPartial = true
+				var partial = &Request{
+					ResponseCh: request.ResponseCh,
+					Pkg:        response.Pkg,
+					More:       true,
+					seq:        response.seq,
+					connID:     response.connID,
+				}
+				// 调用方放弃请求后可能不再读 ResponseCh, 不能一直等在这里, 否则 inner 的响应也没人取
+				select {
+				case request.ResponseCh <- partial:
+					continue
+				case <-ctx.Done():
+				}
+			} else {
+				inner = response
+				break WAIT
+			}
+		case <-ctx.Done():
+		}
+		// Cancel 之后 GoReceive 丢弃 inner 的响应, 不会因为没人读 inner.ResponseCh 而阻塞
+		clientConn.Cancel(inner)
+		request.Err = ctx.Err()
+		request.Done()
+		return
+	}
+
+	if inner.Err == ErrClientConnClosed && request.Idempotent && !gotPartial && queued.submitCnt < rc.MaxResubmit && !rc.IsClosed() {
+		queued.submitCnt++
+		clientConn.logger().With("seq", inner.seq).Warnf("connection lost during request, resubmit. submitCnt=>%d", queued.submitCnt)
+		rc.enqueue(queued)
+		return
+	}
+
+	request.Pkg = inner.Pkg
+	request.Err = inner.Err
+	request.seq, request.connID = inner.seq, inner.connID
+	request.Done()
+}
+
+func (rc *ReconnectClientConn) waitReady(ctx context.Context, deadline time.Time) (clientConn *ClientConn, err error) {
+	for {
+		rc.mutex.Lock()
+		readyCh := rc.readyCh
+		clientConn = rc.clientConn
+		rc.mutex.Unlock()
+
+		select {
+		case <-readyCh:
+			if clientConn.IsClosed() {
+				// GoReconnect 还没来得及换掉 readyCh
+				if time.Now().After(deadline) {
+					return nil, ErrClientConnRequestTimeout
+				}
+				select {
+				case <-time.After(10 * time.Millisecond):
+					continue
+				case <-rc.closedCh:
+					return nil, ErrClientConnClosed
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return clientConn, nil
+		case <-rc.closedCh:
+			return nil, ErrClientConnClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Until(deadline)):
+			return nil, ErrClientConnRequestTimeout
+		}
+	}
+}
+
+func (rc *ReconnectClientConn) Close() {
+	if atomic.CompareAndSwapUint64(&rc.closed, 0, 1) {
+		close(rc.closedCh)
+		rc.mutex.Lock()
+		clientConn := rc.clientConn
+		rc.mutex.Unlock()
+		if clientConn != nil {
+			clientConn.Close()
+		}
+		rc.setState(ConnStateClosed)
+	}
+}
+
+func (rc *ReconnectClientConn) IsClosed() bool {
+	return atomic.LoadUint64(&rc.closed) == 1
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mycp/mycplog"
+	"os"
+	"strings"
+)
+
+// ExecMain 实现 mycp exec [flags] @ip:port:dir -- cmd [args...], 返回远端命令的退出码
+func ExecMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycp exec [flags] @ip:port:dir -- cmd [args...]\n")
+		fs.PrintDefaults()
+	}
+	auth := newAuthFlags(fs)
+	logs := newLogFlags(fs)
+	timeout := fs.Duration("timeout", 0, "overall deadline, 0 means no deadline")
+	_ = fs.Parse(args)
+	logs.apply()
+
+	rest := fs.Args()
+	if len(rest) > 1 && rest[1] == "--" {
+		rest = append(rest[:1:1], rest[2:]...)
+	}
+	if len(rest) < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := newContext(*timeout)
+	defer cancel()
+
+	client, _, dir := dialRemote(ctx, rest[0], auth)
+	defer client.Close()
+
+	exitCode, err := client.Exec(ctx, dir, rest[1:], os.Stdout, os.Stderr)
+	if err != nil {
+		mycplog.Fatalf("Exec fail=>%v", err)
+	}
+	return
+}
+
+// splitCommand 按 sh 的规则把 --then 的命令拆成参数: 空白分隔, 单引号内原样保留,
+// 双引号内只有 \\, \", \$, \` 和 \ 换行是转义, 引号外的 \ 转义下一个字符. 不做变量替换和通配符展开.
+func splitCommand(command string) (args []string, err error) {
+	var word strings.Builder
+	var inWord bool
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '\'':
+			inWord = true
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+		case r == '"':
+			inWord = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\\\"$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			if runes[i] == '\n' {
+				continue
+			}
+			inWord = true
+			word.WriteRune(runes[i])
+		default:
+			inWord = true
+			word.WriteRune(r)
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	cases := []struct {
+		command string
+		want    []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"  ", nil, true},
+		{"make test", []string{"make", "test"}, true},
+		{" go  test\t./... ", []string{"go", "test", "./..."}, true},
+		{`make -C "a b"`, []string{"make", "-C", "a b"}, true},
+		{`echo 'a "b" $c'`, []string{"echo", `a "b" $c`}, true},
+		{`echo "a \"b\" \$c \d"`, []string{"echo", `a "b" $c \d`}, true},
+		{`echo a\ b`, []string{"echo", "a b"}, true},
+		{`echo ''`, []string{"echo", ""}, true},
+		{`echo a"b c"'d'`, []string{"echo", "ab cd"}, true},
+		{"echo a\\\nb", []string{"echo", "ab"}, true},
+		{`echo 'a`, nil, false},
+		{`echo "a`, nil, false},
+		{`echo a\`, nil, false},
+	}
+	for _, c := range cases {
+		got, err := splitCommand(c.command)
+		if (err == nil) != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitCommand(%q)=>%q, %v", c.command, got, err)
+		}
+	}
+}
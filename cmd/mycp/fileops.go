@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileOpCmd 是远端文件管理子命令 (ls, stat, mkdir, rm, mv) 共用的部分
+type fileOpCmd struct {
+	fs      *flag.FlagSet
+	auth    *authFlags
+	logs    *logFlags
+	timeout *time.Duration
+	nArgs   int // 需要的位置参数个数
+}
+
+func newFileOpCmd(name, usage string, nArgs int) (cmd *fileOpCmd) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycp %s [flags] %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return &fileOpCmd{
+		fs:      fs,
+		auth:    newAuthFlags(fs),
+		logs:    newLogFlags(fs),
+		timeout: fs.Duration("timeout", 0, "overall deadline, 0 means no deadline"),
+		nArgs:   nArgs,
+	}
+}
+
+// run 解析 args 并连接第一个位置参数所在的远端, 然后调用 f. 参数不对时返回 2
+func (cmd *fileOpCmd) run(args []string, f func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string)) (exitCode int) {
+	_ = cmd.fs.Parse(args)
+	cmd.logs.apply()
+	if cmd.fs.NArg() != cmd.nArgs {
+		cmd.fs.Usage()
+		return 2
+	}
+
+	ctx, cancel := newContext(*cmd.timeout)
+	defer cancel()
+
+	client, remoteHost, realPath := dialRemote(ctx, cmd.fs.Arg(0), cmd.auth)
+	defer client.Close()
+
+	f(ctx, client, remoteHost, realPath, cmd.fs.Args()[1:])
+	return 0
+}
+
+// formatFileInfo 返回类似 ls -l 的一行
+func formatFileInfo(info *mycpproto.MyFileInfo) string {
+	name := info.Name
+	if info.IsDir {
+		name += "/"
+	}
+	return fmt.Sprintf("%s %12d %s %s", info.Mode, info.Size, info.ModTime.Format("2006-01-02 15:04:05"), name)
+}
+
+// LsMain 实现 mycp ls [flags] @ip:port:path
+func LsMain(args []string) (exitCode int) {
+	cmd := newFileOpCmd("ls", "@ip:port:path", 1)
+	return cmd.run(args, func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string) {
+		info, err := client.Stat(ctx, realPath)
+		if err != nil {
+			mycplog.Fatalf("Stat fail=>%v", err)
+		}
+		if !info.IsDir {
+			fmt.Println(formatFileInfo(info))
+			return
+		}
+		infos, err := client.List(ctx, realPath)
+		if err != nil {
+			mycplog.Fatalf("List fail=>%v", err)
+		}
+		for i := range infos {
+			fmt.Println(formatFileInfo(&infos[i]))
+		}
+	})
+}
+
+// StatMain 实现 mycp stat [flags] @ip:port:path
+func StatMain(args []string) (exitCode int) {
+	cmd := newFileOpCmd("stat", "@ip:port:path", 1)
+	return cmd.run(args, func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string) {
+		info, err := client.Stat(ctx, realPath)
+		if err != nil {
+			mycplog.Fatalf("Stat fail=>%v", err)
+		}
+		fileType := "file"
+		if info.IsDir {
+			fileType = "dir"
+		}
+		fmt.Printf("  Path: %s\n", realPath)
+		fmt.Printf("  Type: %s\n", fileType)
+		fmt.Printf("  Size: %d\n", info.Size)
+		fmt.Printf("  Mode: %s\n", info.Mode)
+		fmt.Printf("Modify: %s\n", info.ModTime.Format("2006-01-02 15:04:05.000000000 -0700"))
+	})
+}
+
+// MkdirMain 实现 mycp mkdir [flags] @ip:port:path
+func MkdirMain(args []string) (exitCode int) {
+	cmd := newFileOpCmd("mkdir", "@ip:port:path", 1)
+	parents := cmd.fs.Bool("p", false, "make parent dirs as needed, no error if the dir exists")
+	return cmd.run(args, func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string) {
+		err := client.Mkdir(ctx, realPath, *parents)
+		if err != nil {
+			mycplog.Fatalf("Mkdir fail=>%v", err)
+		}
+	})
+}
+
+// RmMain 实现 mycp rm [flags] @ip:port:path, 没有 --yes 时需要在终端确认
+func RmMain(args []string) (exitCode int) {
+	cmd := newFileOpCmd("rm", "@ip:port:path", 1)
+	recursive := cmd.fs.Bool("r", false, "remove dirs and their contents recursively")
+	yes := cmd.fs.Bool("yes", false, "do not ask for confirmation")
+	return cmd.run(args, func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string) {
+		if !*yes && !confirm(fmt.Sprintf("remove @%s:%s", remoteHost, realPath)) {
+			mycplog.Fatalf("aborted")
+		}
+		err := client.Remove(ctx, realPath, *recursive)
+		if err != nil {
+			mycplog.Fatalf("Remove fail=>%v", err)
+		}
+	})
+}
+
+// MvMain 实现 mycp mv [flags] @ip:port:oldpath [@ip:port:]newpath
+func MvMain(args []string) (exitCode int) {
+	cmd := newFileOpCmd("mv", "@ip:port:oldpath [@ip:port:]newpath", 2)
+	return cmd.run(args, func(ctx context.Context, client *mycpclient.Client, remoteHost, realPath string, rest []string) {
+		newPath := rest[0]
+		if strings.HasPrefix(newPath, "@") {
+			var newHost string
+			var err error
+			newHost, newPath, err = mycpclient.ParseRemotePath(newPath, remoteHost)
+			if err != nil {
+				mycplog.Fatalf("ParseRemotePath fail=>%v", err)
+			}
+			if newHost != remoteHost {
+				mycplog.Fatalf("mv only works within one remote host")
+			}
+		}
+		newPath = resolveRemote(remoteHost).path(newPath)
+		err := client.Rename(ctx, realPath, newPath)
+		if err != nil {
+			mycplog.Fatalf("Rename fail=>%v", err)
+		}
+	})
+}
+
+// confirm 在终端询问 prompt, 只有回答 y 或 yes 时返回 true
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s? [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completeFunc 根据光标前的内容 line[:pos] 做补全, 返回补全后的一行和光标位置,
+// 以及无法唯一补全时要展示给用户的候选项
+type completeFunc func(line []rune, pos int) (newLine []rune, newPos int, candidates []string)
+
+// lineEditor 是一个简单的行编辑器: 左右移动, 退格, 上下翻历史, Tab 补全, Ctrl-A/E/U/K/W/C/D.
+// stdin 不是终端 (或者不是 linux) 时退化为按行读取.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	complete completeFunc
+
+	history    []string
+	maxHistory int
+}
+
+func newLineEditor(complete completeFunc) *lineEditor {
+	return &lineEditor{
+		in:         bufio.NewReader(os.Stdin),
+		out:        os.Stdout,
+		complete:   complete,
+		maxHistory: 1000,
+	}
+}
+
+func (ed *lineEditor) AddHistory(line string) {
+	if line == "" || (len(ed.history) > 0 && ed.history[len(ed.history)-1] == line) {
+		return
+	}
+	ed.history = append(ed.history, line)
+	if len(ed.history) > ed.maxHistory {
+		ed.history = ed.history[len(ed.history)-ed.maxHistory:]
+	}
+}
+
+// ReadLine 显示 prompt 并读入一行, 输入结束 (Ctrl-D) 时返回 io.EOF
+func (ed *lineEditor) ReadLine(prompt string) (line string, err error) {
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return ed.readLinePlain(prompt)
+	}
+	defer restore()
+	return ed.readLineRaw(prompt)
+}
+
+func (ed *lineEditor) readLinePlain(prompt string) (line string, err error) {
+	fmt.Fprint(ed.out, prompt)
+	line, err = ed.in.ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (ed *lineEditor) readLineRaw(prompt string) (line string, err error) {
+	var buf []rune
+	var pos int
+	historyIdx := len(ed.history)
+	var editing []rune // 翻历史前正在编辑的内容
+
+	refresh := func() {
+		fmt.Fprintf(ed.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(ed.out, "\x1b[%dD", back)
+		}
+	}
+	showHistory := func(idx int) {
+		if historyIdx == len(ed.history) {
+			editing = buf
+		}
+		historyIdx = idx
+		if idx == len(ed.history) {
+			buf = editing
+		} else {
+			buf = []rune(ed.history[idx])
+		}
+		pos = len(buf)
+		refresh()
+	}
+
+	fmt.Fprint(ed.out, prompt)
+	for {
+		r, _, err := ed.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(ed.out, "\n")
+			return string(buf), nil
+		case 3: // Ctrl-C, 放弃这一行
+			fmt.Fprint(ed.out, "^C\n")
+			buf, pos = nil, 0
+			historyIdx = len(ed.history)
+			fmt.Fprint(ed.out, prompt)
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(ed.out, "\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos:pos], buf[pos+1:]...)
+				refresh()
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1:pos-1], buf[pos:]...)
+				pos--
+				refresh()
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			refresh()
+		case 5: // Ctrl-E
+			pos = len(buf)
+			refresh()
+		case 11: // Ctrl-K
+			buf = buf[:pos:pos]
+			refresh()
+		case 21: // Ctrl-U
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+			refresh()
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start:start], buf[pos:]...)
+			pos = start
+			refresh()
+		case '\t':
+			if ed.complete == nil {
+				continue
+			}
+			newLine, newPos, candidates := ed.complete(buf, pos)
+			if len(candidates) > 0 {
+				fmt.Fprintf(ed.out, "\n%s\n", strings.Join(candidates, "  "))
+			}
+			buf, pos = newLine, newPos
+			refresh()
+		case 27: // ESC, 方向键等
+			seq := ed.readEscape()
+			switch seq {
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+					refresh()
+				}
+			case "[C", "OC":
+				if pos < len(buf) {
+					pos++
+					refresh()
+				}
+			case "[A", "OA":
+				if historyIdx > 0 {
+					showHistory(historyIdx - 1)
+				}
+			case "[B", "OB":
+				if historyIdx < len(ed.history) {
+					showHistory(historyIdx + 1)
+				}
+			case "[H", "OH", "[1~":
+				pos = 0
+				refresh()
+			case "[F", "OF", "[4~":
+				pos = len(buf)
+				refresh()
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos:pos], buf[pos+1:]...)
+					refresh()
+				}
+			}
+		default:
+			if r < 32 {
+				continue
+			}
+			buf = append(buf[:pos:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+			refresh()
+		}
+	}
+}
+
+// readEscape 读 ESC 之后的控制序列, 比如 "[A"
+func (ed *lineEditor) readEscape() string {
+	first, err := ed.in.ReadByte()
+	if err != nil || (first != '[' && first != 'O') {
+		return ""
+	}
+	seq := []byte{first}
+	for {
+		b, err := ed.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e {
+			return string(seq)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"mycp/mycplog"
+)
+
+// logFlags 是所有子命令共用的 -v, -q 和 --log-format
+type logFlags struct {
+	verbose *bool
+	quiet   *bool
+	format  *string
+}
+
+func newLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		verbose: fs.Bool("v", false, "verbose, also print debug logs with the conn and seq of each request"),
+		quiet:   fs.Bool("q", false, "quiet, only print warnings and errors"),
+		format:  fs.String("log-format", "text", "format of logs, text or json"),
+	}
+}
+
+// apply 在解析参数之后调用, 按参数设置日志级别和格式. 参数不对时直接退出进程.
+func (f *logFlags) apply() {
+	if *f.verbose && *f.quiet {
+		mycplog.Fatalf("-v and -q can not be used together")
+	}
+	if *f.verbose {
+		mycplog.SetLevel(mycplog.LevelDebug)
+	} else if *f.quiet {
+		mycplog.SetLevel(mycplog.LevelWarn)
+	}
+	err := mycplog.SetFormat(*f.format)
+	if err != nil {
+		mycplog.Fatalf("SetFormat fail=>%v", err)
+	}
+}
@@ -1,80 +1,474 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	srcPath      = flag.String("src", "@10.252.156.170:31001:D:/work/study/study-golang03/demos/mycp/tmp/a_dir/", "src path")
+	srcPaths     = &pathsFlag{values: []string{"@10.252.156.170:31001:D:/work/study/study-golang03/demos/mycp/tmp/a_dir/"}}
 	dstPath      = flag.String("dst", "D:/work/study/study-golang03/demos/mycp/tmp/b_dir/", "dst path")
 	onlyModified = flag.Bool("modified", false, "only cp modified files")
-	password     = flag.String("password", "OarTkJdFdjYzLEjS", "password")
+	timeout      = flag.Duration("timeout", 0, "overall deadline of this mycp, 0 means no deadline")
+	then         = flag.String("then", "", "command to run on the server in the dst dir after a successful upload, e.g. \"make test\"")
+	auth         = newAuthFlags(flag.CommandLine)
+	logs         = newLogFlags(flag.CommandLine)
+	dstUser      = flag.String("dst-user", "", "user on the dst server when both src and dst are remote, default to the User of its profile")
+	dstPassword  = flag.String("dst-password", "", "deprecated like --password. Password of the dst server when both src and dst are remote, default to the password source of its profile, then --password and env "+PasswordEnv)
+	tarMode      = flag.Bool("tar", false, "transfer each src as one tar stream and extract it into the dst dir, faster for many small files")
+	manifestMode = flag.Bool("manifest", false, "only send files that differ from the manifest the server keeps of the dst tree, incremental from any machine without local state")
+	excludes     = &pathsFlag{}
+	output       = flag.String("output", "text", "text or json: json prints to stdout one object per file (created, overwritten, skipped-unmodified or failed) and a final summary")
 )
 
-func MyCP() {
+func init() {
+	flag.Var(srcPaths, "src", "src path, may be repeated or contain globs (* ? [...]) to cp several paths into the dst dir")
+	flag.Var(excludes, "exclude", "skip files and dirs whose name matches this pattern, may be repeated, added to the Exclude of the profile")
+}
+
+// pathsFlag 是可以重复出现的 flag, 第一次出现时替换掉默认值
+type pathsFlag struct {
+	values []string
+	set    bool
+}
+
+func (f *pathsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, " ")
+}
+
+func (f *pathsFlag) Set(value string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	f.values = append(f.values, value)
+	return nil
+}
+
+// newContext 返回的 ctx 在收到 SIGINT/SIGTERM 或者超过 timeout 时被取消, timeout 为 0 表示不限时
+func newContext(timeout time.Duration) (ctx context.Context, cancel context.CancelFunc) {
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signalCh:
+			mycplog.Infof("got signal %v, be to cancel", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signalCh)
+	}()
+	return
+}
+
+// srcAndDst 返回所有的源路径和目标路径. 除了 --src 和 --dst, 也可以像 cp 一样写成 mycp [flags] src... dst
+func srcAndDst() (srcs []string, dst string) {
+	if flag.NArg() == 0 {
+		return srcPaths.values, *dstPath
+	}
+	var dstSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "dst" {
+			dstSet = true
+		}
+	})
+	if srcPaths.set || dstSet || flag.NArg() < 2 {
+		mycplog.Fatalf("use either --src/--dst or positional args src... dst")
+	}
+	return flag.Args()[:flag.NArg()-1], flag.Arg(flag.NArg() - 1)
+}
+
+// MyCP 返回进程的退出码, 见 exitOK 等; 有 --then 时是远端命令的退出码.
+// 一个文件失败时继续拷贝其他文件, 连接断开等错误会中止拷贝.
+func MyCP() (exitCode int) {
 	var err error
+	result := newCopyResult(*output)
+
+	ctx, cancel := newContext(*timeout)
+	defer cancel()
 
 	// 读 MyCPInfo
 	myCPInfo, err := mycpclient.ReadMyCPInfo()
 	if err != nil {
-		log.Fatalf("ReadMyCPInfo fail=>%v", err)
+		mycplog.Fatalf("ReadMyCPInfo fail=>%v", err)
 	}
 
-	realSrcPath, realDstPath, remoteHost, remoteIsSrc, err := mycpclient.ParsePath(*srcPath, *dstPath, myCPInfo.LastRemoteHost)
-	if err != nil {
-		log.Fatalf("ParsePath fail=>%v", err)
+	srcs, dst := srcAndDst()
+	if strings.HasPrefix(strings.TrimSpace(srcs[0]), "@") && strings.HasPrefix(strings.TrimSpace(dst), "@") {
+		MyCPFromRemoteToRemote(ctx, myCPInfo, srcs, dst, result)
+		exitCode = result.exitCode()
+		result.print(exitCode)
+		return
 	}
 
-	var client *mycpclient.Client
-	client, err = mycpclient.NewClient(remoteHost)
-	if err != nil {
-		log.Fatalf("NewClient fail=>%v", err)
+	// 所有的源路径必须在同一端
+	var realSrcPaths []string
+	var realDstPath, remoteHost string
+	var remoteIsSrc bool
+	for idx, src := range srcs {
+		realSrcPath, thisRealDstPath, thisRemoteHost, thisRemoteIsSrc, err := mycpclient.ParsePath(src, dst, myCPInfo.LastRemoteHost)
+		if err != nil {
+			mycplog.Fatalf("ParsePath fail=>%v", err)
+		}
+		if idx > 0 && (thisRemoteHost != remoteHost || thisRemoteIsSrc != remoteIsSrc) {
+			mycplog.Fatalf("all srcs must be on the same side and the same remote host")
+		}
+		realSrcPaths = append(realSrcPaths, realSrcPath)
+		realDstPath, remoteHost, remoteIsSrc = thisRealDstPath, thisRemoteHost, thisRemoteIsSrc
 	}
-	defer client.Close()
 
-	var hostSrcPath string
+	// remoteHost 可能是 profile 的名字, 远端的相对路径相对于 profile 的 Root
+	r := resolveRemote(remoteHost)
 	if remoteIsSrc {
-		hostSrcPath = fmt.Sprintf("@%s:%s", remoteHost, realSrcPath)
+		for idx := range realSrcPaths {
+			realSrcPaths[idx] = r.path(realSrcPaths[idx])
+		}
 	} else {
-		hostSrcPath = realSrcPath
+		realDstPath = r.path(realDstPath)
+	}
+	client := r.dial(ctx, auth)
+	defer client.Close()
+
+	// 展开通配符, 远端的通配符由服务端展开
+	realSrcPaths, multi := expandSrcPaths(realSrcPaths, func(pattern string) ([]string, error) {
+		if remoteIsSrc {
+			return client.Glob(ctx, pattern)
+		}
+		return localGlob(pattern)
+	})
+	if multi && realDstPath != "-" {
+		realDstPath = dstDir(realDstPath)
+	}
+	if result.encoder != nil && (realDstPath == "-" || *then != "") {
+		mycplog.Fatalf("--output=json writes to stdout, it can not be used with - as dst or --then")
+	}
+	// 在拷贝前解析 --then, 引号不匹配时不拷贝
+	thenArgs, err := splitCommand(*then)
+	if err == nil && *then != "" && len(thenArgs) == 0 {
+		err = errors.New("empty command")
+	}
+	if err != nil {
+		mycplog.Fatalf("bad --then=>%v", err)
+	}
+	if *then != "" && remoteIsSrc {
+		mycplog.Fatalf("--then only works when dst is remote")
+	}
+	if *manifestMode && (remoteIsSrc || *tarMode || *onlyModified) {
+		mycplog.Fatalf("--manifest only works when dst is remote, and can not be used with --tar or --modified")
 	}
 
-	thisMyCPTime := time.Now()
+	// 上次 mycp 时间以源路径所在机器的时钟计, 这样不受两端时钟差异的影响
+	thisMyCPTime, srcClock := time.Now(), false
 	if remoteIsSrc {
-		// 执行 MyCPFromRemoteToLocal
-		log.Printf("MyCPFromRemoteToLocal start")
-		err = client.MyCPFromRemoteToLocal(realSrcPath, realDstPath, *onlyModified, myCPInfo.Path2LastMyCPTime[hostSrcPath], *password)
-		if err != nil {
-			log.Fatalf("MyCPFromRemoteToLocal fail=>%v", err)
+		thisMyCPTime, srcClock = client.ServerNow()
+	}
+	var copiedHostSrcPaths []string
+	for _, realSrcPath := range realSrcPaths {
+		if realSrcPath == "-" {
+			// 从 stdin 读, 没有上次 mycp 时间
+			if len(realSrcPaths) > 1 {
+				mycplog.Fatalf("- can not be used with other srcs")
+			}
+			mycplog.Infof("PutStream start. dst=>%s", realDstPath)
+			err = client.PutStreamWithOptions(ctx, os.Stdin, realDstPath, *tarMode, &mycpclient.MyCPOptions{OnFile: result.onFile})
+			if err != nil {
+				mycplog.Warnf("PutStream fail=>%v", err)
+				result.fail("-", realDstPath, err)
+				break
+			}
+			mycplog.Infof("PutStream done.")
+			continue
+		}
+
+		var hostSrcPath string
+		if remoteIsSrc {
+			hostSrcPath = fmt.Sprintf("@%s:%s", remoteHost, realSrcPath)
+		} else {
+			hostSrcPath = realSrcPath
+		}
+
+		var opts = &mycpclient.MyCPOptions{
+			OnlyModified: *onlyModified,
+			LastMyCPTime: myCPInfo.Path2LastMyCPTime[hostSrcPath],
+			SrcClock:     myCPInfo.SrcClockPaths[hostSrcPath],
+			Exclude:      r.exclude(excludes.values),
+			OnFile:       result.onFile,
+		}
+		if remoteIsSrc && realDstPath == "-" {
+			// 写到 stdout
+			mycplog.Infof("GetStream start. src=>%s", realSrcPath)
+			w := &countingWriter{w: os.Stdout}
+			err = client.GetStream(ctx, realSrcPath, w, *tarMode, opts)
+			if err == nil {
+				result.onFile(&mycpclient.FileEvent{Action: mycpclient.FileCreated, Src: realSrcPath, Dst: "-", Bytes: w.n})
+				mycplog.Infof("GetStream done.")
+			} else {
+				mycplog.Warnf("GetStream fail=>%v", err)
+			}
+		} else if *tarMode {
+			mycplog.Infof("tar start. src=>%s", realSrcPath)
+			if remoteIsSrc {
+				err = client.MyCPTarFromRemoteToLocal(ctx, realSrcPath, realDstPath, opts)
+			} else {
+				err = client.MyCPTarFromLocalToRemote(ctx, realSrcPath, realDstPath, opts)
+			}
+			if err == nil {
+				mycplog.Infof("tar done.")
+			} else {
+				mycplog.Warnf("tar fail=>%v", err)
+			}
+		} else if *manifestMode {
+			mycplog.Infof("MyCPSyncFromLocalToRemote start. src=>%s", realSrcPath)
+			err = client.MyCPSyncFromLocalToRemote(ctx, realSrcPath, realDstPath, opts)
+			if err == nil {
+				mycplog.Infof("MyCPSyncFromLocalToRemote done.")
+			} else {
+				mycplog.Warnf("MyCPSyncFromLocalToRemote fail=>%v", err)
+			}
+		} else if remoteIsSrc {
+			// 执行 MyCPFromRemoteToLocal
+			mycplog.Infof("MyCPFromRemoteToLocal start. src=>%s", realSrcPath)
+			err = client.MyCPFromRemoteToLocal(ctx, realSrcPath, realDstPath, opts)
+			if err == nil {
+				mycplog.Infof("MyCPFromRemoteToLocal done.")
+			} else {
+				mycplog.Warnf("MyCPFromRemoteToLocal fail=>%v", err)
+			}
+		} else {
+			// 执行 MyCPFromLocalToRemote
+			mycplog.Infof("MyCPFromLocalToRemote start. src=>%s", realSrcPath)
+			err = client.MyCPFromLocalToRemote(ctx, realSrcPath, realDstPath, opts)
+			if err == nil {
+				mycplog.Infof("MyCPFromLocalToRemote done.")
+			} else {
+				mycplog.Warnf("MyCPFromLocalToRemote fail=>%v", err)
+			}
 		}
-		log.Printf("MyCPFromRemoteToLocal done.")
-	} else {
-		// 执行 MyCPFromLocalToRemote
-		log.Printf("MyCPFromLocalToRemote start")
-		err = client.MyCPFromLocalToRemote(realSrcPath, realDstPath, *onlyModified, myCPInfo.Path2LastMyCPTime[hostSrcPath], *password)
 		if err != nil {
-			log.Fatalf("MyCPFromLocalToRemote fail=>%v", err)
+			// 有文件失败的源路径不更新上次 mycp 时间, 下次 --modified 时还会拷贝
+			if result.fail(realSrcPath, realDstPath, err) {
+				break
+			}
+			continue
 		}
-		log.Printf("MyCPFromLocalToRemote done.")
+		copiedHostSrcPaths = append(copiedHostSrcPaths, hostSrcPath)
 	}
 
 	// 更新 MyCPInfo
-	myCPInfo.Path2LastMyCPTime[hostSrcPath] = thisMyCPTime
-	myCPInfo.LastRemoteHost = remoteHost
-	err = mycpclient.WriteMyCPInfo(myCPInfo)
+	err = mycpclient.UpdateMyCPInfo(func(myCPInfo *mycpproto.MyCPInfo) {
+		for _, hostSrcPath := range copiedHostSrcPaths {
+			myCPInfo.SetLastMyCPTime(hostSrcPath, thisMyCPTime, srcClock)
+		}
+		myCPInfo.LastRemoteHost = remoteHost
+	})
 	if err != nil {
-		log.Fatalf("WriteMyCPInfo fail=>%v", err)
+		mycplog.Fatalf("UpdateMyCPInfo fail=>%v", err)
+	}
+
+	exitCode = result.exitCode()
+	result.print(exitCode)
+	if *then != "" {
+		if exitCode != exitOK && exitCode != exitNothing {
+			mycplog.Warnf("skip --then because some files failed")
+			return
+		}
+		execDir := realDstPath
+		if !multi {
+			execDir = thenDir(realSrcPaths[0], realDstPath)
+		}
+		mycplog.Infof("be to exec=>%q in %s", thenArgs, execDir)
+		exitCode, err = client.Exec(ctx, execDir, thenArgs, os.Stdout, os.Stderr)
+		if err != nil {
+			mycplog.Fatalf("Exec fail=>%v", err)
+		}
 	}
+	return
+}
 
+// expandSrcPaths 用 glob 展开含有通配符的源路径, 没有匹配时退出.
+// multi 表示有多个源路径或者用到了通配符, 这时 dst 必须是路径.
+func expandSrcPaths(srcPaths []string, glob func(pattern string) ([]string, error)) (expanded []string, multi bool) {
+	multi = len(srcPaths) > 1
+	for _, srcPath := range srcPaths {
+		if !mycpclient.HasGlobMeta(srcPath) {
+			expanded = append(expanded, srcPath)
+			continue
+		}
+		multi = true
+		matches, err := glob(srcPath)
+		if err != nil {
+			mycplog.Fatalf("Glob fail=>%v", err)
+		}
+		if len(matches) == 0 {
+			mycplog.Fatalf("no match for %s", srcPath)
+		}
+		expanded = append(expanded, matches...)
+	}
 	return
 }
 
+func localGlob(pattern string) (matches []string, err error) {
+	matches, err = filepath.Glob(pattern)
+	for idx := range matches {
+		matches[idx] = filepath.ToSlash(matches[idx])
+	}
+	return
+}
+
+// dstDir 让 dst 以 '/' 结尾, 这样多个源路径都会按照 "拷贝至路径 dst 下" 的规则处理,
+// dst 是已存在的文件时拷贝会失败
+func dstDir(dst string) string {
+	if strings.HasSuffix(dst, "/") {
+		return dst
+	}
+	return dst + "/"
+}
+
+// MyCPFromRemoteToRemote 让 src 所在的服务端直接把文件推送到 dst 所在的服务端
+// 推送中的文件不逐个报告, 每个推送成功的源路径计入 result 的 Pushed.
+func MyCPFromRemoteToRemote(ctx context.Context, myCPInfo *mycpproto.MyCPInfo, srcs []string, dst string, result *copyResult) {
+	if *then != "" {
+		mycplog.Fatalf("--then only works when src is local")
+	}
+	if *manifestMode {
+		mycplog.Fatalf("--manifest only works when src is local")
+	}
+	var realSrcPaths []string
+	var srcHost string
+	for idx, src := range srcs {
+		thisSrcHost, realSrcPath, err := mycpclient.ParseRemotePath(src, myCPInfo.LastRemoteHost)
+		if err != nil {
+			mycplog.Fatalf("ParseRemotePath fail=>%v", err)
+		}
+		if idx > 0 && thisSrcHost != srcHost {
+			mycplog.Fatalf("all srcs must be on the same remote host")
+		}
+		srcHost = thisSrcHost
+		realSrcPaths = append(realSrcPaths, realSrcPath)
+	}
+	dstHost, realDstPath, err := mycpclient.ParseRemotePath(dst, myCPInfo.LastRemoteHost)
+	if err != nil {
+		mycplog.Fatalf("ParseRemotePath fail=>%v", err)
+	}
+	srcRemote, dstRemote := resolveRemote(srcHost), resolveRemote(dstHost)
+	for idx := range realSrcPaths {
+		realSrcPaths[idx] = srcRemote.path(realSrcPaths[idx])
+	}
+	realDstPath = dstRemote.path(realDstPath)
+	// dst 的密码由 src 所在的服务端使用, 连接 dst 时用的是 profile 中的地址
+	dstPasswordResolved := dstRemote.password("dst-password", *dstPassword, *auth.password)
+
+	client := srcRemote.dial(ctx, auth)
+	defer client.Close()
+
+	realSrcPaths, multi := expandSrcPaths(realSrcPaths, func(pattern string) ([]string, error) {
+		return client.Glob(ctx, pattern)
+	})
+	if multi {
+		realDstPath = dstDir(realDstPath)
+	}
+
+	// 文件由 src 所在的服务端比较修改时间, 上次 mycp 时间以它的时钟计
+	thisMyCPTime, srcClock := client.ServerNow()
+	var copiedHostSrcPaths []string
+	for _, realSrcPath := range realSrcPaths {
+		hostSrcPath := fmt.Sprintf("@%s:%s", srcHost, realSrcPath)
+		var opts = &mycpclient.MyCPOptions{
+			OnlyModified: *onlyModified,
+			LastMyCPTime: myCPInfo.Path2LastMyCPTime[hostSrcPath],
+			SrcClock:     myCPInfo.SrcClockPaths[hostSrcPath],
+			Exclude:      srcRemote.exclude(excludes.values),
+		}
+		mycplog.Infof("MyCPFromRemoteToRemote start. @%s pushes %s to @%s", srcHost, realSrcPath, dstHost)
+		err = client.MyCPFromRemoteToRemote(ctx, realSrcPath, dstRemote.address, dstPasswordResolved, &mycpclient.ClientOptions{
+			User:   dstRemote.user(*dstUser),
+			TLSPin: dstRemote.tlsPin(),
+		}, realDstPath, opts)
+		if err != nil {
+			mycplog.Warnf("MyCPFromRemoteToRemote fail=>%v", err)
+			var remoteErr *mycpclient.RemoteError
+			if !errors.As(err, &remoteErr) {
+				result.fail(realSrcPath, realDstPath, err)
+				break
+			}
+			result.onFile(&mycpclient.FileEvent{Action: mycpclient.FileFailed, Src: realSrcPath, Dst: realDstPath, Err: err})
+			continue
+		}
+		mycplog.Infof("MyCPFromRemoteToRemote done.")
+		result.summary.Pushed++
+		copiedHostSrcPaths = append(copiedHostSrcPaths, hostSrcPath)
+	}
+
+	// 更新 MyCPInfo, @R 指向 dst 所在的服务端
+	err = mycpclient.UpdateMyCPInfo(func(myCPInfo *mycpproto.MyCPInfo) {
+		for _, hostSrcPath := range copiedHostSrcPaths {
+			myCPInfo.SetLastMyCPTime(hostSrcPath, thisMyCPTime, srcClock)
+		}
+		myCPInfo.LastRemoteHost = dstHost
+	})
+	if err != nil {
+		mycplog.Fatalf("UpdateMyCPInfo fail=>%v", err)
+	}
+}
+
+// thenDir 返回 --then 的命令在远端执行的路径: 源是路径时是拷贝后的那个路径, 源是文件时是 dst
+// (dst 是文件时服务端会在它所在的路径下执行)
+func thenDir(srcPath, dstPath string) string {
+	srcPathInfo, err := os.Stat(srcPath)
+	if err != nil || !srcPathInfo.IsDir() {
+		return dstPath
+	}
+	srcPathTrimmed := strings.TrimSuffix(srcPath, "/")
+	for len(srcPathTrimmed) >= 2 && strings.HasSuffix(srcPathTrimmed, "/") {
+		srcPathTrimmed = strings.TrimSuffix(srcPathTrimmed, "/")
+	}
+	_, srcPathLast := filepath.Split(srcPathTrimmed)
+	return fmt.Sprintf("%s/%s", dstPath, srcPathLast)
+}
+
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "exec":
+			os.Exit(ExecMain(os.Args[2:]))
+		case "watch":
+			os.Exit(WatchMain(os.Args[2:]))
+		case "ls":
+			os.Exit(LsMain(os.Args[2:]))
+		case "stat":
+			os.Exit(StatMain(os.Args[2:]))
+		case "mkdir":
+			os.Exit(MkdirMain(os.Args[2:]))
+		case "rm":
+			os.Exit(RmMain(os.Args[2:]))
+		case "mv":
+			os.Exit(MvMain(os.Args[2:]))
+		case "shell":
+			os.Exit(ShellMain(os.Args[2:]))
+		case "state":
+			os.Exit(StateMain(os.Args[2:]))
+		}
+	}
 	flag.Parse()
-	MyCP()
+	logs.apply()
+	os.Exit(MyCP())
 }
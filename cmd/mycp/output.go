@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"os"
+)
+
+// mycp 拷贝文件时的退出码, 有 --then 时是远端命令的退出码
+const (
+	exitOK      = 0
+	exitFailed  = 1 // 全部失败, 或者还没开始拷贝就失败了
+	exitUsage   = 2 // 参数不对, 与 flag 包相同
+	exitPartial = 3 // 有文件失败, 也有文件成功
+	exitNothing = 4 // 没有失败, 但也没有需要拷贝的文件, 比如 --modified 时都没有修改
+)
+
+// fileEventJSON 是 --output=json 时每个文件的一行
+type fileEventJSON struct {
+	Event  string // 总是 file
+	Action string // created, overwritten, skipped-unmodified 或 failed
+	Src    string
+	Dst    string
+	Bytes  int64  `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	Code   string `json:",omitempty"` // 失败的原因, 见 mycpclient.ErrorCode
+	// 服务端用去重缓存中的内容写了这个文件, 没有传输内容
+	Deduped bool `json:",omitempty"`
+}
+
+// summaryJSON 是 --output=json 时最后的一行
+type summaryJSON struct {
+	Event       string // 总是 summary
+	Created     int
+	Overwritten int
+	Skipped     int
+	Failed      int
+	Pushed      int `json:",omitempty"` // 两端都是远端时推送成功的源路径数, 其中的文件不逐个报告
+	Deduped     int `json:",omitempty"` // Created 和 Overwritten 中用去重缓存写的文件数
+	Bytes       int64
+	Result      string // ok, partial, failed 或 nothing
+	ExitCode    int
+	Error       string `json:",omitempty"` // 中止拷贝的错误
+}
+
+// copyResult 汇总一次 mycp 中每个文件的结果, --output=json 时同时把每个结果输出到 stdout
+type copyResult struct {
+	encoder *json.Encoder // 为 nil 时不输出
+	summary summaryJSON
+}
+
+func newCopyResult(output string) (result *copyResult) {
+	result = &copyResult{}
+	switch output {
+	case "text":
+	case "json":
+		result.encoder = json.NewEncoder(os.Stdout)
+		result.encoder.SetEscapeHTML(false)
+		// 参数不对或者中途失败而退出时也输出 summary
+		mycplog.SetFatalHook(func(msg string) {
+			result.summary.Error = msg
+			result.print(exitFailed)
+		})
+	default:
+		mycplog.Fatalf("unknown --output %q, want text or json", output)
+	}
+	return result
+}
+
+// onFile 用作 MyCPOptions.OnFile
+func (result *copyResult) onFile(event *mycpclient.FileEvent) {
+	switch event.Action {
+	case mycpclient.FileCreated:
+		result.summary.Created++
+	case mycpclient.FileOverwritten:
+		result.summary.Overwritten++
+	case mycpclient.FileSkipped:
+		result.summary.Skipped++
+	case mycpclient.FileFailed:
+		result.summary.Failed++
+	}
+	if event.Deduped {
+		result.summary.Deduped++
+	}
+	result.summary.Bytes += event.Bytes
+	if result.encoder == nil {
+		return
+	}
+	line := &fileEventJSON{Event: "file", Action: event.Action, Src: event.Src, Dst: event.Dst, Bytes: event.Bytes, Deduped: event.Deduped}
+	if event.Err != nil {
+		line.Error, line.Code = event.Err.Error(), mycpclient.ErrorCode(event.Err)
+	}
+	_ = result.encoder.Encode(line)
+}
+
+// fail 记录拷贝 src 的错误 err, 返回是否应该中止整个拷贝. 已经通过 onFile 报告过的 FileError 不再报告,
+// 其他错误 (比如连接断开) 作为 src 的失败报告.
+func (result *copyResult) fail(src, dst string, err error) (abort bool) {
+	var fileErr *mycpclient.FileError
+	if errors.As(err, &fileErr) {
+		return false
+	}
+	result.onFile(&mycpclient.FileEvent{Action: mycpclient.FileFailed, Src: src, Dst: dst, Err: err})
+	return true
+}
+
+// exitCode 按已经汇总的结果返回退出码
+func (result *copyResult) exitCode() int {
+	done := result.summary.Created + result.summary.Overwritten + result.summary.Pushed
+	switch {
+	case result.summary.Failed > 0 && done+result.summary.Skipped > 0:
+		return exitPartial
+	case result.summary.Failed > 0:
+		return exitFailed
+	case done == 0:
+		return exitNothing
+	default:
+		return exitOK
+	}
+}
+
+// print 输出汇总, --output=text 时输出到日志
+func (result *copyResult) print(exitCode int) {
+	summary := &result.summary
+	summary.Event, summary.ExitCode = "summary", exitCode
+	switch exitCode {
+	case exitOK:
+		summary.Result = "ok"
+	case exitPartial:
+		summary.Result = "partial"
+	case exitNothing:
+		summary.Result = "nothing"
+	default:
+		summary.Result = "failed"
+	}
+	if result.encoder != nil {
+		_ = result.encoder.Encode(summary)
+		return
+	}
+	mycplog.Infof("created %d, overwritten %d, skipped %d, failed %d, deduped %d, total %d Bytes",
+		summary.Created, summary.Overwritten, summary.Skipped, summary.Failed, summary.Deduped, summary.Bytes)
+}
+
+// countingWriter 记录写入 w 的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"mycp/clientconn"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"os"
+)
+
+// PasswordEnv 是既没有 --password 也没有 profile 配置的密码时读取密码的环境变量
+const PasswordEnv = "MYCP_PASSWORD"
+
+// authFlags 是连接远端用的 --user 和 --password
+type authFlags struct {
+	user     *string
+	password *string
+}
+
+func newAuthFlags(fs *flag.FlagSet) *authFlags {
+	return &authFlags{
+		user:     fs.String("user", "", "user on the server, default to the User of the profile, needed only when the server has several users"),
+		password: fs.String("password", "", "deprecated, the password can be seen in ps and the shell history. Use the password source of the profile in the config file, or env "+PasswordEnv),
+	}
+}
+
+var loadedConfig *mycpclient.Config
+
+// config 返回客户端的配置文件, 只读一次. 失败时直接退出进程.
+func config() *mycpclient.Config {
+	if loadedConfig == nil {
+		var err error
+		loadedConfig, err = mycpclient.LoadConfig()
+		if err != nil {
+			mycplog.Fatalf("LoadConfig fail=>%v", err)
+		}
+	}
+	return loadedConfig
+}
+
+// remote 是 ParseRemotePath 得到的 remoteHost 解析后的结果
+type remote struct {
+	host    string              // ip:port 或 profile 的名字, 记录在 MyCPInfo 中
+	address string              // ip:port
+	profile *mycpclient.Profile // host 是 ip:port 时为 nil
+}
+
+// resolveRemote 通过配置文件解析 remoteHost. 失败时直接退出进程.
+func resolveRemote(remoteHost string) (r *remote) {
+	profile, err := config().Profile(remoteHost)
+	if err != nil {
+		mycplog.Fatalf("Profile fail=>%v", err)
+	}
+	r = &remote{
+		host:    remoteHost,
+		address: remoteHost,
+		profile: profile,
+	}
+	if profile != nil {
+		r.address = profile.Address
+	}
+	return r
+}
+
+// path 把相对路径解释为相对于 profile 的 Root 的路径
+func (r *remote) path(realPath string) string {
+	return r.profile.RemotePath(realPath)
+}
+
+// password 返回连接 r 用的密码: 命令行参数 flagName 的值 flagValue 不为空时使用它, 其次是 profile 配置的密码,
+// 再次是 fallback, 最后是环境变量 PasswordEnv. 都没有或者读密码失败时直接退出进程.
+func (r *remote) password(flagName, flagValue, fallback string) string {
+	if flagValue != "" {
+		mycplog.Warnf("--%s is deprecated since other users can see it in ps, use the password source of the profile or env %s instead", flagName, PasswordEnv)
+		return flagValue
+	}
+	if r.profile != nil {
+		password, err := r.profile.ReadPassword()
+		if err != nil {
+			mycplog.Fatalf("ReadPassword of profile %s fail=>%v", r.host, err)
+		}
+		if password != "" {
+			return password
+		}
+	}
+	if fallback != "" {
+		return fallback
+	}
+	if password := os.Getenv(PasswordEnv); password != "" {
+		return password
+	}
+	mycplog.Fatalf("no password for %s, configure a password source in its profile or set env %s", r.host, PasswordEnv)
+	return ""
+}
+
+// exclude 返回 profile 配置的 Exclude 加上 extra
+func (r *remote) exclude(extra []string) (exclude []string) {
+	if r.profile != nil {
+		exclude = append(exclude, r.profile.Exclude...)
+	}
+	return append(exclude, extra...)
+}
+
+func (r *remote) tlsPin() string {
+	if r.profile == nil {
+		return ""
+	}
+	return r.profile.TLSPin
+}
+
+// user 返回连接 r 用的用户名: flagValue 不为空时使用它, 其次是 profile 配置的用户名
+func (r *remote) user(flagValue string) string {
+	if flagValue != "" || r.profile == nil {
+		return flagValue
+	}
+	return r.profile.User
+}
+
+// dial 连接 r 并认证, 失败时直接退出进程
+func (r *remote) dial(ctx context.Context, auth *authFlags) (client *mycpclient.Client) {
+	client, err := mycpclient.NewClientWithOptions(ctx, r.address, r.password("password", *auth.password, ""), &mycpclient.ClientOptions{
+		OnStateChange: func(state clientconn.ConnState) {
+			mycplog.Infof("connection state=>%v", state)
+		},
+		TLSPin: r.tlsPin(),
+		User:   r.user(*auth.user),
+	})
+	if err != nil {
+		mycplog.Fatalf("NewClient fail=>%v", err)
+	}
+	return client
+}
+
+// dialRemote 解析 @ip:port:path (或 @profile:path, @R:path) 形式的 remotePath, 连接并认证, 并把这个 host 记为最近一次使用的 remote host.
+// 返回的 realPath 是远端的路径. 失败时直接退出进程.
+func dialRemote(ctx context.Context, remotePath string, auth *authFlags) (client *mycpclient.Client, remoteHost string, realPath string) {
+	myCPInfo, err := mycpclient.ReadMyCPInfo()
+	if err != nil {
+		mycplog.Fatalf("ReadMyCPInfo fail=>%v", err)
+	}
+	remoteHost, realPath, err = mycpclient.ParseRemotePath(remotePath, myCPInfo.LastRemoteHost)
+	if err != nil {
+		mycplog.Fatalf("ParseRemotePath fail=>%v", err)
+	}
+	r := resolveRemote(remoteHost)
+	realPath = r.path(realPath)
+	client = r.dial(ctx, auth)
+
+	err = mycpclient.UpdateMyCPInfo(func(myCPInfo *mycpproto.MyCPInfo) {
+		myCPInfo.LastRemoteHost = remoteHost
+	})
+	if err != nil {
+		mycplog.Fatalf("UpdateMyCPInfo fail=>%v", err)
+	}
+	return
+}
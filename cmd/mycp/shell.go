@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/util"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ShellHistoryFileName = "mycp_shell_history.txt"
+	ShellHistoryMaxLines = 2000 // 历史记录文件超过这么多行时只留下最近的 1000 条
+)
+
+// shell 是 mycp shell 的状态. 所有命令共用一个 Client, 即同一个连接
+type shell struct {
+	client     *mycpclient.Client
+	remoteHost string
+	homeDir    string // 启动时的远端路径, cd 不带参数时回到这里
+	cwd        string // 当前远端路径
+
+	editor       *lineEditor
+	historyLines int // 历史记录文件的行数, 不计其他同时运行的 shell 追加的
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // 正在执行的命令的 cancel, 收到 SIGINT 时调用
+}
+
+type shellCmd struct {
+	usage string
+	run   func(sh *shell, ctx context.Context, args []string) error
+	// argKind 返回第 i 个非 flag 参数是远端路径 ('r') 还是本地路径 ('l'), 用于补全
+	argKind func(i int) byte
+}
+
+func remoteArgs(i int) byte { return 'r' }
+func localArgs(i int) byte  { return 'l' }
+
+var shellCmds map[string]*shellCmd
+
+func init() {
+	shellCmds = map[string]*shellCmd{
+		"help":    {usage: "help", run: (*shell).cmdHelp},
+		"exit":    {usage: "exit (or Ctrl-D)", run: (*shell).cmdExit},
+		"pwd":     {usage: "pwd", run: (*shell).cmdPwd},
+		"lpwd":    {usage: "lpwd", run: (*shell).cmdLpwd},
+		"cd":      {usage: "cd [remote_dir]", run: (*shell).cmdCd, argKind: remoteArgs},
+		"lcd":     {usage: "lcd local_dir", run: (*shell).cmdLcd, argKind: localArgs},
+		"ls":      {usage: "ls [remote_path]", run: (*shell).cmdLs, argKind: remoteArgs},
+		"lls":     {usage: "lls [local_path]", run: (*shell).cmdLls, argKind: localArgs},
+		"get":     {usage: "get remote_path [local_path]", run: (*shell).cmdGet, argKind: func(i int) byte { return "rl"[minInt(i, 1)] }},
+		"put":     {usage: "put local_path [remote_path]", run: (*shell).cmdPut, argKind: func(i int) byte { return "lr"[minInt(i, 1)] }},
+		"mget":    {usage: "mget remote_glob...", run: (*shell).cmdMget, argKind: remoteArgs},
+		"mput":    {usage: "mput local_glob...", run: (*shell).cmdMput, argKind: localArgs},
+		"rm":      {usage: "rm [-r] remote_path", run: (*shell).cmdRm, argKind: remoteArgs},
+		"mkdir":   {usage: "mkdir [-p] remote_dir", run: (*shell).cmdMkdir, argKind: remoteArgs},
+		"history": {usage: "history", run: (*shell).cmdHistory},
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var errShellExit = errors.New("exit")
+
+// hasRemotePath 判断 @ip:port, @profile 或 @R 后面是否带了路径
+func hasRemotePath(remotePath string) bool {
+	fields := strings.Split(strings.TrimPrefix(remotePath, "@"), ":")
+	if len(fields) == 1 {
+		return false
+	}
+	if len(fields) == 2 {
+		_, err := strconv.Atoi(fields[1])
+		return err != nil
+	}
+	return true
+}
+
+// ShellMain 实现 mycp shell [flags] @ip:port[:dir] | @profile[:dir]
+func ShellMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycp shell [flags] @ip:port[:dir] | @profile[:dir]\n")
+		fs.PrintDefaults()
+	}
+	auth := newAuthFlags(fs)
+	logs := newLogFlags(fs)
+	_ = fs.Parse(args)
+	logs.apply()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	remotePath := fs.Arg(0)
+	if !hasRemotePath(remotePath) {
+		// 只有 @ip:port 或 @profile, 从 profile 的 Root 或者服务端的当前路径开始
+		remotePath += ":"
+	}
+
+	client, remoteHost, dir := dialRemote(context.Background(), remotePath, auth)
+	defer client.Close()
+	if !*logs.verbose {
+		// 日志会打乱交互的输出, 只有 -v 时才打印
+		mycplog.SetOutput(ioutil.Discard)
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	sh := &shell{
+		client:     client,
+		remoteHost: remoteHost,
+		homeDir:    dir,
+		cwd:        dir,
+	}
+	sh.editor = newLineEditor(sh.complete)
+	sh.loadHistory()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+	go func() {
+		for sig := range signalCh {
+			sh.mu.Lock()
+			if sh.cancel != nil {
+				sh.cancel()
+			} else if sig == syscall.SIGTERM {
+				os.Exit(1)
+			}
+			sh.mu.Unlock()
+		}
+	}()
+
+	for {
+		line, err := sh.editor.ReadLine(fmt.Sprintf("mycp @%s:%s> ", sh.remoteHost, sh.cwd))
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "read input fail=>%v\n", err)
+				return 1
+			}
+			return 0
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sh.editor.AddHistory(line)
+		sh.appendHistory(line)
+
+		err = sh.runLine(line)
+		if err == errShellExit {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+// runLine 执行一行命令, 执行期间按 Ctrl-C 会取消这个命令而不是退出 shell
+func (sh *shell) runLine(line string) (err error) {
+	fields := strings.Fields(line)
+	cmd, ok := shellCmds[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type help for the list of commands", fields[0])
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sh.mu.Lock()
+	sh.cancel = cancel
+	sh.mu.Unlock()
+	defer func() {
+		sh.mu.Lock()
+		sh.cancel = nil
+		sh.mu.Unlock()
+		cancel()
+	}()
+	return cmd.run(sh, ctx, fields[1:])
+}
+
+// remotePath 把相对于当前远端路径的 p 变成完整的远端路径
+func (sh *shell) remotePath(p string) string {
+	if p == "" {
+		return sh.cwd
+	}
+	if !isRemoteAbs(p) {
+		p = path.Join(sh.cwd, p)
+	}
+	p = path.Clean(p)
+	if strings.HasSuffix(p, ":") {
+		// windows 盘符
+		p += "/"
+	}
+	return p
+}
+
+// isRemoteAbs 判断远端路径是否是绝对路径, 包括 windows 的 D:/ 形式
+func isRemoteAbs(p string) bool {
+	return path.IsAbs(p) || (len(p) >= 2 && p[1] == ':')
+}
+
+// splitFlags 把 args 分成 flag (以 - 开头) 和其余参数
+func splitFlags(args []string) (flags map[string]bool, rest []string) {
+	flags = make(map[string]bool)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			for _, c := range arg[1:] {
+				flags[string(c)] = true
+			}
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return
+}
+
+func (sh *shell) cmdHelp(ctx context.Context, args []string) error {
+	var names []string
+	for name := range shellCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s\n", shellCmds[name].usage)
+	}
+	fmt.Printf("Paths are relative to the current remote/local dir, globs use * ? [...]. Tab completes commands and paths.\n")
+	return nil
+}
+
+func (sh *shell) cmdExit(ctx context.Context, args []string) error {
+	return errShellExit
+}
+
+func (sh *shell) cmdPwd(ctx context.Context, args []string) error {
+	fmt.Printf("@%s:%s\n", sh.remoteHost, sh.cwd)
+	return nil
+}
+
+func (sh *shell) cmdLpwd(ctx context.Context, args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(wd)
+	return nil
+}
+
+func (sh *shell) cmdCd(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		sh.cwd = sh.homeDir
+		return nil
+	}
+	dir := sh.remotePath(args[0])
+	info, err := sh.client.Stat(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return fmt.Errorf("%s is not a dir", dir)
+	}
+	sh.cwd = dir
+	return nil
+}
+
+func (sh *shell) cmdLcd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lcd local_dir")
+	}
+	return os.Chdir(args[0])
+}
+
+func (sh *shell) cmdLs(ctx context.Context, args []string) error {
+	var p string
+	if len(args) > 0 {
+		p = args[0]
+	}
+	p = sh.remotePath(p)
+	info, err := sh.client.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		fmt.Println(formatFileInfo(info))
+		return nil
+	}
+	infos, err := sh.client.List(ctx, p)
+	if err != nil {
+		return err
+	}
+	for i := range infos {
+		fmt.Println(formatFileInfo(&infos[i]))
+	}
+	return nil
+}
+
+func (sh *shell) cmdLls(ctx context.Context, args []string) error {
+	p := "."
+	if len(args) > 0 {
+		p = args[0]
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		fmt.Println(formatLocalFileInfo(info))
+		return nil
+	}
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fmt.Println(formatLocalFileInfo(info))
+	}
+	return nil
+}
+
+func formatLocalFileInfo(info os.FileInfo) string {
+	return formatFileInfo(&mycpproto.MyFileInfo{
+		Name:    info.Name(),
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	})
+}
+
+func (sh *shell) cmdGet(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: " + shellCmds["get"].usage)
+	}
+	dst := "."
+	if len(args) == 2 {
+		dst = args[1]
+	}
+	return sh.get(ctx, sh.remotePath(args[0]), dst)
+}
+
+func (sh *shell) get(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := sh.client.MyCPFromRemoteToLocal(ctx, src, dst, nil)
+	if err != nil {
+		return fmt.Errorf("get %s fail=>%w", src, err)
+	}
+	fmt.Printf("got %s in %v\n", src, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (sh *shell) cmdPut(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: " + shellCmds["put"].usage)
+	}
+	var dst string
+	if len(args) == 2 {
+		dst = args[1]
+	}
+	return sh.put(ctx, args[0], sh.remotePath(dst))
+}
+
+func (sh *shell) put(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := sh.client.MyCPFromLocalToRemote(ctx, src, dst, nil)
+	if err != nil {
+		return fmt.Errorf("put %s fail=>%w", src, err)
+	}
+	fmt.Printf("put %s in %v\n", src, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (sh *shell) cmdMget(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCmds["mget"].usage)
+	}
+	for _, arg := range args {
+		dir, pattern := path.Split(sh.remotePath(arg))
+		infos, err := sh.client.List(ctx, dir)
+		if err != nil {
+			return err
+		}
+		var matched int
+		for _, info := range infos {
+			ok, err := path.Match(pattern, info.Name)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			matched++
+			err = sh.get(ctx, path.Join(dir, info.Name), ".")
+			if err != nil {
+				return err
+			}
+		}
+		if matched == 0 {
+			fmt.Printf("no remote file matches %s\n", arg)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) cmdMput(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + shellCmds["mput"].usage)
+	}
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			fmt.Printf("no local file matches %s\n", arg)
+		}
+		for _, match := range matches {
+			err = sh.put(ctx, filepath.ToSlash(match), sh.cwd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sh *shell) cmdRm(ctx context.Context, args []string) error {
+	flags, rest := splitFlags(args)
+	if len(rest) != 1 {
+		return errors.New("usage: " + shellCmds["rm"].usage)
+	}
+	return sh.client.Remove(ctx, sh.remotePath(rest[0]), flags["r"])
+}
+
+func (sh *shell) cmdMkdir(ctx context.Context, args []string) error {
+	flags, rest := splitFlags(args)
+	if len(rest) != 1 {
+		return errors.New("usage: " + shellCmds["mkdir"].usage)
+	}
+	return sh.client.Mkdir(ctx, sh.remotePath(rest[0]), flags["p"])
+}
+
+func (sh *shell) cmdHistory(ctx context.Context, args []string) error {
+	for i, line := range sh.editor.history {
+		fmt.Printf("%5d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+// complete 补全命令名, 以及按照命令的参数类型补全远端或本地路径
+func (sh *shell) complete(line []rune, pos int) (newLine []rune, newPos int, candidates []string) {
+	before := string(line[:pos])
+	wordStart := strings.LastIndex(before, " ") + 1
+	word := before[wordStart:]
+	fields := strings.Fields(before[:wordStart])
+
+	var names []string // 候选项, 路径以 / 结尾
+	var prefix string  // word 中不参与补全的前缀 (路径所在的路径部分)
+	if len(fields) == 0 {
+		for name := range shellCmds {
+			names = append(names, name)
+		}
+	} else {
+		cmd, ok := shellCmds[fields[0]]
+		if !ok || cmd.argKind == nil || strings.HasPrefix(word, "-") {
+			return line, pos, nil
+		}
+		_, argsBefore := splitFlags(fields[1:])
+		var dir string
+		if idx := strings.LastIndex(word, "/"); idx >= 0 {
+			prefix, dir = word[:idx+1], word[:idx+1]
+		}
+		if cmd.argKind(len(argsBefore)) == 'r' {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			infos, err := sh.client.List(ctx, sh.remotePath(dir))
+			cancel()
+			if err != nil {
+				return line, pos, nil
+			}
+			for _, info := range infos {
+				names = append(names, fileName(info.Name, info.IsDir))
+			}
+		} else {
+			if dir == "" {
+				dir = "."
+			}
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return line, pos, nil
+			}
+			for _, info := range infos {
+				names = append(names, fileName(info.Name(), info.IsDir()))
+			}
+		}
+	}
+
+	base := word[len(prefix):]
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, base) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return line, pos, nil
+	}
+	sort.Strings(matches)
+
+	completed := commonPrefix(matches)
+	if len(matches) == 1 && !strings.HasSuffix(completed, "/") {
+		completed += " "
+	}
+	if len(matches) > 1 && completed == base {
+		candidates = matches
+	}
+	insert := []rune(completed[len(base):])
+	newLine = append(append(append([]rune{}, line[:pos]...), insert...), line[pos:]...)
+	return newLine, pos + len(insert), candidates
+}
+
+func fileName(name string, isDir bool) string {
+	if isDir {
+		return name + "/"
+	}
+	return name
+}
+
+func commonPrefix(names []string) string {
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// 历史记录持久化在 mycpclient.StateDir() 下 (每个用户一个, 不在可执行文件所在的路径下), 每行一条
+func historyFilePath() (string, error) {
+	stateDir, err := mycpclient.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, ShellHistoryFileName), nil
+}
+
+func (sh *shell) loadHistory() {
+	historyPath, err := historyFilePath()
+	if err != nil {
+		return
+	}
+	historyFile, err := os.Open(historyPath)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(historyFile)
+	for scanner.Scan() {
+		sh.editor.AddHistory(scanner.Text())
+		sh.historyLines++
+	}
+	_ = historyFile.Close()
+	sh.trimHistory(historyPath)
+}
+
+// trimHistory 在文件超过 ShellHistoryMaxLines 行时只留下内存中最近的记录, 避免无限增长
+func (sh *shell) trimHistory(historyPath string) {
+	if sh.historyLines <= ShellHistoryMaxLines {
+		return
+	}
+	data := strings.Join(sh.editor.history, "\n") + "\n"
+	err := util.WriteFileAtomic(historyPath, []byte(data), 0600)
+	if err != nil {
+		mycplog.Warnf("WriteFileAtomic fail=>%v", err)
+		return
+	}
+	sh.historyLines = len(sh.editor.history)
+}
+
+func (sh *shell) appendHistory(line string) {
+	historyPath, err := historyFilePath()
+	if err != nil {
+		return
+	}
+	historyFile, err := os.OpenFile(historyPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		mycplog.Warnf("open history file fail=>%v", err)
+		return
+	}
+	_, err = fmt.Fprintln(historyFile, line)
+	_ = historyFile.Close()
+	if err != nil {
+		mycplog.Warnf("write history file fail=>%v", err)
+		return
+	}
+	sh.historyLines++
+	sh.trimHistory(historyPath)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellHistoryCapped(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "mycp_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	defer os.Setenv("MYCP_STATE_DIR", os.Getenv("MYCP_STATE_DIR"))
+	os.Setenv("MYCP_STATE_DIR", stateDir)
+	defer func(maxLines int) { ShellHistoryMaxLines = maxLines }(ShellHistoryMaxLines)
+	ShellHistoryMaxLines = 5
+
+	sh := &shell{editor: newLineEditor(nil)}
+	sh.editor.maxHistory = 3
+	for i := 0; i < 20; i++ {
+		line := fmt.Sprintf("ls %d", i)
+		sh.editor.AddHistory(line)
+		sh.appendHistory(line)
+		data, err := ioutil.ReadFile(filepath.Join(stateDir, ShellHistoryFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) > ShellHistoryMaxLines {
+			t.Fatalf("history file has %d lines, max=>%d", len(lines), ShellHistoryMaxLines)
+		}
+		if lines[len(lines)-1] != line {
+			t.Fatalf("last line of history file=>%q, want %q", lines[len(lines)-1], line)
+		}
+	}
+
+	loaded := &shell{editor: newLineEditor(nil)}
+	loaded.loadHistory()
+	if got := loaded.editor.history[len(loaded.editor.history)-1]; got != "ls 19" {
+		t.Fatalf("last loaded history=>%q", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"os"
+	"strings"
+)
+
+// StateMain 实现 mycp state [show] 和 mycp state prune [flags] [prefix...], 查看和清理本地保存的 MyCPInfo
+func StateMain(args []string) (exitCode int) {
+	if len(args) == 0 || args[0] == "show" {
+		return stateShow()
+	}
+	if args[0] == "prune" {
+		return statePrune(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Usage: mycp state [show]\n       mycp state prune [flags] [prefix...]\n")
+	return 2
+}
+
+func stateShow() (exitCode int) {
+	myCPInfoFilePath, err := mycpclient.MyCPInfoFilePath()
+	if err != nil {
+		mycplog.Fatalf("MyCPInfoFilePath fail=>%v", err)
+	}
+	myCPInfo, err := mycpclient.ReadMyCPInfo()
+	if err != nil {
+		mycplog.Fatalf("ReadMyCPInfo fail=>%v", err)
+	}
+	fmt.Printf("file: %s\n", myCPInfoFilePath)
+	fmt.Printf("last remote host: %s\n", myCPInfo.LastRemoteHost)
+	fmt.Printf("last mycp time of %d srcs:\n", len(myCPInfo.Path2LastMyCPTime))
+	for _, hostSrcPath := range mycpclient.SortedHostSrcPaths(myCPInfo) {
+		fmt.Printf("%s %s\n", myCPInfo.Path2LastMyCPTime[hostSrcPath].Format("2006-01-02 15:04:05"), hostSrcPath)
+	}
+	return 0
+}
+
+func statePrune(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("state prune", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycp state prune [flags] [prefix...]\n"+
+			"forget the last mycp time of srcs older than --older-than, only those starting with one of the prefixes if any\n")
+		fs.PrintDefaults()
+	}
+	olderThan := fs.Duration("older-than", mycpclient.MyCPInfoMaxAge, "forget srcs not copied for this long")
+	all := fs.Bool("all", false, "forget regardless of age")
+	lastHost := fs.Bool("last-host", false, "also forget the last remote host, so @R needs to be specified again")
+	logs := newLogFlags(fs)
+	_ = fs.Parse(args)
+	logs.apply()
+	if *all {
+		*olderThan = 0
+	} else if *olderThan <= 0 {
+		mycplog.Fatalf("--older-than must be positive, use --all to forget regardless of age")
+	}
+	prefixes := fs.Args()
+
+	var pruned int
+	err := mycpclient.UpdateMyCPInfo(func(myCPInfo *mycpproto.MyCPInfo) {
+		pruned = mycpclient.PruneMyCPInfo(myCPInfo, *olderThan, func(hostSrcPath string) bool {
+			if len(prefixes) == 0 {
+				return false
+			}
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(hostSrcPath, prefix) {
+					return false
+				}
+			}
+			return true
+		})
+		if *lastHost {
+			myCPInfo.LastRemoteHost = ""
+		}
+	})
+	if err != nil {
+		mycplog.Fatalf("UpdateMyCPInfo fail=>%v", err)
+	}
+	fmt.Printf("forgot %d srcs\n", pruned)
+	return 0
+}
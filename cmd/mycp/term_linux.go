@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func ioctlTermios(fd int, req uintptr, termios *syscall.Termios) (err error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw 把终端 fd 设为 raw 模式 (逐字节读, 不回显, Ctrl-C 不产生信号), restore 恢复原来的模式.
+// fd 不是终端时返回错误.
+func makeRaw(fd int) (restore func(), err error) {
+	var oldState syscall.Termios
+	err = ioctlTermios(fd, syscall.TCGETS, &oldState)
+	if err != nil {
+		return nil, err
+	}
+	newState := oldState
+	newState.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	newState.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	newState.Cflag &^= syscall.CSIZE | syscall.PARENB
+	newState.Cflag |= syscall.CS8
+	newState.Cc[syscall.VMIN] = 1
+	newState.Cc[syscall.VTIME] = 0
+	err = ioctlTermios(fd, syscall.TCSETS, &newState)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = ioctlTermios(fd, syscall.TCSETS, &oldState)
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// makeRaw 只在 linux 上实现, 其他平台上 mycp shell 按行读取, 没有补全和历史
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal not supported on this platform")
+}
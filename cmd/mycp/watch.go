@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mycp/mycpclient"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"time"
+)
+
+// WatchMain 实现 mycp watch [flags] --src=dir --dst=@ip:port:dir, 一直运行到 Ctrl-C
+func WatchMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycp watch [flags] --src=dir --dst=@ip:port:dir\n")
+		fs.PrintDefaults()
+	}
+	srcPath := fs.String("src", "", "local dir to watch")
+	dstPath := fs.String("dst", "", "remote dir, the watched dir is kept in sync at dst/<last element of src>")
+	onlyModified := fs.Bool("modified", false, "initial sync only cp files modified since the last mycp of src")
+	auth := newAuthFlags(fs)
+	logs := newLogFlags(fs)
+	interval := fs.Duration("interval", 1*time.Second, "how often to scan src for changes")
+	excludes := &pathsFlag{}
+	fs.Var(excludes, "exclude", "skip files and dirs whose name matches this pattern, may be repeated, added to the Exclude of the profile")
+	_ = fs.Parse(args)
+	logs.apply()
+	if *srcPath == "" || *dstPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	myCPInfo, err := mycpclient.ReadMyCPInfo()
+	if err != nil {
+		mycplog.Fatalf("ReadMyCPInfo fail=>%v", err)
+	}
+	realSrcPath, realDstPath, remoteHost, remoteIsSrc, err := mycpclient.ParsePath(*srcPath, *dstPath, myCPInfo.LastRemoteHost)
+	if err != nil {
+		mycplog.Fatalf("ParsePath fail=>%v", err)
+	}
+	if remoteIsSrc {
+		mycplog.Fatalf("watch only works when dst is remote")
+	}
+
+	ctx, cancel := newContext(0)
+	defer cancel()
+
+	r := resolveRemote(remoteHost)
+	realDstPath = r.path(realDstPath)
+	client := r.dial(ctx, auth)
+	defer client.Close()
+
+	var opts = &mycpclient.WatchOptions{
+		MyCPOptions: mycpclient.MyCPOptions{
+			OnlyModified: *onlyModified,
+			LastMyCPTime: myCPInfo.Path2LastMyCPTime[realSrcPath],
+			Exclude:      r.exclude(excludes.values),
+		},
+		Interval: *interval,
+		OnSynced: func(scanTime time.Time) {
+			// 与普通的 mycp 共用上次 mycp 时间, 之后用 --modified 拷贝同一个路径时不会重复传输
+			err := mycpclient.UpdateMyCPInfo(func(myCPInfo *mycpproto.MyCPInfo) {
+				myCPInfo.Path2LastMyCPTime[realSrcPath] = scanTime
+				myCPInfo.LastRemoteHost = remoteHost
+			})
+			if err != nil {
+				mycplog.Warnf("UpdateMyCPInfo fail=>%v", err)
+			}
+		},
+	}
+	err = client.Watch(ctx, realSrcPath, realDstPath, opts)
+	if err != nil && ctx.Err() == nil {
+		mycplog.Fatalf("Watch fail=>%v", err)
+	}
+	mycplog.Infof("watch stopped")
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpserver"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// AdminMain 实现 mycpserver admin [flags] list|kill id, 通过本机的管理接口查看和关闭连接
+func AdminMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycpserver admin [flags] list\n       mycpserver admin [flags] kill id\n")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "config file, default to mycpserver.json next to the binary")
+	admin := fs.String("admin", "", "ip:port of the admin endpoint, default to the Admin.Listen of the config file")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	host := *admin
+	if host == "" {
+		_, config := loadConfig(*configPath)
+		host = config.Admin.Listen
+	}
+	if host == "" {
+		mycplog.Fatalf("no admin endpoint, specify --admin or Admin.Listen in the config file")
+	}
+	tokenPath, err := mycpserver.AdminTokenPath()
+	if err != nil {
+		mycplog.Fatalf("AdminTokenPath fail=>%v", err)
+	}
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		mycplog.Fatalf("read admin token fail=>%v", err)
+	}
+	adminClient := &adminClient{
+		baseURL: "http://" + host,
+		token:   strings.TrimSpace(string(token)),
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		return adminClient.list()
+	case "kill":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		id, err := strconv.ParseUint(fs.Arg(1), 10, 64)
+		if err != nil {
+			mycplog.Fatalf("bad id=>%s", fs.Arg(1))
+		}
+		return adminClient.kill(id)
+	}
+	fs.Usage()
+	return 2
+}
+
+type adminClient struct {
+	baseURL string
+	token   string
+}
+
+// do 发送请求, 响应的状态码不是 2xx 时返回带有响应内容的错误
+func (c *adminClient) do(method, path string) (body []byte, err error) {
+	req, err := http.NewRequest(method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err = ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s=>%s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (c *adminClient) list() (exitCode int) {
+	body, err := c.do(http.MethodGet, "/conns")
+	if err != nil {
+		mycplog.Fatalf("list fail=>%v", err)
+	}
+	var infos []mycpserver.ConnInfo
+	err = json.Unmarshal(body, &infos)
+	if err != nil {
+		mycplog.Fatalf("unmarshal fail=>%v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREMOTE\tUSER\tSINCE\tIN\tOUT\tACTIVE\tOP")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", info.ID, info.RemoteAddr, info.User,
+			info.StartTime.Format("2006-01-02 15:04:05"), info.BytesIn, info.BytesOut, info.Active, info.Op)
+	}
+	_ = w.Flush()
+	return 0
+}
+
+func (c *adminClient) kill(id uint64) (exitCode int) {
+	_, err := c.do(http.MethodPost, "/conns/kill?id="+strconv.FormatUint(id, 10))
+	if err != nil {
+		mycplog.Fatalf("kill fail=>%v", err)
+	}
+	fmt.Printf("conn %d killed\n", id)
+	return 0
+}
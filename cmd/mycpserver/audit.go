@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpserver"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// AuditMain 实现 mycpserver audit [flags], 按路径, 用户, 操作和时间范围查询审计日志
+func AuditMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycpserver audit [flags]\n"+
+			"print records of the audit log and its rotated files matching all the given filters, oldest first\n")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "config file, default to mycpserver.json next to the binary")
+	file := fs.String("file", "", "audit log, default to the Audit.File of the config file")
+	filterPath := fs.String("path", "", "only records on this path or under this dir")
+	user := fs.String("user", "", "only records of this user")
+	op := fs.String("op", "", "only records of this op: read, write, mkdir, remove, rename or push")
+	since := fs.String("since", "", "only records at or after this time, e.g. 2024-05-01, \"2024-05-01 15:04:05\", RFC3339, or a duration like 24h meaning that long ago")
+	until := fs.String("until", "", "only records before this time, same format as --since")
+	jsonOutput := fs.Bool("json", false, "print the matching records as json lines instead of a table")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	auditFile := *file
+	if auditFile == "" {
+		_, config := loadConfig(*configPath)
+		auditFile = config.Audit.File
+	}
+	if auditFile == "" {
+		mycplog.Fatalf("no audit log, specify --file or Audit.File in the config file")
+	}
+	filter := &mycpserver.AuditFilter{Path: *filterPath, User: *user, Op: *op}
+	var err error
+	filter.Since, err = parseAuditTime(*since)
+	if err != nil {
+		mycplog.Fatalf("bad --since=>%v", err)
+	}
+	filter.Until, err = parseAuditTime(*until)
+	if err != nil {
+		mycplog.Fatalf("bad --until=>%v", err)
+	}
+
+	var print func(record *mycpserver.AuditRecord) error
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		print = func(record *mycpserver.AuditRecord) error {
+			return encoder.Encode(record)
+		}
+	} else {
+		fmt.Fprintln(w, "TIME\tREMOTE\tUSER\tOP\tPATH\tBYTES\tRESULT\tSHA256")
+		print = func(record *mycpserver.AuditRecord) error {
+			target := record.Path
+			if record.To != "" {
+				target += " -> " + record.To
+			}
+			result := record.Result
+			if record.Error != "" {
+				result += ": " + record.Error
+			}
+			sum := record.SHA256
+			if len(sum) > 16 {
+				sum = sum[:16]
+			}
+			_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", record.Time.Local().Format("2006-01-02 15:04:05"),
+				record.Remote, record.User, record.Op, target, record.Bytes, result, sum)
+			return err
+		}
+	}
+	err = mycpserver.QueryAudit(auditFile, filter, print)
+	if err != nil {
+		mycplog.Fatalf("QueryAudit fail=>%v", err)
+	}
+	_ = w.Flush()
+	return 0
+}
+
+// parseAuditTime 解析 --since 和 --until, 空串返回零值
+func parseAuditTime(s string) (t time.Time, err error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can not parse %q as a time or duration", s)
+}
@@ -1,23 +1,353 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"mycp/mycplog"
 	"mycp/mycpserver"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	host = flag.String("host", "0.0.0.0:31001", "ip:port")
+	configPath   = flag.String("config", "", "config file, default to mycpserver.json next to the binary")
+	host         = flag.String("host", "0.0.0.0:31001", "ip:port, default to the Listen of the config file")
+	metricsHost  = flag.String("metrics", "", "ip:port of the Prometheus /metrics endpoint, default to the Metrics.Listen of the config file, empty to disable")
+	auditFile    = flag.String("audit", "", "append-only audit log of file operations, default to the Audit.File of the config file, empty to disable")
+	manifestDir  = flag.String("manifest-dir", "", "dir keeping the manifests of synced trees for mycp --manifest, default to the ManifestDir of the config file, then mycp_manifests next to the binary, - to disable")
+	blobDir      = flag.String("blob-dir", "", "dir of the content-addressed deduplication store, partitioned by the Root of users, default to the Blobs.Dir of the config file, empty to disable")
+	adminHost    = flag.String("admin", "", "loopback ip:port of the admin endpoint used by mycpserver admin, default to the Admin.Listen of the config file, empty to disable")
+	pingInterval = flag.Duration("ping-interval", 5*time.Second, "interval of heartbeat ping, 0 to disable")
+	idleTimeout  = flag.Duration("idle-timeout", 20*time.Second, "close conn if nothing received from peer within this duration, 0 to disable")
+	maxInFlight  = flag.Int("max-inflight", 256, "max in-flight requests per conn (credits granted to client)")
+	maxFrameSize = flag.Uint64("max-frame-size", 1<<30, "max frame size in bytes after authentication")
+	maxPreAuth   = flag.Uint64("max-preauth-frame-size", 64*1024, "max frame size in bytes before authentication")
+
+	maxConns          = flag.Int("max-conns", 0, "max conns, new conns beyond it are closed at once, 0 for unlimited")
+	maxConnsPerIP     = flag.Int("max-conns-per-ip", 0, "max conns from one ip, 0 for unlimited")
+	workers           = flag.Int("workers", 4, "number of goroutines processing requests, shared by all conns in a round-robin way")
+	maxWorkersPerConn = flag.Int("max-workers-per-conn", 0, "max workers busy with one conn at the same time, 0 means workers-1")
+
+	logLevel  = flag.String("log-level", "info", "debug, info, warn or error, default to the Log.Level of the config file, debug also prints each request with its conn and seq")
+	logFormat = flag.String("log-format", "text", "text or json, default to the Log.Format of the config file")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT/SIGTERM, wait at most this long for in-flight requests, a second signal stops immediately")
 )
 
+// setupLog 按配置文件和命令行参数设置日志的输出, 级别和格式. 命令行上明确指定的参数优先于配置文件
+func setupLog(logConfig *mycpserver.LogConfig) {
+	level, format := *logLevel, *logFormat
+	if logConfig.Level != "" {
+		level = logConfig.Level
+	}
+	if logConfig.Format != "" {
+		format = logConfig.Format
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "log-level":
+			level = *logLevel
+		case "log-format":
+			format = *logFormat
+		}
+	})
+	parsedLevel, err := mycplog.ParseLevel(level)
+	if err != nil {
+		mycplog.Fatalf("ParseLevel fail=>%v", err)
+	}
+	mycplog.SetLevel(parsedLevel)
+	err = mycplog.SetFormat(format)
+	if err != nil {
+		mycplog.Fatalf("SetFormat fail=>%v", err)
+	}
+	if logConfig.File != "" {
+		logFile, err := os.OpenFile(logConfig.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			mycplog.Fatalf("open log file fail=>%v", err)
+		}
+		mycplog.SetOutput(logFile)
+	}
+}
+
+// loadConfig 读 --config 指定的或者默认的配置文件, 失败时直接退出进程
+func loadConfig(configPath string) (realConfigPath string, config *mycpserver.Config) {
+	realConfigPath = configPath
+	if realConfigPath == "" {
+		var err error
+		realConfigPath, err = mycpserver.DefaultConfigPath()
+		if err != nil {
+			mycplog.Fatalf("DefaultConfigPath fail=>%v", err)
+		}
+	}
+	config, err := mycpserver.LoadConfig(realConfigPath)
+	if err != nil {
+		mycplog.Fatalf("LoadConfig fail=>%v", err)
+	}
+	return realConfigPath, config
+}
+
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "passwd":
+			os.Exit(PasswdMain(os.Args[2:]))
+		case "admin":
+			os.Exit(AdminMain(os.Args[2:]))
+		case "audit":
+			os.Exit(AuditMain(os.Args[2:]))
+		}
+	}
 	flag.Parse()
+	realConfigPath, config := loadConfig(*configPath)
+
+	setupLog(&config.Log)
+	mycplog.Infof("config file=>%s", realConfigPath)
+
 	server := mycpserver.NewServer()
-	err := server.LoadPassword()
+	server.ConnOptions.PingInterval = *pingInterval
+	server.ConnOptions.IdleTimeout = *idleTimeout
+	server.ConnOptions.MaxInFlight = *maxInFlight
+	server.ConnOptions.MaxFrameSize = *maxFrameSize
+	server.ConnOptions.MaxPreAuthFrameSize = *maxPreAuth
+	server.MaxConns = *maxConns
+	server.MaxConnsPerIP = *maxConnsPerIP
+	server.Workers = *workers
+	server.MaxWorkersPerConn = *maxWorkersPerConn
+	err := server.LoadExecAllowList()
+	if err != nil {
+		mycplog.Fatalf("LoadExecAllowList fail=>%v", err)
+	}
+	err = server.LoadPushAllowList()
+	if err != nil {
+		mycplog.Fatalf("LoadPushAllowList fail=>%v", err)
+	}
+	err = server.ApplyConfig(config)
 	if err != nil {
-		log.Fatalf("LoadPassword fail=>%v", err)
+		mycplog.Fatalf("ApplyConfig fail=>%v", err)
+	}
+	// 命令行上明确指定的参数优先于配置文件
+	hosts := config.Listen
+	admin := config.Admin.Listen
+	audit := config.Audit.File
+	manifests := config.ManifestDir
+	blobs := config.Blobs.Dir
+	metricsListen := config.Metrics.Listen
+	timeout := *shutdownTimeout
+	if config.Limits.ShutdownTimeout != 0 {
+		timeout = time.Duration(config.Limits.ShutdownTimeout)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			hosts = []string{*host}
+		case "admin":
+			admin = *adminHost
+		case "audit":
+			audit = *auditFile
+		case "manifest-dir":
+			manifests = *manifestDir
+		case "blob-dir":
+			blobs = *blobDir
+		case "metrics":
+			metricsListen = *metricsHost
+		case "shutdown-timeout":
+			timeout = *shutdownTimeout
+		case "ping-interval":
+			server.ConnOptions.PingInterval = *pingInterval
+		case "idle-timeout":
+			server.ConnOptions.IdleTimeout = *idleTimeout
+		case "max-inflight":
+			server.ConnOptions.MaxInFlight = *maxInFlight
+		case "max-frame-size":
+			server.ConnOptions.MaxFrameSize = *maxFrameSize
+		case "max-preauth-frame-size":
+			server.ConnOptions.MaxPreAuthFrameSize = *maxPreAuth
+		case "max-conns":
+			server.MaxConns = *maxConns
+		case "max-conns-per-ip":
+			server.MaxConnsPerIP = *maxConnsPerIP
+		case "workers":
+			server.Workers = *workers
+		case "max-workers-per-conn":
+			server.MaxWorkersPerConn = *maxWorkersPerConn
+		}
+	})
+
+	err = server.ConnOptions.Validate()
+	if err != nil {
+		mycplog.Fatalf("bad conn options=>%v", err)
+	}
+
+	if len(config.Users) == 0 {
+		generated, err := server.LoadPassword()
+		if err != nil {
+			mycplog.Fatalf("LoadPassword fail=>%v", err)
+		}
+		if generated {
+			// 只有随机生成的密码需要告诉管理员, 从文件读到的密码不写进日志
+			mycplog.Infof("generated password=>\"%s\"", server.Password)
+		}
+	} else {
+		mycplog.Infof("users=>%q", config.UserNames())
+	}
+	if server.Root != "" {
+		mycplog.Infof("root=>%s", server.Root)
 	}
-	log.Printf("password=>\"%s\"", server.Password)
-	_ = server.Start(*host)
+	mycplog.Infof("exec allow list=>%q", server.ExecAllowList)
+	mycplog.Infof("push allow list=>%q", server.PushAllowList)
+	if audit != "" {
+		server.AuditLog = openAuditLog(audit, &config.Audit)
+		defer server.AuditLog.Close()
+	}
+	server.Manifests = openManifestStore(manifests)
+	if blobs != "" {
+		server.Blobs = openBlobStore(blobs, &config.Blobs)
+	}
+	if server.Manifests != nil {
+		defer func() {
+			err := server.Manifests.Flush()
+			if err != nil {
+				mycplog.Errorf("flush manifests fail=>%v", err)
+			}
+		}()
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{*host}
+	}
+	errCh := make(chan error, len(hosts))
+	for _, host := range hosts {
+		listener, err := server.Listen(host)
+		if err != nil {
+			mycplog.Fatalf("Listen fail=>%v", err)
+		}
+		go func() {
+			errCh <- server.Serve(listener)
+		}()
+	}
+	if admin != "" {
+		err = server.ListenAdmin(admin)
+		if err != nil {
+			mycplog.Fatalf("ListenAdmin fail=>%v", err)
+		}
+	}
+	if metricsListen != "" {
+		err = server.ListenMetrics(metricsListen)
+		if err != nil {
+			mycplog.Fatalf("ListenMetrics fail=>%v", err)
+		}
+	}
+	shutdownDone := handleSignals(server, timeout)
+	for range hosts {
+		err = <-errCh
+		if err != nil {
+			mycplog.Fatalf("Serve fail=>%v", err)
+		}
+	}
+	<-shutdownDone
+	mycplog.Infof("mycpserver exit")
+}
+
+// openManifestStore 打开保存同步清单的路径 dir, dir 为空时使用默认的路径, 为 "-" 时返回 nil.
+// 打不开时只是不保存清单, 客户端的 --manifest 会退回到拷贝所有文件
+func openManifestStore(dir string) (store *mycpserver.ManifestStore) {
+	if dir == "-" {
+		return nil
+	}
+	var err error
+	if dir == "" {
+		dir, err = mycpserver.DefaultManifestDir()
+		if err != nil {
+			mycplog.Warnf("DefaultManifestDir fail=>%v, manifests disabled", err)
+			return nil
+		}
+	}
+	store, err = mycpserver.OpenManifestStore(dir)
+	if err != nil {
+		mycplog.Warnf("OpenManifestStore fail=>%v, manifests disabled", err)
+		return nil
+	}
+	mycplog.Infof("manifest dir=>%s", dir)
+	return store
+}
+
+// openBlobStore 打开去重缓存, 失败时直接退出进程
+func openBlobStore(dir string, blobConfig *mycpserver.BlobConfig) (store *mycpserver.BlobStore) {
+	maxSize, minFileSize := blobConfig.MaxSize, blobConfig.MinFileSize
+	if maxSize == 0 {
+		maxSize = mycpserver.DefaultBlobMaxSize
+	}
+	if minFileSize == 0 {
+		minFileSize = mycpserver.DefaultBlobMinFileSize
+	}
+	store, err := mycpserver.OpenBlobStore(dir, maxSize, minFileSize, blobConfig.Link)
+	if err != nil {
+		mycplog.Fatalf("OpenBlobStore fail=>%v", err)
+	}
+	count, size := store.Stats()
+	mycplog.Infof("blob dir=>%s, %d blobs, %d of %d Bytes, link=>%v", dir, count, size, maxSize, blobConfig.Link)
+	return store
+}
+
+// openAuditLog 打开审计日志, 收到 SIGHUP 时重新打开, 以便配合 logrotate 等外部的轮转. 失败时直接退出进程
+func openAuditLog(file string, auditConfig *mycpserver.AuditConfig) (auditLog *mycpserver.AuditLog) {
+	maxSize, maxBackups := auditConfig.MaxSize, auditConfig.MaxBackups
+	if maxSize == 0 {
+		maxSize = mycpserver.DefaultAuditMaxSize
+	} else if maxSize < 0 {
+		maxSize = 0
+	}
+	if maxBackups == 0 {
+		maxBackups = mycpserver.DefaultAuditMaxBackups
+	}
+	auditLog, err := mycpserver.OpenAuditLog(file, maxSize, maxBackups)
+	if err != nil {
+		mycplog.Fatalf("OpenAuditLog fail=>%v", err)
+	}
+	mycplog.Infof("audit log=>%s", file)
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			err := auditLog.Reopen()
+			if err != nil {
+				mycplog.Errorf("reopen audit log fail=>%v", err)
+				continue
+			}
+			mycplog.Infof("audit log reopened")
+		}
+	}()
+	return auditLog
+}
+
+// handleSignals 在收到 SIGINT/SIGTERM 时优雅地关闭 server, 再收到一次时立即关闭. 关闭完成后 shutdownDone 被关闭
+func handleSignals(server *mycpserver.Server, timeout time.Duration) (shutdownDone chan struct{}) {
+	shutdownDone = make(chan struct{})
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(shutdownDone)
+		sig := <-sigCh
+		mycplog.Infof("got signal %v, shutting down, wait at most %v for in-flight requests", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		go func() {
+			select {
+			case sig := <-sigCh:
+				mycplog.Infof("got signal %v again, stop now", sig)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			mycplog.Warnf("Shutdown fail=>%v", err)
+			return
+		}
+		mycplog.Infof("shutdown done")
+	}()
+	return shutdownDone
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpserver"
+	"os"
+	"strings"
+)
+
+// PasswdMain 实现 mycpserver passwd [flags] user, 在配置文件中设置或删除用户的密码.
+// 密码从终端读两次 (不回显), stdin 不是终端时从 stdin 读一行.
+// mycpserver passwd --drop-keys 把以前的版本保存的密钥换成 Verifier.
+func PasswdMain(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mycpserver passwd [flags] user\n       mycpserver passwd [--config=file] --drop-keys\n")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "config file, default to mycpserver.json next to the binary")
+	iterations := fs.Int("iterations", 0, "PBKDF2 iterations, 0 means the default")
+	root := fs.String("root", "", "only allow the user to access files under this dir, empty to keep the current one")
+	del := fs.Bool("delete", false, "delete the user")
+	dropKeys := fs.Bool("drop-keys", false, "replace the keys saved by older versions with verifiers, clients older than this version can no longer log in")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 && !(*dropKeys && fs.NArg() == 0) {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+
+	realConfigPath, config := loadConfig(*configPath)
+	if *dropKeys {
+		names := config.DropKeys()
+		if len(names) == 0 {
+			fmt.Printf("no keys in %s\n", realConfigPath)
+			return 0
+		}
+		fmt.Printf("dropped keys of users %v\n", names)
+	} else if *del {
+		if _, ok := config.Users[name]; !ok {
+			mycplog.Fatalf("no user named %s in %s", name, realConfigPath)
+		}
+		delete(config.Users, name)
+	} else {
+		password, err := readNewPassword()
+		if err != nil {
+			mycplog.Fatalf("read password fail=>%v", err)
+		}
+		err = config.SetPassword(name, password, *iterations)
+		if err != nil {
+			mycplog.Fatalf("SetPassword fail=>%v", err)
+		}
+		if *root != "" {
+			config.Users[name].Root = *root
+		}
+	}
+	err := mycpserver.WriteConfig(realConfigPath, config)
+	if err != nil {
+		mycplog.Fatalf("WriteConfig fail=>%v", err)
+	}
+	fmt.Printf("%s updated, restart mycpserver to take effect\n", realConfigPath)
+	return 0
+}
+
+func readNewPassword() (password string, err error) {
+	fd := int(os.Stdin.Fd())
+	password, err = readPasswordNoEcho(fd, "New password: ")
+	if err == errNotTerminal {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	again, err := readPasswordNoEcho(fd, "Retype new password: ")
+	if err != nil {
+		return "", err
+	}
+	if again != password {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var errNotTerminal = errors.New("not a terminal")
+
+func ioctlTermios(fd int, req uintptr, termios *syscall.Termios) (err error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readPasswordNoEcho 在 stderr 上显示 prompt, 关闭终端 fd 的回显后读一行. fd 不是终端时返回 errNotTerminal.
+func readPasswordNoEcho(fd int, prompt string) (password string, err error) {
+	var oldState syscall.Termios
+	if ioctlTermios(fd, syscall.TCGETS, &oldState) != nil {
+		return "", errNotTerminal
+	}
+	newState := oldState
+	newState.Lflag &^= syscall.ECHO
+	newState.Lflag |= syscall.ICANON | syscall.ISIG
+	err = ioctlTermios(fd, syscall.TCSETS, &newState)
+	if err != nil {
+		return "", err
+	}
+	defer ioctlTermios(fd, syscall.TCSETS, &oldState)
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.NewFile(uintptr(fd), "stdin")).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
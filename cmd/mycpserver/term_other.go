@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errNotTerminal = errors.New("not a terminal")
+
+// readPasswordNoEcho 只在 linux 上实现, 其他平台总是从 stdin 按行读取
+func readPasswordNoEcho(fd int, prompt string) (password string, err error) {
+	return "", errNotTerminal
+}
@@ -0,0 +1,178 @@
+package mycpclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Config 是客户端的配置文件, 目前只有命名的 profile. 比如
+//
+//	{
+//	    "Profiles": {
+//	        "devbox": {
+//	            "Address": "10.252.156.170:31001",
+//	            "PasswordFile": "~/.config/mycp/devbox.password",
+//	            "Root": "/home/work",
+//	            "Exclude": [".git", "*.o"]
+//	        }
+//	    }
+//	}
+//
+// 之后就可以用 @devbox:path 代替 @10.252.156.170:31001:path.
+type Config struct {
+	Profiles map[string]*Profile
+}
+
+// Profile 是一个命名的远端
+type Profile struct {
+	Address string // ip:port
+	User    string // 服务端配置了多个用户时需要指定, 命令行上的 --user 优先
+
+	// 密码的来源, 按 PasswordFile, PasswordEnv, PasswordCommand 的顺序取第一个配置了的.
+	// mycp 依次使用已废弃的 --password, 这里配置的来源, 环境变量 MYCP_PASSWORD, 都没有时报错退出, 没有默认密码.
+	PasswordFile    string // 文件的内容, 去掉首尾空白
+	PasswordEnv     string // 环境变量的值
+	PasswordCommand string // 命令的标准输出, 去掉首尾空白, 比如 "pass show mycp/devbox"
+
+	Root    string   // 远端相对路径的起点, 为空时相对于服务端的工作路径
+	Exclude []string // 拷贝时跳过的文件和路径, 与文件名按 path.Match 匹配
+	TLSPin  string   // 服务端证书 (DER) 的 sha256 的 hex, 配置后用 TLS 连接并且只信任这个证书
+}
+
+// ConfigPath 返回配置文件的路径: 环境变量 MYCP_CONFIG, 或者用户配置路径下的 mycp/config.json
+func ConfigPath() (configPath string, err error) {
+	configPath = os.Getenv("MYCP_CONFIG")
+	if configPath != "" {
+		return configPath, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("UserConfigDir fail=>%w", err)
+	}
+	return filepath.Join(configDir, "mycp", "config.json"), nil
+}
+
+// LoadConfig 读配置文件, 文件不存在时返回空的配置
+func LoadConfig() (config *Config, err error) {
+	configPath, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	config = &Config{}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("ReadFile fail=>%w", err)
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal %s fail=>%w", configPath, err)
+	}
+	for name, profile := range config.Profiles {
+		if profile == nil || profile.Address == "" {
+			return nil, fmt.Errorf("fail=>profile %s of %s has no Address", name, configPath)
+		}
+	}
+	return config, nil
+}
+
+// Profile 返回 ParseRemotePath 得到的 remoteHost 对应的 profile, remoteHost 是 ip:port 时返回 nil
+func (config *Config) Profile(remoteHost string) (profile *Profile, err error) {
+	profile, ok := config.Profiles[remoteHost]
+	if ok {
+		return profile, nil
+	}
+	if IsProfileName(remoteHost) {
+		return nil, fmt.Errorf("no profile named %s in the config", remoteHost)
+	}
+	return nil, nil
+}
+
+// IsProfileName 判断 ParseRemotePath 得到的 remoteHost 是 profile 的名字而不是 ip:port
+func IsProfileName(remoteHost string) bool {
+	return !strings.Contains(remoteHost, ":")
+}
+
+// RemotePath 把相对路径解释为相对于 Root 的路径
+func (profile *Profile) RemotePath(realPath string) string {
+	if profile == nil || profile.Root == "" || realPath == "-" || isAbsRemotePath(realPath) {
+		return realPath
+	}
+	if realPath == "" || realPath == "." {
+		return profile.Root
+	}
+	joined := path.Join(profile.Root, realPath)
+	if strings.HasSuffix(realPath, "/") {
+		// 以 / 结尾表示路径, 拷贝规则依赖这一点
+		joined += "/"
+	}
+	return joined
+}
+
+// isAbsRemotePath 判断远端路径是否是绝对路径, 远端可能是 windows, 比如 D:/work
+func isAbsRemotePath(realPath string) bool {
+	if strings.HasPrefix(realPath, "/") {
+		return true
+	}
+	return len(realPath) >= 2 && realPath[1] == ':'
+}
+
+// ReadPassword 从 profile 配置的来源读密码, 没有配置来源时返回空字符串
+func (profile *Profile) ReadPassword() (password string, err error) {
+	switch {
+	case profile.PasswordFile != "":
+		data, err := ioutil.ReadFile(expandHome(profile.PasswordFile))
+		if err != nil {
+			return "", fmt.Errorf("read password file fail=>%w", err)
+		}
+		password = strings.TrimSpace(string(data))
+	case profile.PasswordEnv != "":
+		password = os.Getenv(profile.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("env %s is empty", profile.PasswordEnv)
+		}
+	case profile.PasswordCommand != "":
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", profile.PasswordCommand)
+		} else {
+			cmd = exec.Command("sh", "-c", profile.PasswordCommand)
+		}
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("password command %s fail=>%w", strconv.Quote(profile.PasswordCommand), err)
+		}
+		password = strings.TrimSpace(string(out))
+	default:
+		return "", nil
+	}
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+// expandHome 把开头的 ~/ 换成用户的 home 路径
+func expandHome(filePath string) string {
+	if !strings.HasPrefix(filePath, "~/") {
+		return filePath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filePath
+	}
+	return filepath.Join(home, filePath[2:])
+}
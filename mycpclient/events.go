@@ -0,0 +1,121 @@
+package mycpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mycp/mycpproto"
+	"net"
+)
+
+// FileEvent 的 Action
+const (
+	FileCreated     = "created"
+	FileOverwritten = "overwritten"
+	FileSkipped     = "skipped-unmodified" // 设置了 OnlyModified 且文件在上次拷贝之后没有修改, 或者与服务端的清单相同
+	FileFailed      = "failed"
+)
+
+// 客户端一侧的错误的分类, 其他取值见 mycpproto.ErrorCode
+const (
+	ErrCodeCanceled     = "canceled"
+	ErrCodeTimeout      = "timeout"
+	ErrCodeShuttingDown = "server_shutting_down"
+)
+
+// FileEvent 是拷贝一个文件的结果, 通过 MyCPOptions.OnFile 报告.
+// 路径本身失败 (比如无法列出其中的文件) 时也报告一个 FileFailed, Src 为这个路径.
+type FileEvent struct {
+	Action string
+	Src    string
+	Dst    string // 写入的文件, 跳过或失败时可能是目标所在的路径
+	Bytes  int64
+	Err    error // Action 为 FileFailed 时的原因
+	// 服务端用去重缓存中的内容写了这个文件, 内容没有经过网络
+	Deduped bool
+}
+
+// FileError 表示拷贝 Path 时有文件失败, 失败已经通过 MyCPOptions.OnFile 报告.
+// 拷贝路径时遇到 FileError 会继续拷贝其他文件, 最后返回一个 FileError; 其他错误 (比如连接断开, ctx 被取消) 中止整个拷贝.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s=>%v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// RemoteError 是服务端执行请求失败
+type RemoteError struct {
+	Code string // 见 mycpproto.ErrorCode, 旧的服务端不会给出
+	Msg  string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote execution fail=>" + e.Msg
+}
+
+func remoteError(rsp *mycpproto.MyCPPackage) error {
+	return &RemoteError{Code: rsp.ErrCode, Msg: rsp.ErrMsg}
+}
+
+// ErrorCode 返回拷贝的错误 err 的分类: not_found, permission_denied, too_large,
+// canceled, timeout, server_shutting_down 或 unknown
+func ErrorCode(err error) string {
+	var remoteErr *RemoteError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &remoteErr):
+		if remoteErr.Code == "" {
+			return mycpproto.ErrCodeUnknown
+		}
+		return remoteErr.Code
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrCodeTimeout
+	case errors.Is(err, ErrServerShuttingDown):
+		return ErrCodeShuttingDown
+	default:
+		return mycpproto.ErrorCode(err)
+	}
+}
+
+func (opts *MyCPOptions) report(event *FileEvent) {
+	if opts.OnFile != nil {
+		opts.OnFile(event)
+	}
+}
+
+// fileFailed 报告 src 失败并返回对应的 FileError
+func (opts *MyCPOptions) fileFailed(src, dst string, err error) error {
+	opts.report(&FileEvent{Action: FileFailed, Src: src, Dst: dst, Err: err})
+	return &FileError{Path: src, Err: err}
+}
+
+// fileWritten 报告 src 已经写入 dst
+func (opts *MyCPOptions) fileWritten(src, dst string, n int64, overwritten bool) {
+	opts.report(writtenEvent(src, dst, n, overwritten))
+}
+
+// writtenEvent 返回 src 已经写入 dst 的 FileEvent
+func writtenEvent(src, dst string, n int64, overwritten bool) *FileEvent {
+	action := FileCreated
+	if overwritten {
+		action = FileOverwritten
+	}
+	return &FileEvent{Action: action, Src: src, Dst: dst, Bytes: n}
+}
+
+// entriesFailed 在拷贝路径 path 的 total 项中有 failed 项失败时返回 FileError
+func entriesFailed(path string, failed, total int) error {
+	if failed == 0 {
+		return nil
+	}
+	return &FileError{Path: path, Err: fmt.Errorf("%d of %d entries failed", failed, total)}
+}
@@ -0,0 +1,38 @@
+package mycpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mycp/mycpproto"
+)
+
+// Exec 在服务端的 dir 路径下执行 args, 输出在产生时写入 stdout 和 stderr, 返回命令的退出码.
+// dir 是文件时在它所在的路径下执行. 命令必须在服务端的白名单中.
+// 请求不会在重连后重发, 连接断开时返回错误.
+func (client *Client) Exec(ctx context.Context, dir string, args []string, stdout, stderr io.Writer) (exitCode int, err error) {
+	if len(args) == 0 {
+		return -1, fmt.Errorf("fail=>no command")
+	}
+	var myCPPackage = &mycpproto.MyCPPackage{
+		Op:       mycpproto.MyCPOpExec,
+		DstPath:  dir,
+		ExecArgs: args,
+	}
+	rsp, err := client.roundTripStream(ctx, myCPPackage, false, func(partial *mycpproto.MyCPPackage) (err error) {
+		switch partial.ExecStream {
+		case mycpproto.ExecStreamStdout:
+			_, err = stdout.Write(partial.Data)
+		case mycpproto.ExecStreamStderr:
+			_, err = stderr.Write(partial.Data)
+		}
+		return
+	})
+	if err != nil {
+		return -1, err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return -1, remoteError(rsp)
+	}
+	return rsp.ExitCode, nil
+}
@@ -0,0 +1,97 @@
+package mycpclient
+
+import (
+	"context"
+	"fmt"
+	"mycp/mycpproto"
+	"strings"
+)
+
+// fileOp 发送一个文件管理请求, 服务端执行失败时返回的错误带有服务端给出的原因
+func (client *Client) fileOp(ctx context.Context, myCPPackage *mycpproto.MyCPPackage, idempotent bool) (rsp *mycpproto.MyCPPackage, err error) {
+	rsp, err = client.roundTrip(ctx, myCPPackage, idempotent)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return nil, remoteError(rsp)
+	}
+	return rsp, nil
+}
+
+// List 列出远端路径 path 下的所有项, 按名字排序
+func (client *Client) List(ctx context.Context, path string) (infos []mycpproto.MyFileInfo, err error) {
+	rsp, err := client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:      mycpproto.MyCPOpList,
+		DstPath: path,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.MyFileInfoSlice, nil
+}
+
+// Stat 查看远端路径 path
+func (client *Client) Stat(ctx context.Context, path string) (info *mycpproto.MyFileInfo, err error) {
+	rsp, err := client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:      mycpproto.MyCPOpStat,
+		DstPath: path,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.MyFileInfoSlice) != 1 {
+		return nil, fmt.Errorf("stat fail=>got %d infos", len(rsp.MyFileInfoSlice))
+	}
+	return &rsp.MyFileInfoSlice[0], nil
+}
+
+// Mkdir 创建远端路径 path, parents 为 true 时同时创建不存在的上级路径, 且 path 已存在也算成功
+func (client *Client) Mkdir(ctx context.Context, path string, parents bool) (err error) {
+	_, err = client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:        mycpproto.MyCPOpMkdir,
+		DstPath:   path,
+		Recursive: parents,
+	}, parents)
+	return err
+}
+
+// Remove 删除远端路径, recursive 为 true 时删除整个路径. 路径不存在也算成功.
+func (client *Client) Remove(ctx context.Context, path string, recursive bool) (err error) {
+	_, err = client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:        mycpproto.MyCPOpRemove,
+		DstPath:   path,
+		Recursive: recursive,
+	}, true)
+	return err
+}
+
+// Rename 把远端路径 oldPath 重命名为 newPath, 两者必须在同一个服务端上
+func (client *Client) Rename(ctx context.Context, oldPath, newPath string) (err error) {
+	_, err = client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:      mycpproto.MyCPOpRename,
+		SrcPath: oldPath,
+		DstPath: newPath,
+	}, false)
+	return err
+}
+
+// Glob 在服务端展开通配符 pattern (语法同 filepath.Match), 返回按顺序排列的完整路径
+func (client *Client) Glob(ctx context.Context, pattern string) (paths []string, err error) {
+	rsp, err := client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:      mycpproto.MyCPOpGlob,
+		DstPath: pattern,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range rsp.MyFileInfoSlice {
+		paths = append(paths, info.Name)
+	}
+	return paths, nil
+}
+
+// HasGlobMeta 判断 path 中是否有通配符
+func HasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
@@ -0,0 +1,34 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package mycpclient
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// staleLockAge 之前创建的锁文件被认为是崩溃的进程留下的
+const staleLockAge = 1 * time.Minute
+
+// lockFile 以独占创建文件 lockPath 的方式加锁, 等到拿到锁为止. 锁文件存在超过 staleLockAge 时删除它.
+func lockFile(lockPath string) (unlock func(), err error) {
+	for {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_ = file.Close()
+			return func() {
+				_ = os.Remove(lockPath)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("OpenFile fail=>%w", err)
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			_ = os.Remove(lockPath)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
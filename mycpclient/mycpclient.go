@@ -1,86 +1,319 @@
 package mycpclient
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mycp/clientconn"
+	"mycp/mycplog"
 	"mycp/mycpproto"
 	"mycp/util"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrServerShuttingDown 表示服务端正在关闭, 请求没有被处理, 可以稍后重试
+var ErrServerShuttingDown = errors.New("server shutting down")
+
 type Client struct {
-	clientConn *clientconn.ClientConn
+	clientConn *clientconn.ReconnectClientConn
+
+	serverMutex sync.Mutex  // 保护 server, 每次 (重新) 认证时更新
+	server      *ServerInfo // 服务端在 Hello 中报告的信息
+}
+
+// ServerInfo 是服务端在 Hello 中报告的信息
+type ServerInfo struct {
+	Clock       *ServerClock // 服务端没有报告时钟时为 nil
+	BlobMinSize int64        // 服务端开启了去重缓存时, 写不小于它的文件先只发送 sha256; 0 表示没有开启
 }
 
-func NewClient(host string) (client *Client, err error) {
+// ServerClock 是在 Hello 中测得的服务端时钟与本机时钟的差
+type ServerClock struct {
+	Offset      time.Duration // 服务端的时钟 - 本机的时钟
+	Uncertainty time.Duration // Offset 的误差不超过它, 即 Hello 往返时间的一半
+}
+
+// MyCPOptions 是一次拷贝的选项, nil 等价于零值
+type MyCPOptions struct {
+	OnlyModified bool      // 只拷贝上次拷贝之后修改过的文件, 见 mycpproto.ModifiedAfter
+	LastMyCPTime time.Time // 上次拷贝的开始时间, 是源路径所在机器的时钟
+	Exclude      []string  // 跳过名字与其中之一按 path.Match 匹配的文件和路径, 直接指定的源路径本身除外
+	// 源路径在远端时 LastMyCPTime 是否是服务端的时钟 (由 ServerNow 得到). 为 false 时服务端减去 mycpproto.TimeAdvanced
+	SrcClock bool
+
+	OnFile func(event *FileEvent) // 每个文件拷贝完, 跳过或失败时调用, 可以为 nil
+
+	// 不为 nil 时从本地拷贝的每一项 (包括源路径下的每个文件和路径) 先经过它检查, 返回错误时这一项失败.
+	// 服务端推送时用它把源路径下指向 Root 外的软链接排除在外
+	Confine func(srcPath string) error
+}
+
+// ClientOptions 是建立连接的选项, nil 等价于零值
+type ClientOptions struct {
+	OnStateChange func(state clientconn.ConnState) // 用于观察连接状态的变化, 可以为 nil
+	TLSPin        string                           // 不为空时用 TLS 连接, 并且只接受 sha256 为 TLSPin 的证书
+	User          string                           // 服务端配置了多个用户时需要指定, 为空时使用服务端唯一的用户
+}
+
+// NewClient 在 ctx 内建立到 host 的连接并用 password 认证. 连接断开后会自动重连并重新认证,
+// onStateChange 用于观察连接状态的变化, 可以为 nil.
+func NewClient(ctx context.Context, host string, password string, onStateChange func(state clientconn.ConnState)) (client *Client, err error) {
+	return NewClientWithOptions(ctx, host, password, &ClientOptions{OnStateChange: onStateChange})
+}
+
+// NewClientWithOptions 与 NewClient 相同, 但可以指定更多的选项
+func NewClientWithOptions(ctx context.Context, host string, password string, opts *ClientOptions) (client *Client, err error) {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
 	client = &Client{}
-	var conn net.Conn
-	conn, err = net.DialTimeout("tcp", host, 1*time.Second)
-	if err != nil {
+	dial := func(ctx context.Context) (conn net.Conn, err error) {
+		var dialer = net.Dialer{Timeout: 1 * time.Second}
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return
+		}
+		mycplog.Debugf("new conn. local=>%v, remote=>%v", conn.LocalAddr(), conn.RemoteAddr())
+		if opts.TLSPin != "" {
+			conn, err = tlsHandshake(ctx, conn, opts.TLSPin)
+		}
 		return
 	}
-	log.Printf("new conn. local=>%v, remote=>%v", conn.LocalAddr(), conn.RemoteAddr())
-	var clientConn *clientconn.ClientConn
-	clientConn, err = clientconn.NewClientConn(conn)
+	auth := func(ctx context.Context, clientConn *clientconn.ClientConn) error {
+		key, server, err := Auth(ctx, clientConn, opts.User, password)
+		if err != nil {
+			return err
+		}
+		// 每个连接的密钥不同, 保存在连接上, 发送时由 Request.Encode 取用
+		clientConn.SetSession(key)
+		client.serverMutex.Lock()
+		client.server = server
+		client.serverMutex.Unlock()
+		return nil
+	}
+	client.clientConn, err = clientconn.NewReconnectClientConn(ctx, dial, auth, opts.OnStateChange, nil)
 	if err != nil {
-		return
+		return nil, err
 	}
-	client.clientConn = clientConn
 	return
 }
 
+// Auth 先在 clientConn 上发送明文的 Hello 取得 user 的盐, 由 password 得到密钥 K,
+// 再发送一个 MyCPOpAuth 请求, 服务端能正确解密并回复即认证成功. 服务端在 Hello 中回了随机数时,
+// 这个连接上用由双方的随机数得到的会话密钥加密, MyCPOpAuth 中带上 K 供服务端校验; 否则 (以前的版本) 直接用 K.
+// 返回这个连接上之后的请求使用的密钥, 以及服务端在 Hello 中报告的信息.
+func Auth(ctx context.Context, clientConn *clientconn.ClientConn, user, password string) (key string, server *ServerInfo, err error) {
+	nonce, err := util.GenSalt(util.NonceLen)
+	if err != nil {
+		return "", nil, err
+	}
+	helloEncoded, err := json.Marshal(&mycpproto.Hello{User: user, Nonce: nonce})
+	if err != nil {
+		return "", nil, fmt.Errorf("marshal fail=>%w", err)
+	}
+	sendTime := time.Now()
+	rspPkg, err := sendRaw(ctx, clientConn, helloEncoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("hello fail=>%w", err)
+	}
+	rtt := time.Since(sendTime)
+	var helloRsp = &mycpproto.HelloResponse{}
+	err = json.Unmarshal(rspPkg, helloRsp)
+	if err != nil {
+		return "", nil, fmt.Errorf("unmarshal HelloResponse fail=>%w", err)
+	}
+	clientConn.SetConnID(helloRsp.ConnID)
+	server = &ServerInfo{BlobMinSize: helloRsp.BlobMinSize}
+	if !helloRsp.ServerTime.IsZero() {
+		// 假设服务端在往返的中点回复
+		server.Clock = &ServerClock{
+			Offset:      helloRsp.ServerTime.Sub(sendTime.Add(rtt / 2)),
+			Uncertainty: rtt / 2,
+		}
+		mycplog.Debugf("server clock offset=>%v, uncertainty=>%v", server.Clock.Offset, server.Clock.Uncertainty)
+	}
+	if len(helloRsp.Salt) == 0 {
+		// 服务端使用旧式的 16 字节密码
+		if len(password) != 16 {
+			return "", nil, errors.New("auth fail=>server uses a 16 bytes password")
+		}
+		key = password
+	} else {
+		key = util.DeriveKey(password, helloRsp.Salt, helloRsp.Iterations)
+	}
+	var authPackage = &mycpproto.MyCPPackage{Op: mycpproto.MyCPOpAuth}
+	if len(helloRsp.Nonce) != 0 {
+		authPackage.AuthProof = []byte(key)
+		key = util.SessionKey(util.KeyVerifier(key), nonce, helloRsp.Nonce)
+	}
+
+	pkgEncoded, err := json.Marshal(authPackage)
+	if err != nil {
+		return "", nil, fmt.Errorf("marshal fail=>%w", err)
+	}
+	rspPkg, err = sendRaw(ctx, clientConn, util.Encrypt(pkgEncoded, key))
+	if err != nil {
+		return "", nil, fmt.Errorf("auth fail=>%w", err)
+	}
+	decrypted, err := util.Decrypt(rspPkg, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("Decrypt fail=>%w", err)
+	}
+	var rsp = &mycpproto.MyCPPackage{}
+	err = json.Unmarshal(decrypted, rsp)
+	if err != nil {
+		return "", nil, fmt.Errorf("unmarshal fail=>%w", err)
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return "", nil, fmt.Errorf("auth fail=>%w", remoteError(rsp))
+	}
+	return key, server, nil
+}
+
+// sendRaw 在 clientConn 上发送 pkg 并等待响应, 不做加解密
+func sendRaw(ctx context.Context, clientConn *clientconn.ClientConn, pkg []byte) (rspPkg []byte, err error) {
+	var request = &clientconn.Request{
+		ResponseCh: make(chan *clientconn.Request, 1),
+		Pkg:        pkg,
+	}
+	clientConn.SendContext(ctx, request)
+
+	select {
+	case request = <-request.ResponseCh:
+	case <-ctx.Done():
+		clientConn.Cancel(request)
+		return nil, ctx.Err()
+	}
+	if request.Err != nil {
+		return nil, request.Err
+	}
+	return request.Pkg, nil
+}
+
 func (client *Client) Close() {
 	client.clientConn.Close()
 }
 
-// windows 也使用 "/" 的形式.
-// 比如 D:/work/gopaths/gopath-wtableplus/src/bj58.com/wtableplus/proxy/transaction.go
-func (client *Client) MyCPFromRemoteToLocal(srcPath, dstPath string, onlyModified bool, lastMyCPTime time.Time, password string) (err error) {
-	// 发请求
-	var myCPPackage = &mycpproto.MyCPPackage{
-		SrcPath:      srcPath,
-		DstPath:      dstPath,
-		OnlyModified: onlyModified,
-		LastMyCPTime: lastMyCPTime,
-		Direction:    mycpproto.DirectionRemoteIsSrc,
+// ServerNow 返回服务端的时钟的现在, 取误差范围内最早的时间, 用作以服务端的时钟计的上次 mycp 时间.
+// 服务端没有报告时钟 (旧版本) 时返回本机的时钟和 false.
+func (client *Client) ServerNow() (now time.Time, ok bool) {
+	clock := client.serverInfo().Clock
+	now = time.Now()
+	if clock == nil {
+		return now, false
 	}
+	return now.Add(clock.Offset - clock.Uncertainty), true
+}
+
+// serverInfo 返回最近一次认证时服务端报告的信息
+func (client *Client) serverInfo() *ServerInfo {
+	client.serverMutex.Lock()
+	defer client.serverMutex.Unlock()
+	if client.server == nil {
+		return &ServerInfo{}
+	}
+	return client.server
+}
+
+// roundTrip 加密发送 myCPPackage 并等待解密后的响应, ctx 被取消时放弃这个请求
+func (client *Client) roundTrip(ctx context.Context, myCPPackage *mycpproto.MyCPPackage, idempotent bool) (rsp *mycpproto.MyCPPackage, err error) {
+	return client.roundTripStream(ctx, myCPPackage, idempotent, nil)
+}
+
+// roundTripStream 与 roundTrip 相同, 但每个中间响应都会交给 onPartial. onPartial 返回错误时
+// 仍然会等到最终响应, 然后返回这个错误.
+func (client *Client) roundTripStream(ctx context.Context, myCPPackage *mycpproto.MyCPPackage, idempotent bool, onPartial func(partial *mycpproto.MyCPPackage) error) (rsp *mycpproto.MyCPPackage, err error) {
 	var request = &clientconn.Request{
 		ResponseCh: make(chan *clientconn.Request, 1),
+		Idempotent: idempotent,
 	}
 	pkgEncoded, err := json.Marshal(myCPPackage)
 	if err != nil {
-		return fmt.Errorf("marshal fail=>%w", err)
+		return nil, fmt.Errorf("marshal fail=>%w", err)
+	}
+	// key 是最后一次发送时所在连接的密钥. 它在发送的协程中赋值, 响应经过 ResponseCh 之后才读, 所以不用加锁
+	var key string
+	request.Encode = func(clientConn *clientconn.ClientConn) []byte {
+		key, _ = clientConn.Session().(string)
+		return util.Encrypt(pkgEncoded, key)
 	}
-	request.Pkg = util.Encrypt(pkgEncoded, password)
-	client.clientConn.Send(request)
+	client.clientConn.SendContext(ctx, request)
 
 	// 处理响应
-	request = <-request.ResponseCh
-	if request.Err != nil {
-		return fmt.Errorf("request.Err=>%w", request.Err)
+	var partialErr error
+	for {
+		response := <-request.ResponseCh
+		logger := mycplog.With("conn", response.ConnID(), "seq", response.Seq())
+		if response.Err != nil {
+			logger.Debugf("op=>%v, request.Err=>%v", myCPPackage.Op, response.Err)
+			return nil, fmt.Errorf("request.Err=>%w", response.Err)
+		}
+		decrypted, err := util.Decrypt(response.Pkg, key)
+		if err != nil {
+			return nil, fmt.Errorf("Decrypt fail=>%w", err)
+		}
+		rsp = &mycpproto.MyCPPackage{}
+		err = json.Unmarshal(decrypted, rsp)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal fail=>%w", err)
+		}
+		if !response.More {
+			logger.Debugf("op=>%v, src=>%s, dst=>%s, status=>%v", myCPPackage.Op, myCPPackage.SrcPath, myCPPackage.DstPath, rsp.Status)
+			break
+		}
+		if onPartial != nil && partialErr == nil {
+			partialErr = onPartial(rsp)
+		}
+	}
+	if partialErr != nil {
+		return nil, partialErr
+	}
+	if rsp.Status == mycpproto.MyCPPackageStatusShuttingDown {
+		return nil, ErrServerShuttingDown
+	}
+	return rsp, nil
+}
+
+// windows 也使用 "/" 的形式.
+// 比如 D:/work/gopaths/gopath-wtableplus/src/bj58.com/wtableplus/proxy/transaction.go
+// ctx 被取消时放弃正在进行的请求并返回, 不会留下写了一半的本地文件.
+func (client *Client) MyCPFromRemoteToLocal(ctx context.Context, srcPath, dstPath string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
 	}
-	dycrpted, err := util.Decrypt(request.Pkg, password)
+	err = ctx.Err()
 	if err != nil {
-		return fmt.Errorf("Decrypt fail=>%w", err)
+		return
 	}
-	var rsp = &mycpproto.MyCPPackage{}
-	err = json.Unmarshal(dycrpted, rsp)
+
+	// 发请求
+	var myCPPackage = &mycpproto.MyCPPackage{
+		SrcPath:      srcPath,
+		DstPath:      dstPath,
+		OnlyModified: opts.OnlyModified,
+		LastMyCPTime: opts.LastMyCPTime,
+		SrcClock:     opts.SrcClock,
+		Direction:    mycpproto.DirectionRemoteIsSrc,
+	}
+	rsp, err := client.roundTrip(ctx, myCPPackage, true)
 	if err != nil {
-		return fmt.Errorf("unmarshal fail=>%w", err)
+		return err
 	}
 	if rsp.Status == mycpproto.MyCPPackageStatusFail {
-		return fmt.Errorf("fail=>MyCPPackageStatusFail")
+		return opts.fileFailed(srcPath, dstPath, remoteError(rsp))
 	} else if rsp.Status == mycpproto.MyCPPackageStatusNoNeedToCP {
-		log.Printf("no need to cp")
+		mycplog.Infof("no need to cp")
+		opts.report(&FileEvent{Action: FileSkipped, Src: srcPath, Dst: dstPath})
 		return nil
 	}
 
@@ -90,10 +323,11 @@ func (client *Client) MyCPFromRemoteToLocal(srcPath, dstPath string, onlyModifie
 		dstFileInfo, err := os.Stat(dstPath)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				return fmt.Errorf("os.Stat fail=>%w", err)
+				return opts.fileFailed(srcPath, dstPath, fmt.Errorf("os.Stat fail=>%w", err))
 			}
 		}
 
+		var realDstFile string
 		if os.IsNotExist(err) {
 			// 如果 dst 不存在
 			// 如果 dst 以 / 结尾则当成是路径, 否则视为文件
@@ -101,41 +335,18 @@ func (client *Client) MyCPFromRemoteToLocal(srcPath, dstPath string, onlyModifie
 			if realDstPath != "" {
 				err := os.MkdirAll(realDstPath, 0775)
 				if err != nil {
-					return fmt.Errorf("MkdirAll fail=>%w", err)
+					return opts.fileFailed(srcPath, dstPath, fmt.Errorf("MkdirAll fail=>%w", err))
 				}
 			}
-			var realDstFile = dstPath
+			realDstFile = dstPath
 			if len(realDstPath) == len(dstPath) {
 				// 如果 dst 以 / 结尾, 则视为路径
 				_, realSrcFileName := filepath.Split(srcPath)
 				realDstFile = fmt.Sprintf("%s/%s", realDstPath, realSrcFileName)
 			}
-			log.Printf("be to write=>%s", realDstFile)
-			outputFile, err := os.OpenFile(realDstFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				return fmt.Errorf("OpenFile fail=>%w", err)
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(rsp.Data)
-			if err != nil {
-				return fmt.Errorf("write fail=>%w", err)
-			}
-			//log.Printf("total write %d Bytes", n)
-			_ = n
-			return nil
 		} else if !dstFileInfo.IsDir() {
 			// dst 存在且是文件
-			outputFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				return fmt.Errorf("OpenFile fail=>%w", err)
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(rsp.Data)
-			if err != nil {
-				return fmt.Errorf("write fail=>%w", err)
-			}
-			log.Printf("total write %d Bytes", n)
-			return nil
+			realDstFile = dstPath
 		} else {
 			// dst 存在且是路径
 
@@ -145,34 +356,34 @@ func (client *Client) MyCPFromRemoteToLocal(srcPath, dstPath string, onlyModifie
 			}
 
 			_, realSrcFileName := filepath.Split(srcPathTrimmed)
-			dstFileName := fmt.Sprintf("%s/%s", dstPath, realSrcFileName)
-			log.Printf("be to write=>%s", dstFileName)
-			outputFile, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				return fmt.Errorf("OpenFile fail=>%w", err)
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(rsp.Data)
-			if err != nil {
-				return fmt.Errorf("write fail=>%w", err)
-			}
-			//log.Printf("total write %d Bytes", n)
-			_ = n
-			return nil
+			realDstFile = fmt.Sprintf("%s/%s", dstPath, realSrcFileName)
+		}
+
+		mycplog.Debugf("be to write=>%s", realDstFile)
+		err = ctx.Err()
+		if err != nil {
+			return err
 		}
+		_, statErr := os.Stat(realDstFile)
+		err = util.WriteFileAtomic(realDstFile, rsp.Data, 0664)
+		if err != nil {
+			return opts.fileFailed(srcPath, realDstFile, fmt.Errorf("WriteFileAtomic fail=>%w", err))
+		}
+		opts.fileWritten(srcPath, realDstFile, int64(len(rsp.Data)), statErr == nil)
+		return nil
 	} else {
 		// 源是路径
 
 		dstPathInfo, err := os.Stat(dstPath)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				return fmt.Errorf("os.Stat fail=>%w", err)
+				return opts.fileFailed(srcPath, dstPath, fmt.Errorf("os.Stat fail=>%w", err))
 			}
 		}
 		// 如果 src 是路径, dst 不存在, 则把 dst 当成是路径
 
 		if err == nil && !dstPathInfo.IsDir() {
-			return fmt.Errorf("fail=>src is dir but dst is file")
+			return opts.fileFailed(srcPath, dstPath, errors.New("src is dir but dst is file"))
 		}
 
 		srcPathTrimmed := strings.TrimSuffix(srcPath, "/")
@@ -185,96 +396,64 @@ func (client *Client) MyCPFromRemoteToLocal(srcPath, dstPath string, onlyModifie
 
 		err = os.MkdirAll(realDstPath, 0775)
 		if err != nil {
-			return fmt.Errorf("os.MkdirAll fail=>%w", err)
+			return opts.fileFailed(srcPath, realDstPath, fmt.Errorf("os.MkdirAll fail=>%w", err))
 		}
 
+		// 一项失败时继续拷贝其他项
+		var failed, total int
 		for _, myFileInfo := range rsp.MyFileInfoSlice {
+			if util.Excluded(myFileInfo.Name, opts.Exclude) {
+				continue
+			}
+			total++
 			newSrcPath := fmt.Sprintf("%s/%s", srcPath, myFileInfo.Name)
-			err = client.MyCPFromRemoteToLocal(newSrcPath, realDstPath, onlyModified, lastMyCPTime, password)
+			err = client.MyCPFromRemoteToLocal(ctx, newSrcPath, realDstPath, opts)
+			var fileErr *FileError
+			if errors.As(err, &fileErr) {
+				failed++
+				continue
+			}
 			if err != nil {
 				return fmt.Errorf("MyCPFromRemoteToLocal fail=>%w", err)
 			}
 		}
-		return nil
+		return entriesFailed(srcPath, failed, total)
 	}
 }
 
-func (client *Client) MyCPFromLocalToRemote(srcPath, dstPath string, onlyModified bool, lastMyCPTime time.Time, password string) (err error) {
-	srcPathInfo, err := os.Stat(srcPath)
+// ctx 被取消时放弃正在进行的请求并返回, 服务端只会在收到完整文件后才替换目标文件.
+func (client *Client) MyCPFromLocalToRemote(ctx context.Context, srcPath, dstPath string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	err = ctx.Err()
 	if err != nil {
-		log.Printf("os.Stat fail=>%v", err)
 		return
 	}
+
+	if opts.Confine != nil {
+		err = opts.Confine(srcPath)
+		if err != nil {
+			mycplog.Warnf("confine fail=>%v", err)
+			return opts.fileFailed(srcPath, dstPath, err)
+		}
+	}
+	srcPathInfo, err := os.Stat(srcPath)
+	if err != nil {
+		mycplog.Warnf("os.Stat fail=>%v", err)
+		return opts.fileFailed(srcPath, dstPath, fmt.Errorf("os.Stat fail=>%w", err))
+	}
 	if !srcPathInfo.IsDir() {
 		// 如果 src 是文件
-		if onlyModified {
-			if srcPathInfo.ModTime().Before(lastMyCPTime.Add(-mycpproto.TimeAdvanced)) {
-				log.Printf("no need to cp because no modification")
+		if opts.OnlyModified {
+			if srcPathInfo.ModTime().Before(mycpproto.ModifiedAfter(opts.LastMyCPTime)) {
+				mycplog.Debugf("no need to cp because no modification")
+				opts.report(&FileEvent{Action: FileSkipped, Src: srcPath, Dst: dstPath})
 				return
 			}
 		}
 
-		var inputFile *os.File
-		inputFile, err = os.Open(srcPath)
-		if err != nil {
-			log.Printf("open fail=>%v", err)
-			return
-		}
-		var maxSize = 500 * 1024 * 1024
-		data := make([]byte, maxSize)
-		var n int
-		n, err = inputFile.Read(data)
-		if err != nil {
-			log.Printf("Read fail=>%v", err)
-			return
-		}
-		//log.Printf("file data=>#%v#", data[:n])
-		//log.Printf("file data=>%#v", data[:n])
-		_ = inputFile.Close()
-		if n >= maxSize {
-			log.Printf("file larger than %d Bytes, filename=>%s", maxSize, srcPath)
-			err = fmt.Errorf("file larger than %d Bytes, filename=>%s", maxSize, srcPath)
-			return
-		}
-
-		// 发请求
-		var myCPPackage = &mycpproto.MyCPPackage{
-			SrcPath:   srcPath,
-			DstPath:   dstPath,
-			Direction: mycpproto.DirectionRemoteIsDst,
-			SrcIsDir:  false,
-			Data:      data[:n],
-		}
-		var request = &clientconn.Request{
-			ResponseCh: make(chan *clientconn.Request, 1),
-		}
-		var pkgEncoded []byte
-		pkgEncoded, err = json.Marshal(myCPPackage)
-		if err != nil {
-			err = fmt.Errorf("marshal fail=>%w", err)
-			return
-		}
-		request.Pkg = util.Encrypt(pkgEncoded, password)
-		client.clientConn.Send(request)
-
-		// 处理响应
-		request = <-request.ResponseCh
-		if request.Err != nil {
-			return fmt.Errorf("request.Err=>%w", request.Err)
-		}
-		dycrypted, err := util.Decrypt(request.Pkg, password)
-		if err != nil {
-			return fmt.Errorf("Decrypt fail=>%w", err)
-		}
-		var rsp = &mycpproto.MyCPPackage{}
-		err = json.Unmarshal(dycrypted, rsp)
-		if err != nil {
-			return fmt.Errorf("unmarshal fail=>%w", err)
-		}
-		if rsp.Status != mycpproto.MyCPPackageStatusSucc {
-			return fmt.Errorf("remote execution fail")
-		}
-		return nil
+		return client.putFile(ctx, srcPath, dstPath, time.Time{}, opts)
 	} else {
 		// 如果 src 是路径
 
@@ -285,43 +464,20 @@ func (client *Client) MyCPFromLocalToRemote(srcPath, dstPath string, onlyModifie
 			Direction: mycpproto.DirectionRemoteIsDst,
 			SrcIsDir:  true,
 		}
-		var request = &clientconn.Request{
-			ResponseCh: make(chan *clientconn.Request, 1),
-		}
-		var pkgEncoded []byte
-		pkgEncoded, err = json.Marshal(myCPPackage)
-		if err != nil {
-			err = fmt.Errorf("marshal fail=>%w", err)
-			return
-		}
-		request.Pkg = util.Encrypt(pkgEncoded, password)
-		client.clientConn.Send(request)
-
-		// 处理响应
-		request = <-request.ResponseCh
-		if request.Err != nil {
-			return fmt.Errorf("request.Err=>%w", request.Err)
-		}
-		var dycrypted []byte
-		dycrypted, err = util.Decrypt(request.Pkg, password)
-		if err != nil {
-			return fmt.Errorf("Decrypt fail=>%w", err)
-		}
-		var rsp = &mycpproto.MyCPPackage{}
-		err = json.Unmarshal(dycrypted, rsp)
+		var rsp *mycpproto.MyCPPackage
+		rsp, err = client.roundTrip(ctx, myCPPackage, true)
 		if err != nil {
-			return fmt.Errorf("unmarshal fail=>%w", err)
+			return err
 		}
 		if rsp.Status != mycpproto.MyCPPackageStatusSucc {
-			return fmt.Errorf("remote execution fail")
+			return opts.fileFailed(srcPath, dstPath, remoteError(rsp))
 		}
 
 		var fileInfos []os.FileInfo
 		fileInfos, err = ioutil.ReadDir(srcPath)
 		if err != nil {
-			log.Printf("ioutil.ReadDir fail=>%v", err)
-			err = fmt.Errorf("ioutil.ReadDir fail=>%v", err)
-			return
+			mycplog.Warnf("ioutil.ReadDir fail=>%v", err)
+			return opts.fileFailed(srcPath, dstPath, fmt.Errorf("ioutil.ReadDir fail=>%w", err))
 		}
 
 		srcPathTrimmed := strings.TrimSuffix(srcPath, "/")
@@ -331,89 +487,137 @@ func (client *Client) MyCPFromLocalToRemote(srcPath, dstPath string, onlyModifie
 
 		_, srcPathLast := filepath.Split(srcPathTrimmed)
 		newDstPath := fmt.Sprintf("%s/%s", dstPath, srcPathLast)
+		// 一项失败时继续拷贝其他项
+		var failed, total int
 		for _, fileInfo := range fileInfos {
+			if util.Excluded(fileInfo.Name(), opts.Exclude) {
+				continue
+			}
+			total++
 			newSrcPath := fmt.Sprintf("%s/%s", srcPath, fileInfo.Name())
-			err = client.MyCPFromLocalToRemote(newSrcPath, newDstPath, onlyModified, lastMyCPTime, password)
+			err = client.MyCPFromLocalToRemote(ctx, newSrcPath, newDstPath, opts)
+			var fileErr *FileError
+			if errors.As(err, &fileErr) {
+				failed++
+				continue
+			}
 			if err != nil {
-				log.Printf("MyCPFromLocalToRemote fail=>%v", err)
+				mycplog.Warnf("MyCPFromLocalToRemote fail=>%v", err)
 				return
 			}
 		}
-		return nil
+		return entriesFailed(srcPath, failed, total)
 	}
 }
 
-var MyCPInfoFileName = "mycp_info.txt"
-
-func ReadMyCPInfo() (myCPInfo *mycpproto.MyCPInfo, err error) {
-	binDir, err := os.Executable()
-	if err != nil {
-		return nil, fmt.Errorf("os.Executable fail=>%w", err)
-	}
-	binDir, err = filepath.Abs(filepath.Dir(binDir))
+// putFile 把本地文件 srcPath 写入远端的 dstPath, 规则与 MyCPFromLocalToRemote 相同.
+// modTime 不为零值时服务端把写入的文件的修改时间设为它.
+func (client *Client) putFile(ctx context.Context, srcPath, dstPath string, modTime time.Time, opts *MyCPOptions) (err error) {
+	inputFile, err := os.Open(srcPath)
 	if err != nil {
-		return nil, fmt.Errorf("fail to get bin dir=>%w", err)
+		mycplog.Warnf("open fail=>%v", err)
+		return opts.fileFailed(srcPath, dstPath, fmt.Errorf("open fail=>%w", err))
 	}
-	myCPInfoFilePath := fmt.Sprintf("%s/%s", binDir, MyCPInfoFileName)
-	myCPInfoFile, err := os.Open(myCPInfoFilePath)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("Open fail=>%w", err)
+	var maxSize = 500 * 1024 * 1024
+	data := make([]byte, maxSize)
+	var n int
+	n, err = inputFile.Read(data)
+	if err != nil && err != io.EOF {
+		_ = inputFile.Close()
+		mycplog.Warnf("Read fail=>%v", err)
+		return opts.fileFailed(srcPath, dstPath, fmt.Errorf("Read fail=>%w", err))
 	}
-	if err == nil {
-		defer myCPInfoFile.Close()
+	//log.Printf("file data=>#%v#", data[:n])
+	//log.Printf("file data=>%#v", data[:n])
+	_ = inputFile.Close()
+	if n >= maxSize {
+		mycplog.Warnf("file larger than %d Bytes, filename=>%s", maxSize, srcPath)
+		return opts.fileFailed(srcPath, dstPath, fmt.Errorf("%w, limit %d Bytes, filename=>%s", mycpproto.ErrTooLarge, maxSize, srcPath))
 	}
 
-	myCPInfo = &mycpproto.MyCPInfo{}
-	if err == nil {
-		// 文件确实存在
-		pkgSize := 1024 * 1024 * 100
-		pkg := make([]byte, pkgSize)
-		n, err := myCPInfoFile.Read(pkg)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("Read fail=>%w", err)
-		}
-		if n >= pkgSize {
-			return nil, fmt.Errorf("fail=>MyCPInfo large over %d Bytes", pkgSize)
+	// 发请求
+	var myCPPackage = &mycpproto.MyCPPackage{
+		SrcPath:    srcPath,
+		DstPath:    dstPath,
+		Direction:  mycpproto.DirectionRemoteIsDst,
+		SrcIsDir:   false,
+		Data:       data[:n],
+		SrcModTime: modTime,
+	}
+	var rsp *mycpproto.MyCPPackage
+	if blobMinSize := client.serverInfo().BlobMinSize; blobMinSize > 0 && int64(n) >= blobMinSize {
+		// 先只发送 sha256, 服务端的去重缓存中没有时再发送内容
+		sum := sha256.Sum256(data[:n])
+		myCPPackage.Data, myCPPackage.BlobSHA256 = nil, hex.EncodeToString(sum[:])
+		rsp, err = client.roundTrip(ctx, myCPPackage, true)
+		if err != nil {
+			return err
 		}
-		pkg = pkg[:n]
-		if len(pkg) > 0 {
-			err := json.Unmarshal(pkg, myCPInfo)
-			if err != nil {
-				return nil, fmt.Errorf("unmarshal fail=>%w", err)
-			}
+		myCPPackage.Data, myCPPackage.BlobSHA256 = data[:n], ""
+	}
+	if rsp == nil || rsp.Status == mycpproto.MyCPPackageStatusNeedData {
+		rsp, err = client.roundTrip(ctx, myCPPackage, true)
+		if err != nil {
+			return err
 		}
 	}
-	if myCPInfo.Path2LastMyCPTime == nil {
-		myCPInfo.Path2LastMyCPTime = make(map[string]time.Time)
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return opts.fileFailed(srcPath, dstPath, remoteError(rsp))
 	}
-	return myCPInfo, nil
+	event := writtenEvent(srcPath, rsp.DstPath, int64(n), rsp.Overwritten)
+	event.Deduped = rsp.Deduped
+	opts.report(event)
+	return nil
 }
 
-func WriteMyCPInfo(myCPInfo *mycpproto.MyCPInfo) (err error) {
-	binDir, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("os.Executable fail=>%w", err)
+// ParseRemotePath 解析 @ip:port:path, @profile:path 或 @R:path 形式的远端路径.
+// 冒号后面是端口号时视为 ip:port, 否则视为 profile 的名字, remoteHost 为这个名字, 由调用方通过配置文件解析.
+func ParseRemotePath(path, lastRemoteHost string) (remoteHost, realPath string, err error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "@") {
+		err = errors.New("need remote host but nil")
+		return
 	}
-	binDir, err = filepath.Abs(filepath.Dir(binDir))
-	if err != nil {
-		return fmt.Errorf("fail to get bin dir=>%w", err)
+	if strings.HasPrefix(path, "@R:") {
+		if lastRemoteHost == "" {
+			err = errors.New("no last remote host, specify it pls")
+			return
+		}
+		remoteHost = lastRemoteHost
+		realPath = path[3:]
+		return
 	}
-	myCPInfoFilePath := fmt.Sprintf("%s/%s", binDir, MyCPInfoFileName)
-	log.Printf("myCPInfoFilePath=>%s", myCPInfoFilePath)
-	myCPInfoFile, err := os.OpenFile(myCPInfoFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-	if err != nil {
-		return fmt.Errorf("Open fail=>%w", err)
+	idx01 := strings.IndexRune(path, ':')
+	if idx01 == -1 {
+		err = errors.New("need remote host but nil")
+		return
 	}
-	defer myCPInfoFile.Close()
-	pkg, err := json.Marshal(myCPInfo)
-	if err != nil {
-		return fmt.Errorf("Marshal fail=>%w", err)
+	idx02 := strings.IndexRune(path[idx01+1:], ':')
+	if idx02 == -1 || !isPort(path[idx01+1:idx01+1+idx02]) {
+		// @profile:path
+		remoteHost = path[1:idx01]
+		realPath = path[idx01+1:]
+		if remoteHost == "" {
+			err = errors.New("need remote host but nil")
+		}
+		return
 	}
-	_, err = myCPInfoFile.Write(pkg)
-	if err != nil {
-		return fmt.Errorf("Write fail=>%w", err)
+	idx := idx01 + idx02 + 1
+	remoteHost = path[1:idx]
+	realPath = path[idx+1:]
+	return
+}
+
+func isPort(s string) bool {
+	if s == "" {
+		return false
 	}
-	return nil
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 // @172.0.0.1:D:/work/study/study-golang03/demos/mycp/tmp/e_dir/e_b_dir
@@ -426,63 +630,15 @@ func ParsePath(srcPath, dstPath, lastRemoteHost string) (realSrcPath, realDstPat
 			err = errors.New("only one remote host needed but two offered")
 			return
 		}
-		if strings.HasPrefix(srcPath, "@R:") {
-			if lastRemoteHost == "" {
-				err = errors.New("no last remote host, specify it pls")
-				return
-			}
-			remoteHost = lastRemoteHost
-			realSrcPath = srcPath[3:]
-			realDstPath = dstPath
-			remoteIsSrc = true
-			return
-		} else {
-			idx01 := strings.IndexRune(srcPath, ':')
-			if idx01 == -1 {
-				err = errors.New("need remote host but nil")
-				return
-			}
-			idx02 := strings.IndexRune(srcPath[idx01+1:], ':')
-			if idx02 == -1 {
-				err = errors.New("need remote host but nil")
-				return
-			}
-			idx := idx01 + idx02 + 1
-			remoteHost = srcPath[1:idx]
-			realSrcPath = srcPath[idx+1:]
-			realDstPath = dstPath
-			remoteIsSrc = true
-			return
-		}
+		remoteHost, realSrcPath, err = ParseRemotePath(srcPath, lastRemoteHost)
+		realDstPath = dstPath
+		remoteIsSrc = true
+		return
 	} else if strings.HasPrefix(dstPath, "@") {
-		if strings.HasPrefix(dstPath, "@R:") {
-			if lastRemoteHost == "" {
-				err = errors.New("no last remote host, specify it pls")
-				return
-			}
-			remoteHost = lastRemoteHost
-			realSrcPath = srcPath
-			realDstPath = dstPath[3:]
-			remoteIsSrc = false
-			return
-		} else {
-			idx01 := strings.IndexRune(dstPath, ':')
-			if idx01 == -1 {
-				err = errors.New("need remote host but nil")
-				return
-			}
-			idx02 := strings.IndexRune(dstPath[idx01+1:], ':')
-			if idx02 == -1 {
-				err = errors.New("need remote host but nil")
-				return
-			}
-			idx := idx01 + idx02 + 1
-			remoteHost = dstPath[1:idx]
-			realDstPath = dstPath[idx+1:]
-			realSrcPath = srcPath
-			remoteIsSrc = false
-			return
-		}
+		remoteHost, realDstPath, err = ParseRemotePath(dstPath, lastRemoteHost)
+		realSrcPath = srcPath
+		remoteIsSrc = false
+		return
 	} else {
 		err = errors.New("need remote host but nil")
 		return
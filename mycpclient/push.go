@@ -0,0 +1,39 @@
+package mycpclient
+
+import (
+	"context"
+	"mycp/mycpproto"
+)
+
+// MyCPFromRemoteToRemote 让当前连接的服务端把它的 srcPath 直接推送到另一个服务端 dstHost 的 dstPath,
+// dstPassword 是 dstHost 的密码, dst 是服务端连接 dstHost 用的选项 (User 和 TLSPin), 其中的 OnStateChange 不会被使用.
+// 拷贝规则与 MyCPFromLocalToRemote 相同, 数据不经过本机. 请求不会在重连后重发, 连接断开时返回错误.
+func (client *Client) MyCPFromRemoteToRemote(ctx context.Context, srcPath, dstHost, dstPassword string, dst *ClientOptions, dstPath string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	if dst == nil {
+		dst = &ClientOptions{}
+	}
+	var myCPPackage = &mycpproto.MyCPPackage{
+		Op:           mycpproto.MyCPOpPush,
+		SrcPath:      srcPath,
+		DstPath:      dstPath,
+		PushHost:     dstHost,
+		PushUser:     dst.User,
+		PushPassword: dstPassword,
+		PushTLSPin:   dst.TLSPin,
+		OnlyModified: opts.OnlyModified,
+		LastMyCPTime: opts.LastMyCPTime,
+		SrcClock:     opts.SrcClock,
+		Exclude:      opts.Exclude,
+	}
+	rsp, err := client.roundTripStream(ctx, myCPPackage, false, nil)
+	if err != nil {
+		return err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return remoteError(rsp)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package mycpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+var MyCPInfoFileName = "mycp_info.txt"
+
+var (
+	MyCPInfoMaxAge     = 90 * 24 * time.Hour // 超过这个时间没有再拷贝过的源路径的上次 mycp 时间会被删除
+	MyCPInfoMaxEntries = 10000               // 最多保留这么多个源路径的上次 mycp 时间, 超过时删除最旧的
+)
+
+// StateDir 返回保存客户端状态 (MyCPInfo, shell 的历史记录等) 的路径, 不存在时创建.
+// 依次是环境变量 MYCP_STATE_DIR, $XDG_STATE_HOME/mycp, 以及 linux 等系统下的 ~/.local/state/mycp,
+// windows 和 macOS 下用户配置路径下的 mycp.
+func StateDir() (stateDir string, err error) {
+	stateDir = os.Getenv("MYCP_STATE_DIR")
+	if stateDir == "" {
+		if xdgStateHome := os.Getenv("XDG_STATE_HOME"); xdgStateHome != "" {
+			stateDir = filepath.Join(xdgStateHome, "mycp")
+		} else if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+			configDir, err := os.UserConfigDir()
+			if err != nil {
+				return "", fmt.Errorf("UserConfigDir fail=>%w", err)
+			}
+			stateDir = filepath.Join(configDir, "mycp")
+		} else {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("UserHomeDir fail=>%w", err)
+			}
+			stateDir = filepath.Join(home, ".local", "state", "mycp")
+		}
+	}
+	err = os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	return stateDir, nil
+}
+
+// MyCPInfoFilePath 返回 MyCPInfo 所在文件的路径
+func MyCPInfoFilePath() (myCPInfoFilePath string, err error) {
+	stateDir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, MyCPInfoFileName), nil
+}
+
+// ReadMyCPInfo 读 MyCPInfo. 文件总是整个被替换, 所以读的时候不需要加锁.
+// 状态路径下还没有文件时, 读以前版本保存在可执行文件所在路径下的文件.
+func ReadMyCPInfo() (myCPInfo *mycpproto.MyCPInfo, err error) {
+	myCPInfoFilePath, err := MyCPInfoFilePath()
+	if err != nil {
+		return nil, err
+	}
+	myCPInfo, err = readMyCPInfoFile(myCPInfoFilePath)
+	if err != nil || myCPInfo != nil {
+		return myCPInfo, err
+	}
+
+	myCPInfo = &mycpproto.MyCPInfo{}
+	binPath, err := os.Executable()
+	if err == nil {
+		legacyMyCPInfo, err := readMyCPInfoFile(filepath.Join(filepath.Dir(binPath), MyCPInfoFileName))
+		if err != nil {
+			mycplog.Warnf("read legacy MyCPInfo fail=>%v", err)
+		} else if legacyMyCPInfo != nil {
+			myCPInfo = legacyMyCPInfo
+		}
+	}
+	if myCPInfo.Path2LastMyCPTime == nil {
+		myCPInfo.Path2LastMyCPTime = make(map[string]time.Time)
+	}
+	return myCPInfo, nil
+}
+
+// readMyCPInfoFile 读文件 filePath 中的 MyCPInfo, 文件不存在时返回 nil
+func readMyCPInfoFile(filePath string) (myCPInfo *mycpproto.MyCPInfo, err error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ReadFile fail=>%w", err)
+	}
+	myCPInfo = &mycpproto.MyCPInfo{}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, myCPInfo)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal %s fail=>%w", filePath, err)
+		}
+	}
+	if myCPInfo.Path2LastMyCPTime == nil {
+		myCPInfo.Path2LastMyCPTime = make(map[string]time.Time)
+	}
+	return myCPInfo, nil
+}
+
+// UpdateMyCPInfo 在文件锁内读出最新的 MyCPInfo, 调用 update 修改它, 删除过期的上次 mycp 时间后写回.
+// 同时运行的多个 mycp 各自的修改都会保留. 写文件时先写临时文件再 rename.
+func UpdateMyCPInfo(update func(myCPInfo *mycpproto.MyCPInfo)) (err error) {
+	myCPInfoFilePath, err := MyCPInfoFilePath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(myCPInfoFilePath + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock fail=>%w", err)
+	}
+	defer unlock()
+
+	myCPInfo, err := ReadMyCPInfo()
+	if err != nil {
+		return err
+	}
+	update(myCPInfo)
+	PruneMyCPInfo(myCPInfo, MyCPInfoMaxAge, nil)
+
+	data, err := json.Marshal(myCPInfo)
+	if err != nil {
+		return fmt.Errorf("Marshal fail=>%w", err)
+	}
+	err = util.WriteFileAtomic(myCPInfoFilePath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("WriteFileAtomic fail=>%w", err)
+	}
+	return nil
+}
+
+// PruneMyCPInfo 删除早于 maxAge 之前的上次 mycp 时间, keep 为 nil 或者对这个源路径返回 false 时才删除.
+// maxAge 为 0 时删除所有 keep 不保留的项. 之后仍然超过 MyCPInfoMaxEntries 项时删除最旧的. 返回删除的个数.
+func PruneMyCPInfo(myCPInfo *mycpproto.MyCPInfo, maxAge time.Duration, keep func(hostSrcPath string) bool) (pruned int) {
+	deadline := time.Now().Add(-maxAge)
+	for hostSrcPath, lastMyCPTime := range myCPInfo.Path2LastMyCPTime {
+		if (maxAge == 0 || lastMyCPTime.Before(deadline)) && (keep == nil || !keep(hostSrcPath)) {
+			myCPInfo.DeleteLastMyCPTime(hostSrcPath)
+			pruned++
+		}
+	}
+
+	if len(myCPInfo.Path2LastMyCPTime) > MyCPInfoMaxEntries {
+		hostSrcPaths := SortedHostSrcPaths(myCPInfo)
+		for _, hostSrcPath := range hostSrcPaths[MyCPInfoMaxEntries:] {
+			myCPInfo.DeleteLastMyCPTime(hostSrcPath)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// SortedHostSrcPaths 返回所有记录了上次 mycp 时间的源路径, 最近拷贝过的在前
+func SortedHostSrcPaths(myCPInfo *mycpproto.MyCPInfo) (hostSrcPaths []string) {
+	for hostSrcPath := range myCPInfo.Path2LastMyCPTime {
+		hostSrcPaths = append(hostSrcPaths, hostSrcPath)
+	}
+	sort.Slice(hostSrcPaths, func(i, j int) bool {
+		ti, tj := myCPInfo.Path2LastMyCPTime[hostSrcPaths[i]], myCPInfo.Path2LastMyCPTime[hostSrcPaths[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return hostSrcPaths[i] < hostSrcPaths[j]
+	})
+	return hostSrcPaths
+}
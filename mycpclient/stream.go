@@ -0,0 +1,285 @@
+package mycpclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/util"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PutStream 把 r 的内容读到 EOF 为止并按顺序分段上传. tar 为 false 时写入远端文件 dstPath,
+// 为 true 时 r 是 tar 格式, 解压到远端路径 dstPath 下. 远端文件在全部上传完后才出现.
+// 请求不会在重连后重发, 连接断开时返回错误.
+func (client *Client) PutStream(ctx context.Context, r io.Reader, dstPath string, tar bool) (err error) {
+	_, _, err = client.putStream(ctx, r, dstPath, tar)
+	return err
+}
+
+// PutStreamWithOptions 与 PutStream 相同, 并通过 opts.OnFile 报告写入的文件, 其中的 Src 为 "-" 表示 r
+func (client *Client) PutStreamWithOptions(ctx context.Context, r io.Reader, dstPath string, tar bool, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	rsp, n, err := client.putStream(ctx, r, dstPath, tar)
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return opts.fileFailed("-", dstPath, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !tar {
+		opts.fileWritten("-", dstPath, n, rsp.Overwritten)
+		return nil
+	}
+	for _, myFileInfo := range rsp.MyFileInfoSlice {
+		opts.fileWritten("-", myFileInfo.Name, myFileInfo.Size, myFileInfo.Overwritten)
+	}
+	return nil
+}
+
+// streamKeepaliveInterval 内没有读到下一段时发送空的一段, 避免服务端认为流空闲太久而放弃它
+const streamKeepaliveInterval = 20 * time.Second
+
+// putStream 实现 PutStream, 返回最终响应和上传的字节数
+func (client *Client) putStream(ctx context.Context, r io.Reader, dstPath string, tar bool) (rsp *mycpproto.MyCPPackage, n int64, err error) {
+	var idBytes = make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rand.Read fail=>%w", err)
+	}
+	streamID := hex.EncodeToString(idBytes)
+
+	// 在另一个 goroutine 中读 r, 这样读阻塞时 (比如 stdin) ctx 被取消也能返回, 同时可以预读下一段
+	type chunk struct {
+		data  []byte
+		final bool
+		err   error
+	}
+	chunkCh := make(chan chunk, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		for {
+			var buf = make([]byte, mycpproto.StreamChunkSize)
+			n, err := io.ReadFull(r, buf)
+			var c = chunk{data: buf[:n]}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				c.final = true
+			} else if err != nil {
+				c.err = fmt.Errorf("read fail=>%w", err)
+			}
+			select {
+			case chunkCh <- c:
+			case <-stopCh:
+				return
+			}
+			if c.final || c.err != nil {
+				return
+			}
+		}
+	}()
+
+	var offset int64
+	var started = false
+	defer func() {
+		if err != nil && started {
+			client.abortStream(streamID, dstPath)
+		}
+	}()
+	keepalive := time.NewTimer(streamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		var c chunk
+		select {
+		case c = <-chunkCh:
+		case <-ctx.Done():
+			return nil, offset, ctx.Err()
+		case <-keepalive.C:
+			if !started {
+				keepalive.Reset(streamKeepaliveInterval)
+				continue
+			}
+			c.data = []byte{}
+		}
+		if c.err != nil {
+			return nil, offset, c.err
+		}
+		var myCPPackage = &mycpproto.MyCPPackage{
+			Op:       mycpproto.MyCPOpStreamPut,
+			DstPath:  dstPath,
+			StreamID: streamID,
+			Offset:   offset,
+			Data:     c.data,
+			Final:    c.final,
+			Tar:      tar,
+		}
+		started = true
+		rsp, err = client.fileOp(ctx, myCPPackage, false)
+		if err != nil {
+			return nil, offset, err
+		}
+		offset += int64(len(c.data))
+		if !keepalive.Stop() {
+			select {
+			case <-keepalive.C:
+			default:
+			}
+		}
+		keepalive.Reset(streamKeepaliveInterval)
+		if c.final {
+			return rsp, offset, nil
+		}
+	}
+}
+
+// abortStream 尽量让服务端放弃上传了一部分的流 streamID, 不等连接断开或者流空闲超时
+func (client *Client) abortStream(streamID, dstPath string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.fileOp(ctx, &mycpproto.MyCPPackage{
+		Op:       mycpproto.MyCPOpStreamPut,
+		DstPath:  dstPath,
+		StreamID: streamID,
+		Abort:    true,
+	}, false)
+	if err != nil {
+		mycplog.Debugf("abort stream %s fail=>%v", streamID, err)
+	}
+}
+
+// GetStream 把远端文件 srcPath 的内容写入 w, tar 为 true 时写入的是 srcPath (文件或路径) 的 tar.
+// 只有 tar 为 true 时 opts 才有意义. w 写失败时放弃请求并返回错误.
+func (client *Client) GetStream(ctx context.Context, srcPath string, w io.Writer, tar bool, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var myCPPackage = &mycpproto.MyCPPackage{
+		Op:           mycpproto.MyCPOpStreamGet,
+		SrcPath:      srcPath,
+		Tar:          tar,
+		OnlyModified: opts.OnlyModified,
+		LastMyCPTime: opts.LastMyCPTime,
+		SrcClock:     opts.SrcClock,
+		Exclude:      opts.Exclude,
+	}
+	rsp, err := client.roundTripStream(ctx, myCPPackage, false, func(partial *mycpproto.MyCPPackage) (err error) {
+		if len(partial.Data) == 0 {
+			// 心跳
+			return nil
+		}
+		_, err = w.Write(partial.Data)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("write fail=>%w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return remoteError(rsp)
+	}
+	return nil
+}
+
+// MyCPTarFromLocalToRemote 把本地的 srcPath 以一个 tar 流的形式拷贝到远端路径 dstDir 下,
+// 结果与 MyCPFromLocalToRemote 拷贝路径相同, 但不需要每个文件一个请求.
+// 整个 tar 作为一项报告失败; 成功时按服务端返回的列表报告写入的每个文件, 不报告跳过的文件.
+func (client *Client) MyCPTarFromLocalToRemote(ctx context.Context, srcPath, dstDir string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	pr, pw := io.Pipe()
+	// tar 中文件的顺序与服务端解压出的文件的顺序相同
+	var srcFiles []string
+	tarErrCh := make(chan error, 1)
+	go func() {
+		err := util.WriteTar(pw, srcPath, modifiedAfter(opts), opts.Exclude, func(entry *util.TarEntry) {
+			if !entry.IsDir {
+				srcFiles = append(srcFiles, entry.Path)
+			}
+		})
+		_ = pw.CloseWithError(err)
+		tarErrCh <- err
+	}()
+	rsp, _, err := client.putStream(ctx, pr, dstDir, true)
+	_ = pr.CloseWithError(err)
+	tarErr := <-tarErrCh
+	var remoteErr *RemoteError
+	if tarErr != nil && (err == nil || errors.Is(err, tarErr)) {
+		// 读本地文件失败, 而不是上传失败导致 WriteTar 失败
+		return opts.fileFailed(srcPath, dstDir, fmt.Errorf("WriteTar fail=>%w", tarErr))
+	}
+	if errors.As(err, &remoteErr) {
+		return opts.fileFailed(srcPath, dstDir, err)
+	}
+	if err != nil {
+		return err
+	}
+	for idx, myFileInfo := range rsp.MyFileInfoSlice {
+		var src string
+		if idx < len(srcFiles) {
+			src = srcFiles[idx]
+		}
+		opts.fileWritten(src, myFileInfo.Name, myFileInfo.Size, myFileInfo.Overwritten)
+	}
+	return nil
+}
+
+// MyCPTarFromRemoteToLocal 把远端的 srcPath 以一个 tar 流的形式拷贝到本地路径 dstDir 下
+// 整个 tar 作为一项报告失败; 每解压出一个文件报告一次, 不报告跳过的文件.
+func (client *Client) MyCPTarFromRemoteToLocal(ctx context.Context, srcPath, dstDir string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	// tar 中的路径以 srcPath 的最后一级开头, 解压到 dstDir 下
+	srcRoot := path.Dir(strings.TrimRight(srcPath, "/"))
+	pr, pw := io.Pipe()
+	extractErrCh := make(chan error, 1)
+	go func() {
+		err := util.ExtractTar(pr, dstDir, func(entry *util.TarEntry) {
+			if entry.IsDir {
+				return
+			}
+			var src string
+			if rel, err := filepath.Rel(dstDir, entry.Path); err == nil {
+				src = path.Join(srcRoot, filepath.ToSlash(rel))
+			}
+			opts.fileWritten(src, entry.Path, entry.Size, entry.Existed)
+		})
+		_ = pr.CloseWithError(err)
+		extractErrCh <- err
+	}()
+	err = client.GetStream(ctx, srcPath, pw, true, opts)
+	_ = pw.CloseWithError(err)
+	extractErr := <-extractErrCh
+	var remoteErr *RemoteError
+	if extractErr != nil && (err == nil || !errors.Is(extractErr, err)) {
+		// 写本地文件失败, 而不是下载失败导致 ExtractTar 失败
+		return opts.fileFailed(srcPath, dstDir, fmt.Errorf("ExtractTar fail=>%w", extractErr))
+	}
+	if errors.As(err, &remoteErr) {
+		return opts.fileFailed(srcPath, dstDir, err)
+	}
+	return err
+}
+
+func modifiedAfter(opts *MyCPOptions) time.Time {
+	if opts == nil || !opts.OnlyModified {
+		return time.Time{}
+	}
+	return mycpproto.ModifiedAfter(opts.LastMyCPTime)
+}
@@ -0,0 +1,176 @@
+package mycpclient
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/util"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrManifestUnsupported 表示服务端是不支持 mycpproto.MyCPOpManifest 的旧版本
+var ErrManifestUnsupported = errors.New("server does not support manifests")
+
+// Manifest 返回服务端以 root 为根的树的清单, Name 是相对于 root 的以 '/' 分隔的路径, 带有 Size, ModTime 和 SHA256.
+// root 还没有同步过时返回空的清单, 之后服务端开始为它保存清单.
+func (client *Client) Manifest(ctx context.Context, root string) (infos []mycpproto.MyFileInfo, err error) {
+	rsp, err := client.roundTripStream(ctx, &mycpproto.MyCPPackage{
+		Op:      mycpproto.MyCPOpManifest,
+		DstPath: root,
+	}, true, func(partial *mycpproto.MyCPPackage) error {
+		infos = append(infos, partial.MyFileInfoSlice...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return nil, remoteError(rsp)
+	}
+	if rsp.SrcIsDir {
+		// 旧的服务端把不认识的 Op 当成拷贝, 列出了空的 SrcPath 所在的路径
+		return nil, ErrManifestUnsupported
+	}
+	return infos, nil
+}
+
+// MyCPSyncFromLocalToRemote 按服务端的清单把路径 srcPath 拷贝到远端路径 dstPath 下, 规则与 MyCPFromLocalToRemote 相同,
+// 但只发送清单中没有的, 或者大小和内容与清单不同的文件, 所以不依赖本机保存的上次 mycp 时间, 在任何机器上都是增量的.
+// 写入的文件保留本地的修改时间, 这样下次只凭大小和修改时间就能判断文件没有变; 修改时间不同时再比较 sha256.
+// 不删除远端多出来的文件. 忽略 opts 的 OnlyModified.
+// srcPath 是文件时与 MyCPFromLocalToRemote 相同; 服务端不支持或者没有开启清单时发送所有文件.
+func (client *Client) MyCPSyncFromLocalToRemote(ctx context.Context, srcPath, dstPath string, opts *MyCPOptions) (err error) {
+	if opts == nil {
+		opts = &MyCPOptions{}
+	}
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	srcPathInfo, err := os.Stat(srcPath)
+	if err != nil {
+		mycplog.Warnf("os.Stat fail=>%v", err)
+		return opts.fileFailed(srcPath, dstPath, fmt.Errorf("os.Stat fail=>%w", err))
+	}
+	if !srcPathInfo.IsDir() {
+		return client.putFile(ctx, srcPath, dstPath, srcPathInfo.ModTime(), opts)
+	}
+
+	srcPathTrimmed := strings.TrimSuffix(srcPath, "/")
+	for len(srcPathTrimmed) >= 2 && strings.HasSuffix(srcPathTrimmed, "/") {
+		srcPathTrimmed = strings.TrimSuffix(srcPathTrimmed, "/")
+	}
+	_, srcPathLast := filepath.Split(srcPathTrimmed)
+	root := fmt.Sprintf("%s/%s", strings.TrimSuffix(dstPath, "/"), srcPathLast)
+
+	infos, err := client.Manifest(ctx, root)
+	if err != nil {
+		var remoteErr *RemoteError
+		if !errors.Is(err, ErrManifestUnsupported) && !errors.As(err, &remoteErr) {
+			return err
+		}
+		mycplog.Warnf("no manifest of %s, send all files=>%v", root, err)
+	}
+	manifest := make(map[string]*mycpproto.MyFileInfo, len(infos))
+	// 清单中有文件的路径一定已经存在, 不需要创建
+	existingDirs := make(map[string]bool)
+	for idx := range infos {
+		manifest[infos[idx].Name] = &infos[idx]
+		for dir := path.Dir(infos[idx].Name); !existingDirs[dir]; dir = path.Dir(dir) {
+			existingDirs[dir] = true
+			if dir == "." {
+				break
+			}
+		}
+	}
+	mycplog.Debugf("manifest of %s=>%d files", root, len(manifest))
+
+	// 一项失败时继续拷贝其他项
+	var failed, total int
+	err = filepath.Walk(srcPathTrimmed, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			total++
+			failed++
+			_ = opts.fileFailed(filePath, root, err)
+			return nil
+		}
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcPathTrimmed, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && util.Excluded(info.Name(), opts.Exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dst := path.Join(root, rel)
+		if info.IsDir() {
+			if existingDirs[rel] {
+				return nil
+			}
+			err = client.Mkdir(ctx, dst, true)
+			var remoteErr *RemoteError
+			if errors.As(err, &remoteErr) {
+				total++
+				failed++
+				_ = opts.fileFailed(filePath, dst, err)
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			mycplog.Debugf("skip non-regular file=>%s", filePath)
+			return nil
+		}
+		total++
+		if sameAsManifest(filePath, info, manifest[rel]) {
+			opts.report(&FileEvent{Action: FileSkipped, Src: filePath, Dst: dst})
+			return nil
+		}
+		err = client.putFile(ctx, filePath, path.Dir(dst)+"/", info.ModTime(), opts)
+		var fileErr *FileError
+		if errors.As(err, &fileErr) {
+			failed++
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		mycplog.Warnf("MyCPSyncFromLocalToRemote fail=>%v", err)
+		return err
+	}
+	return entriesFailed(srcPath, failed, total)
+}
+
+// sameAsManifest 判断本地文件与清单中的 entry 是否相同: 大小相同, 并且修改时间相同或者内容的 sha256 相同
+func sameAsManifest(filePath string, info os.FileInfo, entry *mycpproto.MyFileInfo) bool {
+	if entry == nil || entry.Size != info.Size() {
+		return false
+	}
+	if entry.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	hr := util.NewHashReader(file)
+	_, err = io.Copy(ioutil.Discard, hr)
+	return err == nil && hex.EncodeToString(hr.Sum()) == entry.SHA256
+}
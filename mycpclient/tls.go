@@ -0,0 +1,47 @@
+package mycpclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// tlsHandshake 在 conn 上做 TLS 握手. 不校验证书链和域名, 只接受 sha256 (hex) 等于 pin 的证书,
+// 这样服务端可以使用自签名的证书.
+func tlsHandshake(ctx context.Context, conn net.Conn, pin string) (_ net.Conn, err error) {
+	pin = strings.ToLower(strings.TrimSpace(pin))
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate from server")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			got := hex.EncodeToString(sum[:])
+			if got != pin {
+				return fmt.Errorf("certificate sha256 %s does not match the pin", got)
+			}
+			return nil
+		},
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake fail=>%w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,224 @@
+package mycpclient
+
+import (
+	"context"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type WatchOptions struct {
+	MyCPOptions                 // 初次同步使用
+	Interval    time.Duration   // 轮询间隔, 默认 1s
+	OnSynced    func(time.Time) // 每次同步成功后调用, 参数是这次同步开始前扫描本地路径的时间
+}
+
+// fileState 是一次扫描中一个文件或路径的状态, 修改时间或大小变化则认为需要重新上传
+type fileState struct {
+	ModTime time.Time
+	Size    int64
+	IsDir   bool
+}
+
+// Watch 先把本地路径 srcDir 同步到远端路径 dstDir 下 (与 MyCPFromLocalToRemote 规则相同, 得到 dstDir/srcDir 的最后一级),
+// 之后每隔 opts.Interval 扫描一次 srcDir, 只上传新增和修改的文件, 并删除远端对应的已删除的文件.
+// 一直运行到 ctx 被取消. 单次同步失败只记录日志, 下一轮会重试.
+func (client *Client) Watch(ctx context.Context, srcDir, dstDir string, opts *WatchOptions) (err error) {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 1 * time.Second
+	}
+	srcDirInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return fmt.Errorf("os.Stat fail=>%w", err)
+	}
+	if !srcDirInfo.IsDir() {
+		return fmt.Errorf("fail=>src of watch must be a dir")
+	}
+
+	srcPathTrimmed := strings.TrimSuffix(srcDir, "/")
+	for len(srcPathTrimmed) >= 2 && strings.HasSuffix(srcPathTrimmed, "/") {
+		srcPathTrimmed = strings.TrimSuffix(srcPathTrimmed, "/")
+	}
+	_, srcPathLast := filepath.Split(srcPathTrimmed)
+	remoteRoot := fmt.Sprintf("%s/%s", dstDir, srcPathLast)
+
+	// 先扫描再同步, 同步期间的修改会在下一轮被发现
+	scanTime := time.Now()
+	synced, err := scanDir(srcDir, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	mycplog.Infof("initial sync start")
+	err = client.MyCPFromLocalToRemote(ctx, srcDir, dstDir, &opts.MyCPOptions)
+	if err != nil {
+		return fmt.Errorf("initial sync fail=>%w", err)
+	}
+	mycplog.Infof("initial sync done, watching %s", srcDir)
+	if opts.OnSynced != nil {
+		opts.OnSynced(scanTime)
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		scanTime = time.Now()
+		current, err := scanDir(srcDir, opts.Exclude)
+		if err != nil {
+			mycplog.Warnf("scanDir fail=>%v", err)
+			continue
+		}
+		changedCnt, failedCnt := client.syncChanges(ctx, srcDir, remoteRoot, synced, current)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if changedCnt > 0 {
+			mycplog.Infof("synced %d changes, %d failed", changedCnt-failedCnt, failedCnt)
+			if failedCnt == 0 && opts.OnSynced != nil {
+				opts.OnSynced(scanTime)
+			}
+		}
+	}
+}
+
+// syncChanges 把 current 相对 synced 的变化同步到远端, 成功的变化会更新到 synced 中
+func (client *Client) syncChanges(ctx context.Context, srcDir, remoteRoot string, synced, current map[string]fileState) (changedCnt, failedCnt int) {
+	// 删除: 只删最上层被删除的路径
+	var removed []string
+	for rel := range synced {
+		if _, ok := current[rel]; !ok {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(removed)
+	var lastRemovedDir string
+	for _, rel := range removed {
+		if lastRemovedDir != "" && strings.HasPrefix(rel, lastRemovedDir+"/") {
+			delete(synced, rel)
+			continue
+		}
+		changedCnt++
+		remotePath := fmt.Sprintf("%s/%s", remoteRoot, rel)
+		mycplog.Infof("be to remove=>%s", remotePath)
+		err := client.Remove(ctx, remotePath, true)
+		if err != nil {
+			mycplog.Warnf("Remove fail=>%v", err)
+			failedCnt++
+			continue
+		}
+		if synced[rel].IsDir {
+			lastRemovedDir = rel
+		}
+		delete(synced, rel)
+	}
+
+	// 新增和修改: 按路径排序, 保证父路径先于子路径创建
+	var changed []string
+	for rel, state := range current {
+		old, ok := synced[rel]
+		if !ok || old.IsDir != state.IsDir || (!state.IsDir && (!old.ModTime.Equal(state.ModTime) || old.Size != state.Size)) {
+			changed = append(changed, rel)
+		}
+	}
+	sort.Strings(changed)
+	for _, rel := range changed {
+		changedCnt++
+		state := current[rel]
+		localPath := fmt.Sprintf("%s/%s", srcDir, rel)
+		remotePath := fmt.Sprintf("%s/%s", remoteRoot, rel)
+		var err error
+		if old, ok := synced[rel]; ok && old.IsDir != state.IsDir {
+			// 文件变成路径或者路径变成文件, 先删掉远端的
+			err = client.Remove(ctx, remotePath, true)
+			if err != nil {
+				mycplog.Warnf("Remove fail=>%v", err)
+				failedCnt++
+				continue
+			}
+		}
+		if state.IsDir {
+			// 只创建路径本身, 里面的文件在 changed 中各自上传
+			remoteParent, _ := filepath.Split(remotePath)
+			err = client.mkdirLike(ctx, localPath, remoteParent)
+		} else {
+			mycplog.Infof("be to upload=>%s", remotePath)
+			err = client.MyCPFromLocalToRemote(ctx, localPath, remotePath, nil)
+		}
+		if err != nil {
+			mycplog.Warnf("sync %s fail=>%v", rel, err)
+			failedCnt++
+			continue
+		}
+		synced[rel] = state
+	}
+	return
+}
+
+// mkdirLike 在远端 remoteParent 下创建与本地路径 localDir 同名的路径, 不拷贝其中的内容
+func (client *Client) mkdirLike(ctx context.Context, localDir, remoteParent string) (err error) {
+	var myCPPackage = &mycpproto.MyCPPackage{
+		SrcPath:   localDir,
+		DstPath:   remoteParent,
+		Direction: mycpproto.DirectionRemoteIsDst,
+		SrcIsDir:  true,
+	}
+	rsp, err := client.roundTrip(ctx, myCPPackage, true)
+	if err != nil {
+		return err
+	}
+	if rsp.Status != mycpproto.MyCPPackageStatusSucc {
+		return fmt.Errorf("remote execution fail")
+	}
+	return nil
+}
+
+// scanDir 返回 dir 下所有文件和路径的状态, key 是以 / 分隔的相对路径. 跳过名字与 exclude 匹配的文件和路径
+func scanDir(dir string, exclude []string) (states map[string]fileState, err error) {
+	states = make(map[string]fileState)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 扫描期间被删除
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if util.Excluded(info.Name(), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		states[filepath.ToSlash(rel)] = fileState{
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+			IsDir:   info.IsDir(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Walk fail=>%w", err)
+	}
+	return states, nil
+}
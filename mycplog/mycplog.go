@@ -0,0 +1,268 @@
+// Package mycplog 是 mycp 和 mycpserver 使用的分级日志.
+// 每行可以带有 key=value 形式的字段, 比如连接的 conn 和请求的 seq, 这样可以在客户端和服务端的日志中找到同一个请求.
+// 默认输出的格式与标准库 log 的 LstdFlags|Lshortfile|Lmicroseconds 相同, 只是多了级别和字段; 也可以输出 json, 每行一个对象.
+package mycplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota // 每个请求的细节, 比如每个文件的读写
+	LevelInfo               // 连接的建立和关闭, 拷贝的开始和结束等
+	LevelWarn               // 请求失败等不影响进程继续运行的错误
+	LevelError              // 需要关注的错误
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (level Level) String() string {
+	if level < 0 || int(level) >= len(levelNames) {
+		return fmt.Sprintf("LEVEL(%d)", int32(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel 解析 debug, info, warn, error, 不区分大小写
+func ParseLevel(s string) (level Level, err error) {
+	for idx, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(idx), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, want one of debug, info, warn, error", s)
+}
+
+var (
+	level   = int32(LevelInfo)
+	jsonFmt uint32
+
+	outputMutex sync.Mutex
+	output      io.Writer = os.Stderr
+)
+
+// SetLevel 设置输出的最低级别, 默认是 LevelInfo
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Enabled 返回 l 级别的日志是否会输出, 用于避免准备很贵的日志内容
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// SetJSON 设置是否以 json 输出, 每行一个对象, 包含 time, level, caller, msg 以及所有字段
+func SetJSON(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&jsonFmt, v)
+}
+
+// SetFormat 设置输出格式, format 是 text 或者 json
+func SetFormat(format string) (err error) {
+	switch format {
+	case "text", "":
+		SetJSON(false)
+	case "json":
+		SetJSON(true)
+	default:
+		return fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+	return nil
+}
+
+// SetOutput 设置输出, 同时设置标准库 log 的输出, 这样其他包 (比如 net/http) 的日志也写到同一个地方
+func SetOutput(w io.Writer) {
+	outputMutex.Lock()
+	output = w
+	outputMutex.Unlock()
+	log.SetOutput(w)
+}
+
+// Logger 带有一组字段, 它输出的每一行都带有这些字段. nil 等价于没有字段的 Logger
+type Logger struct {
+	fields []interface{} // key1, value1, key2, value2, ...
+}
+
+// With 返回带有 kv (key1, value1, key2, value2, ...) 字段的 Logger
+func With(kv ...interface{}) *Logger {
+	return (*Logger)(nil).With(kv...)
+}
+
+// With 返回在 logger 的字段后面加上 kv 的 Logger, logger 本身不变
+func (logger *Logger) With(kv ...interface{}) *Logger {
+	var fields []interface{}
+	if logger != nil {
+		fields = make([]interface{}, 0, len(logger.fields)+len(kv))
+		fields = append(fields, logger.fields...)
+	}
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.output(LevelDebug, format, args...)
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.output(LevelInfo, format, args...)
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.output(LevelWarn, format, args...)
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.output(LevelError, format, args...)
+}
+
+// Fatalf 不论级别都输出, 然后退出进程
+func (logger *Logger) Fatalf(format string, args ...interface{}) {
+	logger.write(2, LevelError, format, args...)
+	exit(format, args...)
+}
+
+func Debugf(format string, args ...interface{}) {
+	(*Logger)(nil).output(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	(*Logger)(nil).output(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	(*Logger)(nil).output(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	(*Logger)(nil).output(LevelError, format, args...)
+}
+
+func Fatalf(format string, args ...interface{}) {
+	(*Logger)(nil).write(2, LevelError, format, args...)
+	exit(format, args...)
+}
+
+var fatalHook atomic.Value // func(msg string)
+
+// SetFatalHook 设置 Fatalf 在退出进程之前调用的 fn, 参数是日志的内容. 用于程序在退出前输出自己的结果
+func SetFatalHook(fn func(msg string)) {
+	fatalHook.Store(fn)
+}
+
+func exit(format string, args ...interface{}) {
+	if fn, _ := fatalHook.Load().(func(msg string)); fn != nil {
+		fn(fmt.Sprintf(format, args...))
+	}
+	os.Exit(1)
+}
+
+func (logger *Logger) output(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	logger.write(3, l, format, args...)
+}
+
+// write 输出一行, skip 是从 write 到调用 Infof 等方法的代码的栈深度
+func (logger *Logger) write(skip int, l Level, format string, args ...interface{}) {
+	now := time.Now()
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(skip); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	msg := fmt.Sprintf(format, args...)
+	var fields []interface{}
+	if logger != nil {
+		fields = logger.fields
+	}
+
+	var buf []byte
+	if atomic.LoadUint32(&jsonFmt) == 1 {
+		buf = formatJSON(now, l, caller, msg, fields)
+	} else {
+		buf = formatText(now, l, caller, msg, fields)
+	}
+	outputMutex.Lock()
+	_, _ = output.Write(buf)
+	outputMutex.Unlock()
+}
+
+func formatText(now time.Time, l Level, caller, msg string, fields []interface{}) []byte {
+	var sb strings.Builder
+	sb.WriteString(now.Format("2006/01/02 15:04:05.000000"))
+	sb.WriteByte(' ')
+	sb.WriteString(l.String())
+	sb.WriteByte(' ')
+	sb.WriteString(caller)
+	sb.WriteString(": ")
+	sb.WriteString(strings.TrimSuffix(msg, "\n"))
+	for idx := 0; idx+1 < len(fields); idx += 2 {
+		value := fmt.Sprint(fields[idx+1])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&sb, " %v=%s", fields[idx], value)
+	}
+	sb.WriteByte('\n')
+	return []byte(sb.String())
+}
+
+func formatJSON(now time.Time, l Level, caller, msg string, fields []interface{}) []byte {
+	// 用有序的 key 拼出对象, 这样 time, level, caller, msg 总在最前面
+	var sb strings.Builder
+	// 不转义 <, >, &, 日志中很多 "=>"
+	marshal := func(v interface{}) (b []byte, err error) {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		err = encoder.Encode(v)
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+	}
+	writeKV := func(key string, value interface{}) {
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		} else {
+			sb.WriteByte('{')
+		}
+		keyJSON, _ := marshal(key)
+		valueJSON, err := marshal(value)
+		if err != nil {
+			valueJSON, _ = marshal(fmt.Sprint(value))
+		}
+		sb.Write(keyJSON)
+		sb.WriteByte(':')
+		sb.Write(valueJSON)
+	}
+	writeKV("time", now.Format(time.RFC3339Nano))
+	writeKV("level", strings.ToLower(l.String()))
+	writeKV("caller", caller)
+	writeKV("msg", strings.TrimSuffix(msg, "\n"))
+	for idx := 0; idx+1 < len(fields); idx += 2 {
+		writeKV(fmt.Sprint(fields[idx]), fields[idx+1])
+	}
+	sb.WriteString("}\n")
+	return []byte(sb.String())
+}
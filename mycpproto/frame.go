@@ -0,0 +1,55 @@
+package mycpproto
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 帧头共 16 字节:
+// [0, 8)  高 8 位是帧类型, 低 56 位是 body 长度
+// [8, 16) seq, 对 FrameTypeCredit 来说是授予的额度, 其他控制帧不使用
+const (
+	HeadSize = 16
+
+	frameLenMask = 1<<56 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameTypeData FrameType = iota
+	FrameTypePing
+	FrameTypePong
+	FrameTypeCredit   // 接收方授予发送方的额度, 每个额度允许发送方多发一个请求
+	FrameTypeDataMore // 中间响应, 同一个 seq 之后还有响应, 最后一个响应是 FrameTypeData
+)
+
+func PutHead(head []byte, frameType FrameType, bodyLen int, seq uint64) {
+	binary.BigEndian.PutUint64(head[0:], uint64(frameType)<<56|uint64(bodyLen)&frameLenMask)
+	binary.BigEndian.PutUint64(head[8:], seq)
+}
+
+func ParseHead(head []byte) (frameType FrameType, bodyLen uint64, seq uint64) {
+	first := binary.BigEndian.Uint64(head[0:])
+	frameType = FrameType(first >> 56)
+	bodyLen = first & frameLenMask
+	seq = binary.BigEndian.Uint64(head[8:])
+	return
+}
+
+// CheckHead 在读 body 之前校验帧头, 避免按照恶意的长度分配内存
+func CheckHead(frameType FrameType, bodyLen uint64, maxBodyLen uint64) (err error) {
+	switch frameType {
+	case FrameTypeData, FrameTypeDataMore:
+		if bodyLen > maxBodyLen {
+			return fmt.Errorf("frame too large. bodyLen=>%d, max=>%d", bodyLen, maxBodyLen)
+		}
+	case FrameTypePing, FrameTypePong, FrameTypeCredit:
+		if bodyLen != 0 {
+			return fmt.Errorf("control frame with body. frameType=>%d, bodyLen=>%d", frameType, bodyLen)
+		}
+	default:
+		return fmt.Errorf("unknown frame type=>%d", frameType)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build go1.18
+// +build go1.18
+
+package mycpproto
+
+import (
+	"testing"
+)
+
+func FuzzCheckHead(f *testing.F) {
+	f.Add(make([]byte, HeadSize))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x03, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, head []byte) {
+		if len(head) < HeadSize {
+			return
+		}
+		checkArbitraryHead(t, head[:HeadSize], 1<<20)
+	})
+}
@@ -0,0 +1,81 @@
+package mycpproto
+
+import (
+	"testing"
+)
+
+func TestHeadRoundTrip(t *testing.T) {
+	cases := []struct {
+		frameType FrameType
+		bodyLen   int
+		seq       uint64
+	}{
+		{FrameTypeData, 0, 0},
+		{FrameTypeData, 12345, 1},
+		{FrameTypeDataMore, 1 << 20, 1<<64 - 1},
+		{FrameTypePing, 0, 0},
+		{FrameTypeCredit, 0, 256},
+		{FrameTypeData, frameLenMask, 7},
+	}
+	head := make([]byte, HeadSize)
+	for _, c := range cases {
+		PutHead(head, c.frameType, c.bodyLen, c.seq)
+		frameType, bodyLen, seq := ParseHead(head)
+		if frameType != c.frameType || bodyLen != uint64(c.bodyLen) || seq != c.seq {
+			t.Errorf("ParseHead(PutHead(%d, %d, %d))=>%d, %d, %d", c.frameType, c.bodyLen, c.seq, frameType, bodyLen, seq)
+		}
+	}
+}
+
+func TestCheckHead(t *testing.T) {
+	const max = 1 << 20
+	cases := []struct {
+		name      string
+		frameType FrameType
+		bodyLen   uint64
+		ok        bool
+	}{
+		{"empty data", FrameTypeData, 0, true},
+		{"max data", FrameTypeData, max, true},
+		{"data over max", FrameTypeData, max + 1, false},
+		{"data more over max", FrameTypeDataMore, max + 1, false},
+		{"largest length in head", FrameTypeData, frameLenMask, false},
+		{"ping", FrameTypePing, 0, true},
+		{"ping with body", FrameTypePing, 1, false},
+		{"pong with body", FrameTypePong, 16, false},
+		{"credit with body", FrameTypeCredit, 1, false},
+		{"unknown type", FrameTypeDataMore + 1, 0, false},
+		{"largest type", 0xff, 0, false},
+	}
+	for _, c := range cases {
+		err := CheckHead(c.frameType, c.bodyLen, max)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: CheckHead(%d, %d)=>%v", c.name, c.frameType, c.bodyLen, err)
+		}
+	}
+}
+
+// 任意 16 字节的帧头都能解析, 通过 CheckHead 的帧头不会要求分配超过上限的内存
+func TestCheckHeadArbitraryHeads(t *testing.T) {
+	const max = 1 << 20
+	heads := [][]byte{
+		make([]byte, HeadSize),
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0x04, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0x03, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	for _, head := range heads {
+		checkArbitraryHead(t, head, max)
+	}
+}
+
+func checkArbitraryHead(t *testing.T, head []byte, max uint64) {
+	frameType, bodyLen, _ := ParseHead(head)
+	if bodyLen > frameLenMask {
+		t.Fatalf("ParseHead(%x) bodyLen=>%d over 56 bits", head, bodyLen)
+	}
+	if CheckHead(frameType, bodyLen, max) == nil && bodyLen > max {
+		t.Fatalf("CheckHead(%x) accepted bodyLen=>%d over max=>%d", head, bodyLen, max)
+	}
+}
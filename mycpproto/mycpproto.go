@@ -1,6 +1,11 @@
 package mycpproto
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
 
 type MyCPPackageStatus int64
 
@@ -8,6 +13,8 @@ const (
 	MyCPPackageStatusFail MyCPPackageStatus = iota
 	MyCPPackageStatusSucc
 	MyCPPackageStatusNoNeedToCP
+	MyCPPackageStatusShuttingDown // 服务端正在关闭, 没有处理这个请求
+	MyCPPackageStatusNeedData     // 服务端没有 BlobSHA256 对应的内容, 需要重新发送带有文件内容的请求
 )
 
 type MyCPPackage struct {
@@ -19,20 +26,162 @@ type MyCPPackage struct {
 	MyFileInfoSlice []MyFileInfo
 	LastMyCPTime    time.Time
 	OnlyModified    bool
+	SrcClock        bool `json:",omitempty"` // LastMyCPTime 是服务端的时钟, 见 SrcLastMyCPTime
 	Password        string
 	Direction       DirectionT
+	Op              MyCPOpT
+	ErrMsg          string   // Status 为 MyCPPackageStatusFail 时的原因, 可能为空
+	ErrCode         string   `json:",omitempty"` // Status 为 MyCPPackageStatusFail 时原因的分类, 见 ErrorCode, 可能为空
+	Exclude         []string // 跳过名字与其中之一按 path.Match 匹配的文件和路径, 用于 MyCPOpPush 和 tar 的 MyCPOpStreamGet
+	Overwritten     bool     `json:",omitempty"` // 写文件的响应: 文件在写之前已经存在. 写文件成功的响应的 DstPath 是实际写入的文件
+
+	// MyCPOpExec 使用. 请求: ExecArgs 在 DstPath 下执行;
+	// 中间响应: Data 是 ExecStream 上的一段输出; 最终响应: ExitCode
+	ExecArgs   []string
+	ExecStream ExecStreamT
+	ExitCode   int
+
+	Recursive bool // MyCPOpRemove: 是否删除整个路径; MyCPOpMkdir: 是否同时创建不存在的上级路径
+
+	// MyCPOpAuth 的请求: 服务端在 HelloResponse 中给了 Nonce 时是密钥 K, 服务端校验它的 sha256. 响应中没有
+	AuthProof []byte `json:",omitempty"`
+
+	// 写文件的请求: 不为零值时把写入的文件的修改时间设为它, 这样按清单同步时能用大小和修改时间判断文件是否相同
+	SrcModTime time.Time `json:",omitempty"`
+	// 写文件的请求: 不带 Data, 让服务端用去重缓存中 sha256 (hex) 为它的内容写文件, 没有时响应 MyCPPackageStatusNeedData.
+	// 只发给在 HelloResponse 中报告了 BlobMinSize 的服务端
+	BlobSHA256 string `json:",omitempty"`
+	Deduped    bool   `json:",omitempty"` // 写文件的响应: 内容来自去重缓存
+
+	// MyCPOpPush 使用. 服务端以 PushUser 和 PushPassword 认证连接到 PushHost, 把本地的 SrcPath 拷贝到 PushHost 的 DstPath
+	PushHost     string
+	PushUser     string
+	PushPassword string
+	PushTLSPin   string // 不为空时用 TLS 连接 PushHost, 只接受 sha256 为它的证书
+
+	// MyCPOpStreamPut 和 MyCPOpStreamGet 使用. Tar 为 true 时传输的是 tar 格式的路径, 否则是单个文件的内容.
+	// StreamPut 的请求按顺序发送 StreamID 这个流在 Offset 处的 Data, Final 表示最后一个请求.
+	// Tar 的 StreamPut 的最终响应在 MyFileInfoSlice 中列出解压出的每个文件, Name 是完整的路径
+	StreamID string
+	Offset   int64
+	Final    bool
+	Tar      bool
+	// StreamPut 使用: 客户端放弃这个流, 服务端删除写了一半的临时文件
+	Abort bool `json:",omitempty"`
 }
 
+// MyFileInfo 是路径下的一项. 拷贝时只用到 Name 和 IsDir, MyCPOpList 和 MyCPOpStat 会填写全部字段
 type MyFileInfo struct {
-	Name  string
-	IsDir bool
+	Name    string
+	IsDir   bool
+	Size    int64 `json:",omitempty"`
+	ModTime time.Time
+	Mode    os.FileMode `json:",omitempty"`
+	// 只用于 tar 的 StreamPut 的最终响应: 文件在解压之前已经存在
+	Overwritten bool `json:",omitempty"`
+	// 只用于 MyCPOpManifest: 文件内容的 sha256, hex
+	SHA256 string `json:",omitempty"`
+}
+
+// Hello 是建连后认证前以明文 json 发送的第一个请求, 用于取得 User 的密钥参数.
+// User 为空时使用服务端唯一的用户. Nonce 是客户端生成的 util.NonceLen 字节的随机数, 以前的版本不发送.
+type Hello struct {
+	User  string
+	Nonce []byte `json:",omitempty"`
+}
+
+// HelloResponse 是 Hello 的明文 json 响应. 密钥 K 是 DeriveKey(密码, Salt, Iterations),
+// Salt 为空表示服务端使用旧式的 16 字节密码, K 就是密码.
+// Nonce 不为空时之后的请求都用 util.SessionKey(util.KeyVerifier(K), Hello.Nonce, Nonce) 加密,
+// 并且第一个请求必须是 AuthProof 为 K 的 MyCPOpAuth; 为空时 (以前的版本) 直接用 K 加密.
+// ConnID 是服务端给这个连接的 ID, 客户端在日志中带上它以便与服务端的日志对应.
+// ServerTime 是服务端回复时的时钟, 客户端由它得到两端时钟的差.
+// BlobMinSize 不为 0 表示服务端开启了去重缓存, 客户端写不小于它的文件时先只发送 BlobSHA256.
+type HelloResponse struct {
+	Salt        []byte
+	Iterations  int
+	Nonce       []byte    `json:",omitempty"`
+	ConnID      uint64    `json:",omitempty"`
+	ServerTime  time.Time `json:",omitempty"`
+	BlobMinSize int64     `json:",omitempty"`
 }
 
+// MyCPInfo 是客户端持久化的状态. Path2LastMyCPTime 的键是 [@host:]path 形式的源路径.
+// 本地源路径的上次 mycp 时间是本机的时钟; 远端源路径在 SrcClockPaths 中时是它所在的服务端的时钟,
+// 否则是本机的时钟 (以前的版本保存的, 或者服务端没有报告时钟), 服务端比较时减去 TimeAdvanced.
+// 以前的版本更新文件时会丢掉 SrcClockPaths, 这样所有的时间都被当成本机的时钟, 仍然是安全的.
 type MyCPInfo struct {
 	Path2LastMyCPTime map[string]time.Time
 	LastRemoteHost    string
+	SrcClockPaths     map[string]bool `json:",omitempty"`
 }
 
+// SetLastMyCPTime 记录 hostSrcPath 的上次 mycp 时间, srcClock 表示 t 是远端源路径所在的服务端的时钟
+func (myCPInfo *MyCPInfo) SetLastMyCPTime(hostSrcPath string, t time.Time, srcClock bool) {
+	if myCPInfo.Path2LastMyCPTime == nil {
+		myCPInfo.Path2LastMyCPTime = make(map[string]time.Time)
+	}
+	myCPInfo.Path2LastMyCPTime[hostSrcPath] = t
+	if !srcClock {
+		delete(myCPInfo.SrcClockPaths, hostSrcPath)
+		return
+	}
+	if myCPInfo.SrcClockPaths == nil {
+		myCPInfo.SrcClockPaths = make(map[string]bool)
+	}
+	myCPInfo.SrcClockPaths[hostSrcPath] = true
+}
+
+// DeleteLastMyCPTime 删除 hostSrcPath 的上次 mycp 时间
+func (myCPInfo *MyCPInfo) DeleteLastMyCPTime(hostSrcPath string) {
+	delete(myCPInfo.Path2LastMyCPTime, hostSrcPath)
+	delete(myCPInfo.SrcClockPaths, hostSrcPath)
+}
+
+type MyCPOpT int
+
+const (
+	MyCPOpCP        MyCPOpT = iota // 拷贝, 方向由 Direction 决定
+	MyCPOpAuth                     // 只做认证, 建连 (包括重连) 后发送
+	MyCPOpExec                     // 在服务端执行命令, 输出以中间响应的形式流式返回
+	MyCPOpRemove                   // 删除 DstPath, 不存在也算成功
+	MyCPOpList                     // 列出路径 DstPath 下的所有项, 结果在 MyFileInfoSlice 中
+	MyCPOpStat                     // 查看 DstPath, 结果是 MyFileInfoSlice 中唯一的一项
+	MyCPOpMkdir                    // 创建路径 DstPath
+	MyCPOpRename                   // 把 SrcPath 重命名为 DstPath
+	MyCPOpPush                     // 服务端把 SrcPath 推送到另一个服务端, 期间以中间响应作为心跳
+	MyCPOpGlob                     // 展开通配符 DstPath, 匹配到的路径在 MyFileInfoSlice 的 Name 中
+	MyCPOpStreamPut                // 按顺序上传一个流的一段, 服务端写入文件 DstPath 或者解压 tar 到路径 DstPath 下
+	MyCPOpStreamGet                // 以中间响应的形式下载文件 SrcPath 的内容或者 SrcPath 的 tar
+	MyCPOpManifest                 // 取得以 DstPath 为根的树的清单, 以中间响应的形式在 MyFileInfoSlice 中返回, Name 是相对于根的路径
+)
+
+var myCPOpNames = []string{"cp", "auth", "exec", "rm", "ls", "stat", "mkdir", "mv", "push", "glob", "stream-put", "stream-get", "manifest"}
+
+func (op MyCPOpT) String() string {
+	if op < 0 || int(op) >= len(myCPOpNames) {
+		return fmt.Sprintf("op(%d)", int(op))
+	}
+	return myCPOpNames[op]
+}
+
+var myCPPackageStatusNames = []string{"fail", "succ", "no_need_to_cp", "shutting_down", "need_data"}
+
+func (status MyCPPackageStatus) String() string {
+	if status < 0 || int(status) >= len(myCPPackageStatusNames) {
+		return fmt.Sprintf("status(%d)", int64(status))
+	}
+	return myCPPackageStatusNames[status]
+}
+
+type ExecStreamT int
+
+const (
+	ExecStreamNone ExecStreamT = iota // 心跳, 没有输出
+	ExecStreamStdout
+	ExecStreamStderr
+)
+
 type DirectionT int
 
 const (
@@ -40,4 +189,51 @@ const (
 	DirectionRemoteIsDst
 )
 
-var TimeAdvanced = 5 * time.Minute // 只传输这个时间之后修改过的文件. 这个时间 = 上次 mycp 时间 - TimeAdvanced
+const StreamChunkSize = 4 * 1024 * 1024 // 流式传输时每个请求或中间响应中 Data 的最大字节数
+
+// TimeAdvanced 只用于不是源路径所在机器的时钟的上次 mycp 时间 (旧版本的客户端, 或者以前保存的时间):
+// 只传输这个时间之后修改过的文件, 这个时间 = 上次 mycp 时间 - TimeAdvanced, 用来掩盖两台机器时钟的差异
+var TimeAdvanced = 5 * time.Minute
+
+// ModTimePrecision 是文件修改时间可能的误差 (比如 FAT 的精度是 2 秒), 判断文件是否修改过时留出这么多余量
+const ModTimePrecision = 2 * time.Second
+
+// ModifiedAfter 返回只拷贝修改过的文件时的界限, 修改时间早于它的文件不需要拷贝.
+// lastMyCPTime 必须是文件所在机器的时钟.
+func ModifiedAfter(lastMyCPTime time.Time) time.Time {
+	return lastMyCPTime.Add(-ModTimePrecision)
+}
+
+// SrcLastMyCPTime 返回服务端 (源路径所在的机器) 的时钟的 LastMyCPTime.
+// SrcClock 为 false 时 LastMyCPTime 是客户端的时钟, 减去 TimeAdvanced.
+func (myCPPackage *MyCPPackage) SrcLastMyCPTime() time.Time {
+	if myCPPackage.SrcClock {
+		return myCPPackage.LastMyCPTime
+	}
+	return myCPPackage.LastMyCPTime.Add(-TimeAdvanced)
+}
+
+// ErrCode 的取值
+const (
+	ErrCodeNotFound   = "not_found"
+	ErrCodePermission = "permission_denied"
+	ErrCodeTooLarge   = "too_large"
+	ErrCodeUnknown    = "unknown"
+)
+
+// ErrTooLarge 表示文件超过了不用流式传输时一次能拷贝的大小
+var ErrTooLarge = errors.New("file too large")
+
+// ErrorCode 返回文件操作的错误 err 的分类, 供程序区分失败的原因
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		return ErrCodeTooLarge
+	case errors.Is(err, os.ErrNotExist):
+		return ErrCodeNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrCodePermission
+	default:
+		return ErrCodeUnknown
+	}
+}
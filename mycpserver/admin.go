@@ -0,0 +1,124 @@
+package mycpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/util"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminTokenFileName 是管理接口的 token 所在的文件, 位于可执行文件 mycpserver 所在路径下.
+// 每次启动管理接口时重新生成, 只有所有者可读, 这样同一台机器上的其他用户不能使用管理接口.
+var AdminTokenFileName = "mycp_admin_token.txt"
+
+// AdminTokenPath 返回 AdminTokenFileName 的路径
+func AdminTokenPath() (tokenPath string, err error) {
+	return binFilePath(AdminTokenFileName)
+}
+
+// CheckLoopback 检查 host 是不是只能从本机访问的地址, 管理接口只允许监听这样的地址
+func CheckLoopback(host string) (err error) {
+	ip, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	if ip == "localhost" {
+		return nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	return nil
+}
+
+// ListenAdmin 在本机地址 host 上提供管理接口:
+//
+//	GET  /conns          列出所有连接, 返回 []ConnInfo
+//	POST /conns/kill?id= 关闭一个连接
+//
+// 请求需要带上 "Authorization: Bearer <token>", token 在 AdminTokenPath 中. 管理接口在 Close 时关闭.
+func (server *Server) ListenAdmin(host string) (err error) {
+	err = CheckLoopback(host)
+	if err != nil {
+		return err
+	}
+	token := util.GenPassword(32)
+	tokenPath, err := AdminTokenPath()
+	if err != nil {
+		return err
+	}
+	err = util.WriteFileAtomic(tokenPath, []byte(token+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("write admin token fail=>%w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(server.Conns())
+	})
+	mux.HandleFunc("/conns/kill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		err = server.KillConn(id)
+		if err == errNoSuchConn {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	err = server.serveHTTP(host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	if err != nil {
+		return err
+	}
+	mycplog.Infof("admin listening on %s, token file=>%s", host, tokenPath)
+	return nil
+}
+
+// serveHTTP 在 host 上提供 handler, 直到 server 被 Close
+func (server *Server) serveHTTP(host string, handler http.Handler) (err error) {
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+	server.connsMutex.Lock()
+	server.httpListeners = append(server.httpListeners, listener)
+	server.connsMutex.Unlock()
+	if server.IsClosed() {
+		// Close 可能已经遍历过 httpListeners 了
+		_ = listener.Close()
+		return errors.New("server closed")
+	}
+	go func() {
+		err := http.Serve(listener, handler)
+		if !server.IsClosed() {
+			mycplog.Warnf("http Serve on %s fail=>%v", host, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,326 @@
+package mycpserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 审计日志中的 Op
+const (
+	AuditOpRead   = "read"
+	AuditOpWrite  = "write"
+	AuditOpMkdir  = "mkdir"
+	AuditOpRemove = "remove"
+	AuditOpRename = "rename"
+	AuditOpPush   = "push"
+)
+
+// AuditRecord 是审计日志中的一行
+type AuditRecord struct {
+	Time   time.Time
+	Remote string // 客户端的地址
+	User   string // 认证的用户, 使用旧式密码时为空
+	Conn   uint64 // 连接 ID, 与日志和管理接口中的相同
+	Op     string
+	Path   string
+	To     string `json:",omitempty"` // rename 的新路径, push 的目标
+	Bytes  int64
+	Result string // ok 或 fail
+	Error  string `json:",omitempty"`
+	SHA256 string `json:",omitempty"` // 读写的文件内容的 sha256, hex
+	// 写文件的内容来自去重缓存, 没有经过网络
+	Deduped bool `json:",omitempty"`
+}
+
+const (
+	DefaultAuditMaxSize    = 100 * 1024 * 1024
+	DefaultAuditMaxBackups = 10
+)
+
+// AuditLog 是只追加的审计日志, 每行一个 json 的 AuditRecord.
+// 文件超过 MaxSize 时改名为 File.1 (已有的 File.1 改为 File.2, 依次类推, 最多保留 MaxBackups 个), 然后写新的文件.
+// 也可以由外部 (比如 logrotate) 改名后调用 Reopen.
+type AuditLog struct {
+	File       string
+	MaxSize    int64 // 0 表示不按大小轮转
+	MaxBackups int
+
+	mu     sync.Mutex
+	file   *os.File // 轮转或 Reopen 失败后可能为 nil, 下次 Write 时重新打开
+	size   int64
+	closed bool
+}
+
+// OpenAuditLog 打开审计日志 file, 不存在时创建
+func OpenAuditLog(file string, maxSize int64, maxBackups int) (auditLog *AuditLog, err error) {
+	if maxBackups < 1 {
+		maxBackups = 1
+	}
+	auditLog = &AuditLog{File: file, MaxSize: maxSize, MaxBackups: maxBackups}
+	err = auditLog.open()
+	if err != nil {
+		return nil, err
+	}
+	return auditLog, nil
+}
+
+func (auditLog *AuditLog) open() (err error) {
+	file, err := os.OpenFile(auditLog.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("open audit log fail=>%w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("Stat fail=>%w", err)
+	}
+	auditLog.file, auditLog.size = file, info.Size()
+	return nil
+}
+
+// Write 追加一条记录, 需要时先轮转
+func (auditLog *AuditLog) Write(record *AuditRecord) (err error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal fail=>%w", err)
+	}
+	line = append(line, '\n')
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.closed {
+		return errors.New("audit log closed")
+	}
+	if auditLog.file == nil {
+		err = auditLog.open()
+		if err != nil {
+			return err
+		}
+	}
+	if auditLog.MaxSize > 0 && auditLog.size > 0 && auditLog.size+int64(len(line)) > auditLog.MaxSize {
+		err = auditLog.rotate()
+		if err != nil {
+			// 轮转失败时继续写 File, 不能因此停止审计
+			mycplog.Errorf("rotate audit log fail=>%v", err)
+			if auditLog.file == nil {
+				return err
+			}
+		}
+	}
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("Write fail=>%w", err)
+	}
+	return nil
+}
+
+// rotate 把 File.i 改名为 File.i+1, File 改名为 File.1, 然后打开新的 File. 调用时持有 mu.
+// 改名失败时仍然 (追加) 打开 File, 只有打开也失败时 file 才为 nil
+func (auditLog *AuditLog) rotate() (err error) {
+	_ = auditLog.file.Close()
+	auditLog.file = nil
+	err = auditLog.renameBackups()
+	openErr := auditLog.open()
+	if err != nil {
+		return err
+	}
+	return openErr
+}
+
+func (auditLog *AuditLog) renameBackups() (err error) {
+	_ = os.Remove(fmt.Sprintf("%s.%d", auditLog.File, auditLog.MaxBackups))
+	for idx := auditLog.MaxBackups - 1; idx >= 1; idx-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", auditLog.File, idx), fmt.Sprintf("%s.%d", auditLog.File, idx+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Rename fail=>%w", err)
+		}
+	}
+	err = os.Rename(auditLog.File, auditLog.File+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Rename fail=>%w", err)
+	}
+	return nil
+}
+
+// Reopen 关闭并重新打开 File, 用于外部改名轮转之后
+func (auditLog *AuditLog) Reopen() (err error) {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if auditLog.closed {
+		return errors.New("audit log closed")
+	}
+	if auditLog.file != nil {
+		_ = auditLog.file.Close()
+		auditLog.file = nil
+	}
+	return auditLog.open()
+}
+
+func (auditLog *AuditLog) Close() (err error) {
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	auditLog.closed = true
+	if auditLog.file == nil {
+		return nil
+	}
+	err = auditLog.file.Close()
+	auditLog.file = nil
+	return err
+}
+
+// audit 在审计日志中记录 request 所在连接上的一次文件操作, err 不为 nil 表示失败. 没有配置审计日志时什么也不做.
+func (server *Server) audit(request *serverconn.Request, record *AuditRecord, err error) {
+	if server.AuditLog == nil {
+		return
+	}
+	record.Time = time.Now()
+	record.Path = filepath.Clean(record.Path)
+	record.Remote = request.Conn().RemoteAddr().String()
+	record.Conn = request.Conn().ID
+	if sess := server.session(request); sess != nil {
+		record.User = sess.user
+	}
+	record.Result = "ok"
+	if err != nil {
+		record.Result = "fail"
+		record.Error = err.Error()
+	}
+	err = server.AuditLog.Write(record)
+	if err != nil {
+		atomic.AddUint64(&server.metrics.auditFailures, 1)
+		request.Logger().Errorf("write audit log fail=>%v", err)
+	}
+}
+
+// auditTarEntry 返回记录 tar 中每个文件和路径的 util.TarEntryFunc
+func (server *Server) auditTarEntry(request *serverconn.Request, fileOp string) util.TarEntryFunc {
+	return func(entry *util.TarEntry) {
+		if entry.IsDir {
+			if fileOp == AuditOpWrite {
+				server.audit(request, &AuditRecord{Op: AuditOpMkdir, Path: entry.Path}, nil)
+			}
+			return
+		}
+		server.audit(request, &AuditRecord{Op: fileOp, Path: entry.Path, Bytes: entry.Size, SHA256: hex.EncodeToString(entry.SHA256)}, nil)
+	}
+}
+
+// dataSum 返回 myCPPackage.Data 的 sha256, hex. 没有 Data 时返回空
+func dataSum(myCPPackage *mycpproto.MyCPPackage) string {
+	if myCPPackage.Data == nil {
+		return ""
+	}
+	sum := sha256.Sum256(myCPPackage.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// packageErr 返回 myCPPackage 表示的失败, 成功时返回 nil
+func packageErr(myCPPackage *mycpproto.MyCPPackage) error {
+	if myCPPackage.Status != mycpproto.MyCPPackageStatusFail {
+		return nil
+	}
+	if myCPPackage.ErrMsg == "" {
+		return errors.New("unknown error")
+	}
+	return errors.New(myCPPackage.ErrMsg)
+}
+
+// AuditFiles 返回审计日志 file 和它还存在的轮转后的文件, 从旧到新
+func AuditFiles(file string) (files []string) {
+	for idx := 1; ; idx++ {
+		backup := fmt.Sprintf("%s.%d", file, idx)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		files = append([]string{backup}, files...)
+	}
+	return append(files, file)
+}
+
+// AuditFilter 是查询审计日志的条件, 零值的字段不限制
+type AuditFilter struct {
+	Path  string // Path 或 To 是这个路径或者在这个路径下
+	User  string
+	Op    string
+	Since time.Time
+	Until time.Time
+}
+
+func underPath(p, dir string) bool {
+	p, dir = filepath.ToSlash(filepath.Clean(p)), filepath.ToSlash(filepath.Clean(dir))
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func (filter *AuditFilter) Match(record *AuditRecord) bool {
+	if filter.Path != "" && !underPath(record.Path, filter.Path) && (record.To == "" || !underPath(record.To, filter.Path)) {
+		return false
+	}
+	if filter.User != "" && record.User != filter.User {
+		return false
+	}
+	if filter.Op != "" && record.Op != filter.Op {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !record.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// QueryAudit 按时间顺序读审计日志 file 和它轮转后的文件, 对每条满足 filter 的记录调用 fn, fn 返回错误时停止.
+// 无法解析的行 (比如写到一半时进程退出) 被跳过.
+func QueryAudit(file string, filter *AuditFilter, fn func(record *AuditRecord) error) (err error) {
+	for _, auditFile := range AuditFiles(file) {
+		err = queryAuditFile(auditFile, filter, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryAuditFile(auditFile string, filter *AuditFilter, fn func(record *AuditRecord) error) (err error) {
+	file, err := os.Open(auditFile)
+	if err != nil {
+		return fmt.Errorf("Open fail=>%w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &AuditRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			continue
+		}
+		if !filter.Match(record) {
+			continue
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("read %s fail=>%w", auditFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package mycpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditFilterMatch(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := &AuditRecord{Time: now, User: "alice", Op: AuditOpRename, Path: "/data/a/x.txt", To: "/backup/x.txt"}
+	for _, c := range []struct {
+		filter AuditFilter
+		want   bool
+	}{
+		{AuditFilter{}, true},
+		{AuditFilter{Path: "/data"}, true},
+		{AuditFilter{Path: "/data/"}, true},
+		{AuditFilter{Path: "/data/a/x.txt"}, true},
+		{AuditFilter{Path: "/backup"}, true}, // To 在路径下
+		{AuditFilter{Path: "/dat"}, false},
+		{AuditFilter{Path: "/data/a/x"}, false},
+		{AuditFilter{Path: "/other"}, false},
+		{AuditFilter{User: "alice"}, true},
+		{AuditFilter{User: "bob"}, false},
+		{AuditFilter{Op: AuditOpRename}, true},
+		{AuditFilter{Op: AuditOpWrite}, false},
+		{AuditFilter{Since: now}, true},
+		{AuditFilter{Since: now.Add(time.Second)}, false},
+		{AuditFilter{Until: now.Add(time.Second)}, true},
+		{AuditFilter{Until: now}, false}, // Until 不含
+		{AuditFilter{Path: "/data", User: "alice", Op: AuditOpRename, Since: now.Add(-time.Hour), Until: now.Add(time.Hour)}, true},
+		{AuditFilter{Path: "/data", User: "bob"}, false},
+	} {
+		filter := c.filter
+		if got := filter.Match(record); got != c.want {
+			t.Errorf("%+v.Match=>%v, want %v", c.filter, got, c.want)
+		}
+	}
+
+	// 没有 To 的记录只看 Path
+	filter := &AuditFilter{Path: "/"}
+	if !filter.Match(&AuditRecord{Op: AuditOpWrite, Path: "/x"}) {
+		t.Errorf("/ does not match /x")
+	}
+}
+
+// readAuditFile 返回 file 中的记录的 Path
+func readAuditFile(t *testing.T, file string) (paths []string) {
+	err := queryAuditFile(file, &AuditFilter{}, func(record *AuditRecord) error {
+		paths = append(paths, record.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("queryAuditFile fail=>%v", err)
+	}
+	return paths
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mycp-audit-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	// 每条记录单独一个文件
+	auditLog, err := OpenAuditLog(file, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fail=>%v", err)
+	}
+	defer auditLog.Close()
+	for _, p := range []string{"/1", "/2", "/3", "/4"} {
+		err = auditLog.Write(&AuditRecord{Op: AuditOpWrite, Path: p})
+		if err != nil {
+			t.Fatalf("Write fail=>%v", err)
+		}
+	}
+
+	files := AuditFiles(file)
+	if strings.Join(files, ",") != strings.Join([]string{file + ".2", file + ".1", file}, ",") {
+		t.Fatalf("AuditFiles=>%v", files)
+	}
+	for idx, want := range []string{"/2", "/3", "/4"} {
+		if paths := readAuditFile(t, files[idx]); strings.Join(paths, ",") != want {
+			t.Errorf("%s=>%v, want %s", files[idx], paths, want)
+		}
+	}
+	var paths []string
+	err = QueryAudit(file, &AuditFilter{}, func(record *AuditRecord) error {
+		paths = append(paths, record.Path)
+		return nil
+	})
+	if err != nil || strings.Join(paths, ",") != "/2,/3,/4" {
+		t.Fatalf("QueryAudit=>%v, %v", paths, err)
+	}
+}
+
+// TestAuditLogRotateFail 检查改名失败时继续写 File
+func TestAuditLogRotateFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mycp-audit-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	// File.1 是非空的目录, 既删不掉也不能被 File 覆盖
+	if err := os.MkdirAll(filepath.Join(file+".1", "x"), 0755); err != nil {
+		t.Fatalf("MkdirAll fail=>%v", err)
+	}
+	auditLog, err := OpenAuditLog(file, 10, 1)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fail=>%v", err)
+	}
+	defer auditLog.Close()
+	for _, p := range []string{"/1", "/2", "/3"} {
+		err = auditLog.Write(&AuditRecord{Op: AuditOpWrite, Path: p})
+		if err != nil {
+			t.Fatalf("Write fail=>%v", err)
+		}
+	}
+	if paths := readAuditFile(t, file); strings.Join(paths, ",") != "/1,/2,/3" {
+		t.Fatalf("%s=>%v", file, paths)
+	}
+}
@@ -0,0 +1,287 @@
+package mycpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// session 是 Hello 之后保存在连接上的状态
+type session struct {
+	user string
+	key  string // 这个连接上的请求和响应加解密用的密钥
+	root string // 只能访问这个路径下的文件, 为空表示不限制
+
+	// 不为 nil 时 key 是由它得到的会话密钥, 第一个请求必须是出示了 K 的 MyCPOpAuth, 见 mycpproto.HelloResponse
+	verifier []byte
+	proven   uint32 // 是否已经出示了 K, 原子读写
+}
+
+// ApplyConfig 使用配置文件中的用户, 路径限制, 命令白名单和连接参数, 并加载 TLS 证书
+func (server *Server) ApplyConfig(config *Config) (err error) {
+	server.Users = config.Users
+	server.Root = config.Root
+	var keyUsers []string
+	for _, name := range config.UserNames() {
+		if config.Users[name].Key != "" {
+			keyUsers = append(keyUsers, name)
+		}
+	}
+	if len(keyUsers) != 0 {
+		mycplog.Warnf("users %v still have keys in the config, anyone who can read it can log in as them. "+
+			"run mycpserver passwd --drop-keys after all clients are upgraded", keyUsers)
+	}
+	if config.ExecAllow != nil {
+		server.ExecAllowList = config.ExecAllow
+	}
+	if config.PushAllow != nil {
+		server.PushAllowList = config.PushAllow
+	}
+
+	limits := config.Limits
+	if limits.PingInterval != 0 {
+		server.ConnOptions.PingInterval = time.Duration(limits.PingInterval)
+	}
+	if limits.IdleTimeout != 0 {
+		server.ConnOptions.IdleTimeout = time.Duration(limits.IdleTimeout)
+	}
+	if limits.MaxInFlight < 0 {
+		return fmt.Errorf("Limits.MaxInFlight must be at least 1, got %d", limits.MaxInFlight)
+	}
+	if limits.MaxInFlight != 0 {
+		server.ConnOptions.MaxInFlight = limits.MaxInFlight
+	}
+	if limits.MaxFrameSize != 0 {
+		server.ConnOptions.MaxFrameSize = limits.MaxFrameSize
+	}
+	if limits.MaxPreAuthFrameSize != 0 {
+		server.ConnOptions.MaxPreAuthFrameSize = limits.MaxPreAuthFrameSize
+	}
+	if limits.MaxConns != 0 {
+		server.MaxConns = limits.MaxConns
+	}
+	if limits.MaxConnsPerIP != 0 {
+		server.MaxConnsPerIP = limits.MaxConnsPerIP
+	}
+	if limits.Workers != 0 {
+		server.Workers = limits.Workers
+	}
+	if limits.MaxWorkersPerConn != 0 {
+		server.MaxWorkersPerConn = limits.MaxWorkersPerConn
+	}
+
+	if config.TLS.CertFile != "" || config.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("LoadX509KeyPair fail=>%w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		sum := sha256.Sum256(cert.Certificate[0])
+		mycplog.Infof("tls enabled, TLSPin of the cert=>%s", hex.EncodeToString(sum[:]))
+	}
+	return nil
+}
+
+// isHello 判断请求是不是明文的 Hello. 加密后的请求是 base64, 不会以 '{' 开头
+func isHello(pkg []byte) bool {
+	return bytes.HasPrefix(pkg, []byte("{"))
+}
+
+// MyCPHello 处理 Hello: 在连接上记下用户和密钥, 把用户的盐和迭代次数发回去.
+// 客户端发了 Nonce 时也回一个随机数, 这个连接的密钥是由双方的随机数和用户的 Verifier 得到的会话密钥.
+// 用户不存在时也回一个由用户名决定的假的盐, 不让对方知道哪些用户存在, 之后的请求会因为无法解密而失败.
+func (server *Server) MyCPHello(request *serverconn.Request) (dropped bool) {
+	logger := request.Logger()
+	hello := &mycpproto.Hello{}
+	err := json.Unmarshal(request.Pkg, hello)
+	if err != nil {
+		logger.Warnf("unmarshal Hello fail=>%v", err)
+		request.CloseConn()
+		return true
+	}
+
+	var rsp = &mycpproto.HelloResponse{ConnID: request.Conn().ID, ServerTime: time.Now()}
+	if server.Blobs != nil {
+		rsp.BlobMinSize = server.Blobs.MinFileSize
+	}
+	if len(hello.Nonce) != 0 && len(hello.Nonce) != util.NonceLen {
+		logger.Warnf("bad Nonce length=>%d", len(hello.Nonce))
+		request.CloseConn()
+		return true
+	}
+	var sess *session
+	var verifier []byte
+	if len(server.Users) == 0 {
+		sess = &session{key: server.passwordKey, root: server.Root}
+		verifier = util.KeyVerifier(server.passwordKey)
+		rsp.Salt, rsp.Iterations = server.passwordSalt, server.passwordIterations
+	} else {
+		name := hello.User
+		if name == "" && len(server.Users) == 1 {
+			for onlyName := range server.Users {
+				name = onlyName
+			}
+		}
+		user, ok := server.Users[name]
+		if ok {
+			salt, _ := hex.DecodeString(user.Salt)
+			root := user.Root
+			if root == "" {
+				root = server.Root
+			}
+			// 只保存了 Verifier 的用户 key 为空, 不发 Nonce 的旧客户端不能登录
+			sess = &session{user: name, key: user.key(), root: root}
+			verifier = user.verifier()
+			rsp.Salt, rsp.Iterations = salt, user.Iterations
+		} else {
+			logger.Warnf("hello from unknown user=>%q", name)
+			mac := hmac.New(sha256.New, server.helloSecret)
+			mac.Write([]byte(name))
+			sess = &session{user: name}
+			rsp.Salt, rsp.Iterations = mac.Sum(nil)[:util.SaltLen], util.DefaultIterations
+			// 随机的 Verifier, 谁也无法得到对应的会话密钥
+			verifier, err = util.GenSalt(sha256.Size)
+			if err != nil {
+				logger.Warnf("GenSalt fail=>%v", err)
+				request.CloseConn()
+				return true
+			}
+		}
+	}
+	if len(hello.Nonce) != 0 {
+		rsp.Nonce, err = util.GenSalt(util.NonceLen)
+		if err != nil {
+			logger.Warnf("GenSalt fail=>%v", err)
+			request.CloseConn()
+			return true
+		}
+		sess.key = util.SessionKey(verifier, hello.Nonce, rsp.Nonce)
+		sess.verifier = verifier
+	}
+	request.SetSession(sess)
+	logger.Infof("hello from user=>%q", sess.user)
+
+	request.Pkg, err = json.Marshal(rsp)
+	if err != nil {
+		logger.Warnf("Marshal fail=>%v", err)
+		request.CloseConn()
+		return true
+	}
+	return false
+}
+
+// session 返回请求所在连接的 session. 没有发 Hello 时, 只有在使用旧式 16 字节密码的情况下才能直接用密码作为密钥.
+func (server *Server) session(request *serverconn.Request) *session {
+	if sess, ok := request.Session().(*session); ok {
+		return sess
+	}
+	if len(server.Users) == 0 && len(server.passwordSalt) == 0 {
+		return &session{key: server.passwordKey, root: server.Root}
+	}
+	return nil
+}
+
+// confinePaths 把请求中服务端一侧的路径限制在 root 下, root 为空时不做任何修改
+func confinePaths(root string, myCPPackage *mycpproto.MyCPPackage) (err error) {
+	if root == "" {
+		return nil
+	}
+	var paths []*string
+	switch myCPPackage.Op {
+	case mycpproto.MyCPOpCP:
+		if myCPPackage.Direction == mycpproto.DirectionRemoteIsSrc {
+			paths = append(paths, &myCPPackage.SrcPath)
+		} else {
+			// SrcPath 是客户端的路径, 只用到了它的最后一级
+			paths = append(paths, &myCPPackage.DstPath)
+		}
+	case mycpproto.MyCPOpRename:
+		paths = append(paths, &myCPPackage.SrcPath, &myCPPackage.DstPath)
+	case mycpproto.MyCPOpPush, mycpproto.MyCPOpStreamGet:
+		paths = append(paths, &myCPPackage.SrcPath)
+	case mycpproto.MyCPOpAuth:
+	default:
+		paths = append(paths, &myCPPackage.DstPath)
+	}
+	for _, p := range paths {
+		*p, err = confinePath(root, *p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confinePath 把 p 解释为 root 下的路径: 相对路径相对于 root, 绝对路径必须在 root 下.
+// 保留结尾的 '/'. 除了字面上的检查, 还解析 p 已经存在的部分中的软链接, 指向 root 外面时也拒绝.
+// 检查之后才在 root 下创建的软链接不在此列, 不能让不可信的人在 root 下直接创建文件.
+func confinePath(root, p string) (confined string, err error) {
+	var joined string
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "/") {
+		joined = filepath.Clean(p)
+	} else {
+		joined = filepath.Join(root, p)
+	}
+	rel, err := filepath.Rel(root, joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(p + " is outside the root")
+	}
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := resolveExisting(joined)
+	if err != nil {
+		return "", err
+	}
+	rel, err = filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(p + " links to outside the root")
+	}
+	confined = filepath.ToSlash(joined)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(confined, "/") {
+		confined += "/"
+	}
+	return confined, nil
+}
+
+// resolveExisting 解析 p 已经存在的最长前缀中的软链接, 再接上不存在的部分.
+// 悬空的软链接返回错误, 因为写它会在它指向的地方创建文件.
+func resolveExisting(p string) (resolved string, err error) {
+	var rest []string
+	for {
+		resolved, err = filepath.EvalSymlinks(p)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("EvalSymlinks fail=>%w", err)
+		}
+		if _, lstatErr := os.Lstat(p); lstatErr == nil {
+			return "", errors.New(p + " is a dangling symlink")
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", fmt.Errorf("EvalSymlinks fail=>%w", err)
+		}
+		rest = append(rest, filepath.Base(p))
+		p = parent
+	}
+	for i := len(rest) - 1; i >= 0; i-- {
+		resolved = filepath.Join(resolved, rest[i])
+	}
+	return resolved, nil
+}
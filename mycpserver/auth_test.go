@@ -0,0 +1,98 @@
+package mycpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfinePath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mycp-confine-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// root 本身是软链接也没有关系
+	realRoot := filepath.Join(tmp, "real-root")
+	root := filepath.Join(tmp, "root")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(realRoot, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll fail=>%v", err)
+		}
+	}
+	for link, target := range map[string]string{
+		root:                                  realRoot,
+		filepath.Join(realRoot, "out"):        outside,
+		filepath.Join(realRoot, "in"):         filepath.Join(realRoot, "dir"),
+		filepath.Join(realRoot, "rel-in"):     "dir",
+		filepath.Join(realRoot, "rel-out"):    "../outside",
+		filepath.Join(realRoot, "dangling"):   filepath.Join(outside, "no-such-file"),
+		filepath.Join(realRoot, "dir", "top"): "/",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Symlink fail=>%v", err)
+		}
+	}
+
+	slash := filepath.ToSlash
+	for _, c := range []struct {
+		p    string
+		want string // 为空表示应该被拒绝
+	}{
+		{"a.txt", slash(root + "/a.txt")},
+		{"dir/new/a.txt", slash(root + "/dir/new/a.txt")},
+		{"dir/", slash(root+"/dir") + "/"},
+		{".", slash(root)},
+		{root + "/dir/../a.txt", slash(root + "/a.txt")},
+		// 按字面比较, 绕过 root 的软链接写出的绝对路径也算在 root 外
+		{realRoot + "/a.txt", ""},
+		{"in/a.txt", slash(root + "/in/a.txt")},
+		{"rel-in/new/a.txt", slash(root + "/rel-in/new/a.txt")},
+		{"..", ""},
+		{"../outside/a.txt", ""},
+		{"dir/../../a.txt", ""},
+		{outside + "/a.txt", ""},
+		{"/etc/passwd", ""},
+		{"out", ""},
+		{"out/a.txt", ""},
+		{"out/new/a.txt", ""},
+		{"rel-out/a.txt", ""},
+		{"dangling", ""},
+		{"dir/top/etc/passwd", ""},
+	} {
+		got, err := confinePath(root, c.p)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("confinePath(%q)=>%q, want error", c.p, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("confinePath(%q)=>%q, %v, want %q", c.p, got, err, c.want)
+		}
+	}
+}
+
+func TestResolveExisting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mycp-resolve-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	tmp, err = filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatalf("EvalSymlinks fail=>%v", err)
+	}
+	if err := os.Mkdir(filepath.Join(tmp, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir fail=>%v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "dir"), filepath.Join(tmp, "link")); err != nil {
+		t.Fatalf("Symlink fail=>%v", err)
+	}
+	got, err := resolveExisting(filepath.Join(tmp, "link", "a", "b"))
+	if want := filepath.Join(tmp, "dir", "a", "b"); err != nil || got != want {
+		t.Fatalf("resolveExisting=>%q, %v, want %q", got, err, want)
+	}
+}
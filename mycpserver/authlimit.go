@@ -0,0 +1,92 @@
+package mycpserver
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// MaxAuthFailures 是一个 ip 在被拒绝之前允许的认证失败次数
+	MaxAuthFailures = 5
+	// 超过 MaxAuthFailures 之后每次失败都拒绝这个 ip 一段时间, 从 minAuthBackoff 开始每次加倍, 最多 maxAuthBackoff
+	minAuthBackoff = 30 * time.Second
+	maxAuthBackoff = time.Hour
+	// 最后一次失败之后过了这么久就忘掉这个 ip 的失败次数
+	authFailureTTL = time.Hour
+	// 记录的 ip 超过这么多时清理已经过期的
+	authLimiterPruneSize = 4096
+)
+
+// authLimiter 按 ip 记录认证失败的次数, 失败太多的 ip 在一段时间内不能再连接和认证.
+// 只影响这个 ip, 不会因为别人猜密码而影响其他用户
+type authLimiter struct {
+	mu  sync.Mutex
+	ips map[string]*authFailure
+	now func() time.Time
+}
+
+type authFailure struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{
+		ips: make(map[string]*authFailure),
+		now: time.Now,
+	}
+}
+
+// failed 记 ip 的一次认证失败, 返回之后拒绝这个 ip 多久, 0 表示还不拒绝
+func (limiter *authLimiter) failed(ip string) (backoff time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.now()
+	failure, ok := limiter.ips[ip]
+	if !ok || now.Sub(failure.last) > authFailureTTL {
+		if len(limiter.ips) >= authLimiterPruneSize {
+			limiter.prune(now)
+		}
+		failure = &authFailure{}
+		limiter.ips[ip] = failure
+	}
+	failure.count++
+	failure.last = now
+	if failure.count < MaxAuthFailures {
+		return 0
+	}
+	backoff = minAuthBackoff
+	for idx := MaxAuthFailures; idx < failure.count && backoff < maxAuthBackoff; idx++ {
+		backoff *= 2
+	}
+	if backoff > maxAuthBackoff {
+		backoff = maxAuthBackoff
+	}
+	failure.blockedUntil = now.Add(backoff)
+	return backoff
+}
+
+// blocked 返回 ip 还要被拒绝多久, 0 表示不拒绝
+func (limiter *authLimiter) blocked(ip string) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	failure, ok := limiter.ips[ip]
+	if !ok {
+		return 0
+	}
+	remaining := failure.blockedUntil.Sub(limiter.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// prune 删除已经过期的记录, 调用时持有 mu
+func (limiter *authLimiter) prune(now time.Time) {
+	for ip, failure := range limiter.ips {
+		if now.Sub(failure.last) > authFailureTTL && now.After(failure.blockedUntil) {
+			delete(limiter.ips, ip)
+		}
+	}
+}
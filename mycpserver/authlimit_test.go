@@ -0,0 +1,99 @@
+package mycpserver
+
+import (
+	"context"
+	"mycp/mycpclient"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	limiter := newAuthLimiter()
+	limiter.now = func() time.Time { return now }
+
+	for idx := 1; idx < MaxAuthFailures; idx++ {
+		if backoff := limiter.failed("10.0.0.1"); backoff != 0 {
+			t.Fatalf("failure #%d=>backoff %v", idx, backoff)
+		}
+	}
+	if limiter.blocked("10.0.0.1") != 0 {
+		t.Fatalf("blocked before %d failures", MaxAuthFailures)
+	}
+	// 之后每次失败拒绝的时间加倍, 最多 maxAuthBackoff
+	for _, want := range []time.Duration{minAuthBackoff, 2 * minAuthBackoff, 4 * minAuthBackoff} {
+		if backoff := limiter.failed("10.0.0.1"); backoff != want {
+			t.Fatalf("backoff=>%v, want %v", backoff, want)
+		}
+	}
+	if got := limiter.blocked("10.0.0.1"); got != 4*minAuthBackoff {
+		t.Fatalf("blocked=>%v", got)
+	}
+	// 其他 ip 不受影响
+	if limiter.blocked("10.0.0.2") != 0 || limiter.failed("10.0.0.2") != 0 {
+		t.Fatalf("another ip blocked")
+	}
+	for idx := 0; idx < 20; idx++ {
+		limiter.failed("10.0.0.1")
+	}
+	if got := limiter.blocked("10.0.0.1"); got != maxAuthBackoff {
+		t.Fatalf("blocked=>%v, want %v", got, maxAuthBackoff)
+	}
+
+	now = now.Add(maxAuthBackoff + time.Second)
+	if got := limiter.blocked("10.0.0.1"); got != 0 {
+		t.Fatalf("still blocked=>%v", got)
+	}
+	// 最后一次失败过了 authFailureTTL 之后重新计数
+	now = now.Add(authFailureTTL)
+	if backoff := limiter.failed("10.0.0.1"); backoff != 0 {
+		t.Fatalf("failure after ttl=>backoff %v", backoff)
+	}
+
+	limiter.prune(now.Add(authFailureTTL + time.Second))
+	if len(limiter.ips) != 0 {
+		t.Fatalf("%d ips after prune", len(limiter.ips))
+	}
+}
+
+// TestAuthBackoff 检查密码错误太多时只拒绝这个 ip, 服务端不会退出
+func TestAuthBackoff(t *testing.T) {
+	config := &Config{}
+	if err := config.SetPassword("alice", "alice-password", 1); err != nil {
+		t.Fatalf("SetPassword fail=>%v", err)
+	}
+	server, host := startTestServer(t, config)
+	// 服务端在其他协程中读 now
+	var offset int64
+	server.authLimiter.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for idx := 0; idx < MaxAuthFailures+2; idx++ {
+		client, err := mycpclient.NewClient(ctx, host, "wrong-password", nil)
+		if err == nil {
+			client.Close()
+			t.Fatalf("wrong password accepted")
+		}
+	}
+	if server.IsClosed() {
+		t.Fatalf("server closed after auth failures")
+	}
+	if atomic.LoadUint64(&server.WrongPasswordTimes) < MaxAuthFailures {
+		t.Fatalf("WrongPasswordTimes=>%d", atomic.LoadUint64(&server.WrongPasswordTimes))
+	}
+	// 被拒绝期间密码正确也不能连接
+	client, err := mycpclient.NewClient(ctx, host, "alice-password", nil)
+	if err == nil {
+		client.Close()
+		t.Fatalf("blocked ip connected")
+	}
+
+	atomic.StoreInt64(&offset, int64(maxAuthBackoff+time.Second))
+	client, err = mycpclient.NewClient(ctx, host, "alice-password", nil)
+	if err != nil {
+		t.Fatalf("NewClient after backoff fail=>%v", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,439 @@
+package mycpserver
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBlobMaxSize     = 10 * 1024 * 1024 * 1024
+	DefaultBlobMinFileSize = 4096
+)
+
+// errBlobNotFound 表示去重缓存中没有这个内容
+var errBlobNotFound = errors.New("blob not found")
+
+// blob 是去重缓存中的一个内容
+type blob struct {
+	ns      string // 所属的分区, 见 BlobNamespace
+	sum     string // sha256, hex
+	size    int64
+	modTime time.Time // 存入时 blob 文件的修改时间, 变了说明文件被改过 (Link 时可能经由链接出去的文件被原地修改)
+}
+
+// BlobStore 是以内容的 sha256 为 key 的去重缓存. 写入服务端的不小于 MinFileSize 的文件都会存入一份,
+// 之后客户端写同样内容的文件时先只发送 sha256, 服务端从缓存中拷贝 (或者硬链接) 出来, 不用再传输内容.
+// 所有 blob 的总字节数超过 MaxSize 时删除最久没有用到的.
+//
+// 缓存按用户能访问的路径 (Root) 分区, 每个分区只用自己存入的内容, 见 BlobNamespace. 否则知道 sha256 就能得到
+// 别的用户的文件, 也能知道服务端上有没有某个内容. 每个 blob 是 Dir 下的 分区/sha256 的前两位/sha256 这个文件.
+//
+// Link 为 true 时存入和取出都用硬链接代替拷贝, 省空间也更快, 但 blob 与写入的文件是同一个文件:
+// 原地修改写入的文件会让 blob 失效 (用到时发现修改时间变了就删掉), 修改其权限也会改变 blob 的权限.
+// 需要设置修改时间 (SrcModTime) 的写入总是拷贝, 否则会改掉 blob 的修改时间.
+type BlobStore struct {
+	Dir         string
+	MaxSize     int64
+	MinFileSize int64
+	Link        bool
+
+	mu    sync.Mutex
+	blobs map[string]*list.Element // value 是 *blob
+	lru   *list.List               // 最近用到的在前面
+	size  int64                    // 所有 blob 的总字节数
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// OpenBlobStore 打开保存在路径 dir 下的去重缓存, dir 不存在时创建. 已有的 blob 按修改时间排出最近用到的顺序,
+// 超过 maxSize 时删除最旧的. 写到一半时进程退出留下的临时文件, 以及以前的版本不分区保存的 blob 被删除,
+// dir 下的其他文件被忽略.
+func OpenBlobStore(dir string, maxSize, minFileSize int64, link bool) (store *BlobStore, err error) {
+	if minFileSize < 1 {
+		minFileSize = 1
+	}
+	err = os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	store = &BlobStore{
+		Dir:         dir,
+		MaxSize:     maxSize,
+		MinFileSize: minFileSize,
+		Link:        link,
+		blobs:       make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	var found []*blob
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.Contains(info.Name(), ".mycp-tmp-") {
+			mycplog.Debugf("remove temp file in blob store=>%s", filePath)
+			return os.Remove(filePath)
+		}
+		sum := info.Name()
+		if !info.Mode().IsRegular() || !isBlobSum(sum) {
+			mycplog.Debugf("skip unknown file in blob store=>%s", filePath)
+			return nil
+		}
+		if filePath == filepath.Join(dir, sum[:2], sum) {
+			mycplog.Debugf("remove unpartitioned blob=>%s", filePath)
+			return os.Remove(filePath)
+		}
+		ns := filepath.Base(filepath.Dir(filepath.Dir(filePath)))
+		if !isBlobNamespace(ns) || filePath != store.path(ns, sum) {
+			mycplog.Debugf("skip unknown file in blob store=>%s", filePath)
+			return nil
+		}
+		found = append(found, &blob{ns: ns, sum: sum, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk %s fail=>%w", dir, err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.After(found[j].modTime)
+	})
+	for _, b := range found {
+		store.blobs[blobKey(b.ns, b.sum)] = store.lru.PushBack(b)
+		store.size += b.size
+	}
+	store.mu.Lock()
+	store.evict()
+	store.mu.Unlock()
+	return store, nil
+}
+
+// isBlobSum 判断 name 是不是小写 hex 的 sha256
+func isBlobSum(name string) bool {
+	return len(name) == 64 && isHex(name)
+}
+
+// isHex 判断 name 是否只由小写 hex 字符组成
+func isHex(name string) bool {
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// BlobNamespace 返回能访问 root 下的文件的用户使用的分区, root 为空表示不限制. Root 相同的用户本来就能读写彼此的文件,
+// 共用一个分区; Root 不同的用户之间不共享内容, 也不会硬链接到同一个文件.
+func BlobNamespace(root string) string {
+	if root != "" {
+		root = filepath.Clean(root)
+	}
+	sum := sha256.Sum256([]byte(root))
+	return hex.EncodeToString(sum[:8])
+}
+
+// isBlobNamespace 判断 name 是不是 BlobNamespace 返回的分区
+func isBlobNamespace(name string) bool {
+	return len(name) == 16 && isHex(name)
+}
+
+func blobKey(ns, sum string) string {
+	return ns + "/" + sum
+}
+
+func (store *BlobStore) path(ns, sum string) string {
+	return filepath.Join(store.Dir, ns, sum[:2], sum)
+}
+
+// Has 判断分区 ns 中是否有 sha256 为 sum 的内容, store 为 nil 时返回 false
+func (store *BlobStore) Has(ns, sum string) bool {
+	if store == nil || !isBlobSum(sum) {
+		return false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, ok := store.blobs[blobKey(ns, sum)]
+	return ok
+}
+
+// WriteFile 用分区 ns 中 sha256 为 sum 的内容写文件 dstPath, 先写临时文件再 rename. 返回内容的字节数.
+// link 为 true 且 store.Link 时用硬链接, 失败时 (比如不在同一个文件系统) 退回到拷贝. 缓存中没有时返回 errBlobNotFound.
+func (store *BlobStore) WriteFile(ns, sum, dstPath string, link bool) (size int64, err error) {
+	b := store.use(ns, sum)
+	if b == nil {
+		atomic.AddUint64(&store.misses, 1)
+		return 0, errBlobNotFound
+	}
+	blobPath := store.path(ns, sum)
+	info, err := os.Stat(blobPath)
+	if err != nil || info.Size() != b.size || !info.ModTime().Equal(b.modTime) {
+		mycplog.Warnf("blob %s is missing or modified, drop it", sum)
+		store.remove(ns, sum)
+		atomic.AddUint64(&store.misses, 1)
+		return 0, errBlobNotFound
+	}
+	perm := os.FileMode(0664)
+	if dstInfo, err := os.Stat(dstPath); err == nil {
+		perm = dstInfo.Mode().Perm()
+	}
+
+	if link && store.Link {
+		err = linkAtomic(blobPath, dstPath)
+		if err == nil {
+			atomic.AddUint64(&store.hits, 1)
+			return b.size, nil
+		}
+		mycplog.Debugf("link blob fail, copy it=>%v", err)
+	}
+	file, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		// 刚刚被删掉了
+		atomic.AddUint64(&store.misses, 1)
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Open fail=>%w", err)
+	}
+	defer file.Close()
+	err = util.WriteFileAtomicFrom(dstPath, file, perm)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&store.hits, 1)
+	return b.size, nil
+}
+
+// use 返回分区 ns 中 sum 对应的 blob 并把它标记为最近用到的, 没有时返回 nil
+func (store *BlobStore) use(ns, sum string) *blob {
+	if !isBlobSum(sum) {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	elem, ok := store.blobs[blobKey(ns, sum)]
+	if !ok {
+		return nil
+	}
+	store.lru.MoveToFront(elem)
+	return elem.Value.(*blob)
+}
+
+// Add 把刚刚写入的文件 filePath 存入分区 ns, sum 和 size 是服务端自己算出的写入的内容的 sha256 (hex) 和字节数.
+// 小于 MinFileSize, 大于 MaxSize 或者已经在缓存中时什么也不做, store 为 nil 时也什么也不做.
+// 拷贝时校验内容, 文件在写入之后又被修改过时不存入.
+func (store *BlobStore) Add(ns, filePath, sum string, size int64) (err error) {
+	if store == nil || size < store.MinFileSize || size > store.MaxSize || !isBlobSum(sum) || !isBlobNamespace(ns) {
+		return nil
+	}
+	if store.use(ns, sum) != nil {
+		return nil
+	}
+	blobPath := store.path(ns, sum)
+	err = os.MkdirAll(filepath.Dir(blobPath), 0750)
+	if err != nil {
+		return fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	if store.Link {
+		err = linkAtomic(filePath, blobPath)
+		if err == nil {
+			err = checkBlobSize(blobPath, size)
+		}
+	} else {
+		err = copyBlob(filePath, blobPath, sum)
+	}
+	if err != nil {
+		return fmt.Errorf("add blob %s fail=>%w", sum, err)
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return fmt.Errorf("os.Stat fail=>%w", err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key := blobKey(ns, sum)
+	if elem, ok := store.blobs[key]; ok {
+		// 同时有别的请求存入了同样的内容
+		elem.Value.(*blob).modTime = info.ModTime()
+		store.lru.MoveToFront(elem)
+		return nil
+	}
+	store.blobs[key] = store.lru.PushFront(&blob{ns: ns, sum: sum, size: size, modTime: info.ModTime()})
+	store.size += size
+	store.evict()
+	return nil
+}
+
+// evict 在总字节数超过 MaxSize 时删除最久没有用到的 blob, 调用时持有 mu
+func (store *BlobStore) evict() {
+	for store.size > store.MaxSize && store.lru.Len() > 0 {
+		b := store.lru.Remove(store.lru.Back()).(*blob)
+		delete(store.blobs, blobKey(b.ns, b.sum))
+		store.size -= b.size
+		atomic.AddUint64(&store.evictions, 1)
+		err := os.Remove(store.path(b.ns, b.sum))
+		if err != nil && !os.IsNotExist(err) {
+			mycplog.Warnf("remove blob fail=>%v", err)
+		}
+	}
+}
+
+// remove 删除分区 ns 中 sum 对应的 blob
+func (store *BlobStore) remove(ns, sum string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key := blobKey(ns, sum)
+	elem, ok := store.blobs[key]
+	if !ok {
+		return
+	}
+	store.lru.Remove(elem)
+	delete(store.blobs, key)
+	store.size -= elem.Value.(*blob).size
+	_ = os.Remove(store.path(ns, sum))
+}
+
+// Stats 返回 blob 的个数和总字节数
+func (store *BlobStore) Stats() (count int, size int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.lru.Len(), store.size
+}
+
+// copyBlob 把文件 filePath 拷贝为 blobPath, 内容的 sha256 不是 sum 时失败
+func copyBlob(filePath, blobPath, sum string) (err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("Open fail=>%w", err)
+	}
+	defer file.Close()
+	hr := util.NewHashReader(file)
+	dir, name := filepath.Split(blobPath)
+	tmpFile, err := ioutil.TempFile(dir, "."+name+".mycp-tmp-")
+	if err != nil {
+		return fmt.Errorf("TempFile fail=>%w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	_, err = tmpFile.ReadFrom(hr)
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("Write fail=>%w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Close fail=>%w", closeErr)
+	}
+	if hex.EncodeToString(hr.Sum()) != sum {
+		return errors.New("file modified after written")
+	}
+	err = os.Rename(tmpPath, blobPath)
+	if err != nil {
+		return fmt.Errorf("Rename fail=>%w", err)
+	}
+	return nil
+}
+
+// checkBlobSize 在硬链接存入的 blob 的大小不是 size 时删掉它. 不读内容, 只能发现大小的变化
+func checkBlobSize(blobPath string, size int64) (err error) {
+	info, err := os.Stat(blobPath)
+	if err == nil && info.Size() == size {
+		return nil
+	}
+	_ = os.Remove(blobPath)
+	return errors.New("file modified after written")
+}
+
+// linkAtomic 让 newPath 成为 oldPath 的硬链接, 先链接到临时的名字再 rename, 所以 newPath 已存在时也会被替换
+func linkAtomic(oldPath, newPath string) (err error) {
+	dir, name := filepath.Split(newPath)
+	if dir == "" {
+		dir = "."
+	}
+	suffix, err := util.GenSalt(8)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, "."+name+".mycp-tmp-"+hex.EncodeToString(suffix))
+	err = os.Link(oldPath, tmpPath)
+	if err != nil {
+		return fmt.Errorf("Link fail=>%w", err)
+	}
+	err = os.Rename(tmpPath, newPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Rename fail=>%w", err)
+	}
+	return nil
+}
+
+// blobNamespace 返回请求所在连接的用户使用的去重缓存分区
+func (server *Server) blobNamespace(request *serverconn.Request) string {
+	root := server.Root
+	if sess := server.session(request); sess != nil {
+		root = sess.root
+	}
+	return BlobNamespace(root)
+}
+
+// addBlob 把请求刚刚写入的文件存入用户的去重缓存分区, 失败时只记日志
+func (server *Server) addBlob(request *serverconn.Request, logger *mycplog.Logger, filePath, sum string, size int64) {
+	err := server.Blobs.Add(server.blobNamespace(request), filePath, sum, size)
+	if err != nil {
+		logger.Warnf("Blobs.Add fail=>%v", err)
+	}
+}
+
+// MyCPPutBlob 处理只带 BlobSHA256 的写文件请求: 用用户的去重缓存分区中的内容写文件, 规则与 MyCPFromLocalToRemote 相同.
+// 分区中没有时响应 MyCPPackageStatusNeedData. 返回实际写入的文件和内容的字节数.
+func (server *Server) MyCPPutBlob(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage) (realDst string, size int64) {
+	logger := request.Logger()
+	ns, sum := server.blobNamespace(request), myCPPackage.BlobSHA256
+	if !server.Blobs.Has(ns, sum) {
+		if server.Blobs != nil {
+			atomic.AddUint64(&server.Blobs.misses, 1)
+		}
+		myCPPackage.Status = mycpproto.MyCPPackageStatusNeedData
+		return "", 0
+	}
+	var blobErr error
+	realDst = myCPFromLocalToRemote(logger, myCPPackage, func(realDstFile string) error {
+		// 设置修改时间时不能用硬链接, 否则会改掉 blob 的修改时间
+		size, blobErr = server.Blobs.WriteFile(ns, sum, realDstFile, myCPPackage.SrcModTime.IsZero())
+		if blobErr != nil && !errors.Is(blobErr, errBlobNotFound) {
+			return fmt.Errorf("write blob fail=>%w", blobErr)
+		}
+		return blobErr
+	})
+	if errors.Is(blobErr, errBlobNotFound) {
+		// 刚刚被删掉了
+		myCPPackage.Status, myCPPackage.ErrMsg, myCPPackage.ErrCode = mycpproto.MyCPPackageStatusNeedData, "", ""
+		return "", 0
+	}
+	if myCPPackage.Status == mycpproto.MyCPPackageStatusSucc {
+		myCPPackage.Deduped = true
+	}
+	return realDst, size
+}
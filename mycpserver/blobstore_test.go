@@ -0,0 +1,112 @@
+package mycpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBlobFile 写一个 size 字节的文件, 内容由 c 重复而成, 返回它的 sha256
+func writeBlobFile(t *testing.T, filePath string, c byte, size int) (sum string) {
+	data := []byte(strings.Repeat(string(c), size))
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatalf("WriteFile fail=>%v", err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestBlobStoreEvict(t *testing.T) {
+	for _, link := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "mycp-blob-")
+		if err != nil {
+			t.Fatalf("TempDir fail=>%v", err)
+		}
+		defer os.RemoveAll(dir)
+		store, err := OpenBlobStore(filepath.Join(dir, "blobs"), 250, 1, link)
+		if err != nil {
+			t.Fatalf("OpenBlobStore fail=>%v", err)
+		}
+		ns := BlobNamespace(dir)
+
+		var sums []string
+		for _, c := range []byte("abc") {
+			filePath := filepath.Join(dir, string(c))
+			sum := writeBlobFile(t, filePath, c, 100)
+			if c == 'c' {
+				// 用到 a 之后, 最久没有用到的是 b
+				if _, err := store.WriteFile(ns, sums[0], filepath.Join(dir, "a.copy"), true); err != nil {
+					t.Fatalf("link=%v: WriteFile fail=>%v", link, err)
+				}
+			}
+			if err := store.Add(ns, filePath, sum, 100); err != nil {
+				t.Fatalf("link=%v: Add fail=>%v", link, err)
+			}
+			sums = append(sums, sum)
+		}
+
+		if count, size := store.Stats(); count != 2 || size != 200 {
+			t.Fatalf("link=%v: Stats=>%d, %d", link, count, size)
+		}
+		for idx, want := range []bool{true, false, true} {
+			if got := store.Has(ns, sums[idx]); got != want {
+				t.Errorf("link=%v: Has(%c)=>%v, want %v", link, "abc"[idx], got, want)
+			}
+		}
+		_, err = store.WriteFile(ns, sums[1], filepath.Join(dir, "b.copy"), true)
+		if !errors.Is(err, errBlobNotFound) {
+			t.Errorf("link=%v: WriteFile evicted blob=>%v", link, err)
+		}
+		if _, err := os.Stat(store.path(ns, sums[1])); !os.IsNotExist(err) {
+			t.Errorf("link=%v: evicted blob file still exists=>%v", link, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "a.copy"))
+		if err != nil || string(data) != strings.Repeat("a", 100) {
+			t.Errorf("link=%v: a.copy=>%q, %v", link, data, err)
+		}
+
+		// 小于 MinFileSize 或者大于 MaxSize 的不存入
+		big := writeBlobFile(t, filepath.Join(dir, "big"), 'd', 300)
+		if err := store.Add(ns, filepath.Join(dir, "big"), big, 300); err != nil || store.Has(ns, big) {
+			t.Errorf("link=%v: Add big file=>%v, Has=>%v", link, err, store.Has(ns, big))
+		}
+	}
+}
+
+func TestBlobStoreNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mycp-blob-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenBlobStore(filepath.Join(dir, "blobs"), 1<<20, 1, true)
+	if err != nil {
+		t.Fatalf("OpenBlobStore fail=>%v", err)
+	}
+	alice, bob := BlobNamespace("/home/alice"), BlobNamespace("/home/bob")
+	if alice == bob || alice != BlobNamespace("/home/alice/") || !isBlobNamespace(alice) {
+		t.Fatalf("BlobNamespace=>%q, %q", alice, bob)
+	}
+
+	filePath := filepath.Join(dir, "a")
+	sum := writeBlobFile(t, filePath, 'a', 100)
+	if err := store.Add(alice, filePath, sum, 100); err != nil {
+		t.Fatalf("Add fail=>%v", err)
+	}
+	if !store.Has(alice, sum) || store.Has(bob, sum) {
+		t.Fatalf("Has=>%v, %v", store.Has(alice, sum), store.Has(bob, sum))
+	}
+	_, err = store.WriteFile(bob, sum, filepath.Join(dir, "b"), true)
+	if !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("WriteFile from another namespace=>%v", err)
+	}
+	// 非法的分区不存入
+	if err := store.Add("../x", filePath, sum, 100); err != nil || store.Has("../x", sum) {
+		t.Fatalf("Add with bad namespace=>%v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package mycpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mycp/util"
+	"os"
+	"sort"
+	"time"
+)
+
+// ConfigFileName 是服务端配置文件的默认文件名, 位于可执行文件 mycpserver 所在路径下
+var ConfigFileName = "mycpserver.json"
+
+// Config 是服务端的配置文件. 所有字段都可以省略, 省略时使用命令行参数或者默认值. 比如
+//
+//	{
+//	    "Listen": ["0.0.0.0:31001"],
+//	    "Root": "/data/mycp",
+//	    "Users": {"alice": {"Salt": "...", "Iterations": 100000, "Verifier": "...", "Root": "/home/alice"}},
+//	    "Limits": {"IdleTimeout": "1m", "MaxInFlight": 64},
+//	    "TLS": {"CertFile": "cert.pem", "KeyFile": "key.pem"},
+//	    "Log": {"File": "/var/log/mycpserver.log"},
+//	    "Admin": {"Listen": "127.0.0.1:31002"},
+//	    "Metrics": {"Listen": "10.0.0.1:9101"}
+//	}
+//
+// Users 由 mycpserver passwd 维护.
+type Config struct {
+	Listen    []string         `json:",omitempty"` // 监听的地址, 可以有多个
+	Root      string           `json:",omitempty"` // 没有配置 Root 的用户只能访问这个路径下的文件, 为空表示不限制
+	Users     map[string]*User // 为空时使用 mycp_password.txt 中的旧式密码
+	ExecAllow []string         // 允许远端执行的命令, 不为 nil 时代替 mycp_exec_allow.txt
+	PushAllow []string         // 允许推送到的地址, 不为 nil 时代替 mycp_push_allow.txt
+	Limits    Limits
+	TLS       TLSConfig
+	Log       LogConfig
+	Admin     AdminConfig
+	Metrics   MetricsConfig
+	Audit     AuditConfig
+	Blobs     BlobConfig
+	// 保存同步清单的路径, 见 ManifestStore. 为空时使用可执行文件所在路径下的 ManifestDirName, "-" 表示不保存清单
+	ManifestDir string `json:",omitempty"`
+}
+
+// User 是一个用户. 不保存密码本身, 也不保存由密码和盐得到的密钥 K, 只保存 K 的 util.KeyVerifier.
+// 认证时客户端要出示 K, 所以读到配置文件的人不能冒充用户.
+type User struct {
+	Salt       string // hex
+	Iterations int
+	Verifier   string `json:",omitempty"` // hex, util.KeyVerifier(K), K 是 util.DeriveKey(密码, Salt, Iterations)
+	// hex, K 本身. 以前的版本保存它, 不发送 Hello.Nonce 的旧客户端需要它才能登录.
+	// mycpserver passwd --drop-keys 把它换成 Verifier
+	Key  string `json:",omitempty"`
+	Root string // 这个用户只能访问这个路径下的文件, 为空时使用 Config.Root
+}
+
+// key 返回保存的 K, 只保存了 Verifier 时返回空
+func (user *User) key() string {
+	key, _ := hex.DecodeString(user.Key)
+	return string(key)
+}
+
+// verifier 返回 util.KeyVerifier(K), 以前的配置文件中只有 Key, 由它计算
+func (user *User) verifier() []byte {
+	if user.Verifier == "" {
+		return util.KeyVerifier(user.key())
+	}
+	verifier, _ := hex.DecodeString(user.Verifier)
+	return verifier
+}
+
+// Limits 覆盖 serverconn.Options 中对应的值以及同名的命令行参数的默认值, 零值表示不覆盖
+type Limits struct {
+	PingInterval        Duration
+	IdleTimeout         Duration
+	MaxInFlight         int
+	MaxFrameSize        uint64
+	MaxPreAuthFrameSize uint64
+	ShutdownTimeout     Duration // 收到 SIGINT/SIGTERM 后最多等这么久让处理中的请求结束
+
+	// 以下覆盖 Server 中的同名字段
+	MaxConns          int
+	MaxConnsPerIP     int
+	Workers           int
+	MaxWorkersPerConn int
+}
+
+// TLSConfig 配置后所有地址都以 TLS 监听, 客户端需要在 profile 中配置证书的 TLSPin
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+// AuditConfig 配置审计日志, 见 AuditLog
+type AuditConfig struct {
+	File       string // 为空时不记录
+	MaxSize    int64  // 超过这么多字节时轮转, 0 表示 DefaultAuditMaxSize, 负数表示不按大小轮转
+	MaxBackups int    // 最多保留这么多个轮转后的文件, 0 表示 DefaultAuditMaxBackups
+}
+
+// BlobConfig 配置去重缓存, 见 BlobStore
+type BlobConfig struct {
+	Dir         string // 为空时不开启
+	MaxSize     int64  // 所有 blob 的总字节数的上限, 0 表示 DefaultBlobMaxSize
+	MinFileSize int64  // 小于这么多字节的文件不存入, 0 表示 DefaultBlobMinFileSize
+	Link        bool   // 用硬链接代替拷贝, 见 BlobStore.Link
+}
+
+type AdminConfig struct {
+	Listen string // 管理接口监听的本机地址, 比如 "127.0.0.1:31002", 为空时不提供管理接口
+}
+
+type MetricsConfig struct {
+	Listen string // 以 HTTP 提供 Prometheus 格式的 /metrics 的地址, 为空时不提供. 不需要认证
+}
+
+type LogConfig struct {
+	File   string // 日志追加写入这个文件, 为空时写 stderr
+	Level  string `json:",omitempty"` // debug, info, warn 或 error, 为空时使用 --log-level
+	Format string `json:",omitempty"` // text 或 json, 为空时使用 --log-format
+}
+
+// Duration 在 json 中写成 "5s", "1m" 这样的字符串
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\"=>%w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// DefaultConfigPath 返回可执行文件所在路径下的 ConfigFileName
+func DefaultConfigPath() (configPath string, err error) {
+	return binFilePath(ConfigFileName)
+}
+
+// ManifestDirName 是默认保存同步清单的路径名, 位于可执行文件 mycpserver 所在路径下
+var ManifestDirName = "mycp_manifests"
+
+// DefaultManifestDir 返回可执行文件所在路径下的 ManifestDirName
+func DefaultManifestDir() (dir string, err error) {
+	return binFilePath(ManifestDirName)
+}
+
+// LoadConfig 读配置文件, 文件不存在时返回空的配置
+func LoadConfig(configPath string) (config *Config, err error) {
+	config = &Config{}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("ReadFile fail=>%w", err)
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal %s fail=>%w", configPath, err)
+	}
+	for name, user := range config.Users {
+		if user == nil || user.Iterations <= 0 {
+			return nil, fmt.Errorf("user %s of %s is invalid, set its password by mycpserver passwd", name, configPath)
+		}
+		if _, err := hex.DecodeString(user.Salt); err != nil {
+			return nil, fmt.Errorf("Salt of user %s is invalid=>%w", name, err)
+		}
+		if user.Verifier == "" && user.Key == "" {
+			return nil, fmt.Errorf("user %s of %s has no Verifier, set its password by mycpserver passwd", name, configPath)
+		}
+		if verifier, err := hex.DecodeString(user.Verifier); err != nil || (user.Verifier != "" && len(verifier) != sha256.Size) {
+			return nil, fmt.Errorf("Verifier of user %s is invalid", name)
+		}
+		if key, err := hex.DecodeString(user.Key); err != nil || (user.Key != "" && len(key) != util.KeyLen) {
+			return nil, fmt.Errorf("Key of user %s is invalid", name)
+		}
+	}
+	return config, nil
+}
+
+// WriteConfig 把 config 写入 configPath, 先写临时文件再 rename. 文件中的 Verifier 能解密窃听到的连接, 新建时只有所有者可读写.
+func WriteConfig(configPath string, config *Config) (err error) {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Marshal fail=>%w", err)
+	}
+	return util.WriteFileAtomic(configPath, append(data, '\n'), 0600)
+}
+
+// SetPassword 设置用户 name 的密码, 用户不存在时创建. 密码可以是任意长度, 但不能为空.
+func (config *Config) SetPassword(name, password string, iterations int) (err error) {
+	if password == "" {
+		return errors.New("empty password")
+	}
+	if iterations <= 0 {
+		iterations = util.DefaultIterations
+	}
+	salt, err := util.GenSalt(util.SaltLen)
+	if err != nil {
+		return err
+	}
+	if config.Users == nil {
+		config.Users = make(map[string]*User)
+	}
+	user, ok := config.Users[name]
+	if !ok {
+		user = &User{}
+		config.Users[name] = user
+	}
+	user.Salt = hex.EncodeToString(salt)
+	user.Iterations = iterations
+	user.Verifier = hex.EncodeToString(util.KeyVerifier(util.DeriveKey(password, salt, iterations)))
+	user.Key = ""
+	return nil
+}
+
+// DropKeys 把以前的版本保存的 Key 换成 Verifier, 返回修改了的用户名. 之后不发送 Hello.Nonce 的旧客户端不能再登录这些用户
+func (config *Config) DropKeys() (names []string) {
+	for _, name := range config.UserNames() {
+		user := config.Users[name]
+		if user.Key == "" {
+			continue
+		}
+		user.Verifier = hex.EncodeToString(user.verifier())
+		user.Key = ""
+		names = append(names, name)
+	}
+	return names
+}
+
+// UserNames 返回排好序的用户名
+func (config *Config) UserNames() (names []string) {
+	for name := range config.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
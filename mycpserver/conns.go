@@ -0,0 +1,190 @@
+package mycpserver
+
+import (
+	"errors"
+	"fmt"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// connEntry 是连接登记表中的一项
+type connEntry struct {
+	id         uint64
+	serverConn *serverconn.ServerConn
+
+	activeCnt int64        // 这个连接上正在处理的请求数
+	op        atomic.Value // string, 最近开始处理的请求
+}
+
+// ConnInfo 是一个连接的快照, 由管理接口以 json 返回
+type ConnInfo struct {
+	ID         uint64
+	RemoteAddr string
+	User       string
+	StartTime  time.Time
+	BytesIn    uint64
+	BytesOut   uint64
+	Active     int64  // 正在处理的请求数
+	Op         string // 最近开始处理的请求, Active 为 0 时是已经处理完的
+}
+
+// addConn 检查连接数限制, 为 conn 创建 ServerConn 并登记, 连接关闭时自动删除.
+// 连接上的请求交给 scheduler 排队.
+func (server *Server) addConn(conn net.Conn) (err error) {
+	ip := remoteIP(conn.RemoteAddr())
+	if backoff := server.authLimiter.blocked(ip); backoff > 0 {
+		server.metrics.connsRejected.inc(`reason="auth_backoff"`)
+		return fmt.Errorf("too many auth failures from %s, retry after %v", ip, backoff)
+	}
+	server.connsMutex.Lock()
+	defer server.connsMutex.Unlock()
+	if server.MaxConns > 0 && len(server.conns) >= server.MaxConns {
+		server.metrics.connsRejected.inc(`reason="max_conns"`)
+		return fmt.Errorf("too many conns, max=>%d", server.MaxConns)
+	}
+	if server.MaxConnsPerIP > 0 {
+		var ipConnCnt int
+		for serverConn := range server.conns {
+			if remoteIP(serverConn.RemoteAddr()) == ip {
+				ipConnCnt++
+			}
+		}
+		if ipConnCnt >= server.MaxConnsPerIP {
+			server.metrics.connsRejected.inc(`reason="max_conns_per_ip"`)
+			return fmt.Errorf("too many conns from %s, max=>%d", ip, server.MaxConnsPerIP)
+		}
+	}
+
+	requestCh := make(chan *serverconn.Request)
+	serverConn, err := serverconn.NewServerConn(server.StopCtx, conn, requestCh, server.ConnOptions)
+	if err != nil {
+		return err
+	}
+	entry := &connEntry{
+		id:         serverConn.ID,
+		serverConn: serverConn,
+	}
+	entry.op.Store("")
+	server.conns[serverConn] = entry
+	atomic.AddUint64(&server.metrics.connsAccepted, 1)
+	mycplog.With("conn", entry.id).Infof("new conn. remote=>%v", serverConn.RemoteAddr())
+	if server.IsShuttingDown() {
+		// Shutdown 可能已经遍历过 conns 了
+		serverConn.Shutdown()
+	}
+	go func() {
+		for {
+			select {
+			case request := <-requestCh:
+				server.sched.push(request)
+			case <-serverConn.StopCtx.Done():
+				server.sched.removeConn(serverConn)
+				server.connsMutex.Lock()
+				delete(server.conns, serverConn)
+				atomic.AddUint64(&server.metrics.closedBytesIn, serverConn.BytesIn())
+				atomic.AddUint64(&server.metrics.closedBytesOut, serverConn.BytesOut())
+				server.connsMutex.Unlock()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// remoteIP 返回地址中的 ip, 没有端口时返回整个地址
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// trackOp 在请求所在连接的登记项中记下正在处理的请求, 返回的函数在处理完后调用
+func (server *Server) trackOp(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage) (done func()) {
+	server.connsMutex.Lock()
+	entry, ok := server.conns[request.Conn()]
+	server.connsMutex.Unlock()
+	if !ok {
+		return func() {}
+	}
+	entry.op.Store(describeOp(myCPPackage))
+	atomic.AddInt64(&entry.activeCnt, 1)
+	return func() {
+		atomic.AddInt64(&entry.activeCnt, -1)
+	}
+}
+
+// describeOp 返回请求的简短描述, 比如 "cp-put /work/a.txt"
+func describeOp(myCPPackage *mycpproto.MyCPPackage) string {
+	switch myCPPackage.Op {
+	case mycpproto.MyCPOpCP:
+		if myCPPackage.Direction == mycpproto.DirectionRemoteIsSrc {
+			return "cp-get " + myCPPackage.SrcPath
+		}
+		return "cp-put " + myCPPackage.DstPath
+	case mycpproto.MyCPOpAuth:
+		return myCPPackage.Op.String()
+	case mycpproto.MyCPOpRename:
+		return fmt.Sprintf("%v %s %s", myCPPackage.Op, myCPPackage.SrcPath, myCPPackage.DstPath)
+	case mycpproto.MyCPOpPush:
+		return fmt.Sprintf("%v %s %s:%s", myCPPackage.Op, myCPPackage.SrcPath, myCPPackage.PushHost, myCPPackage.DstPath)
+	case mycpproto.MyCPOpStreamGet:
+		return fmt.Sprintf("%v %s", myCPPackage.Op, myCPPackage.SrcPath)
+	case mycpproto.MyCPOpStreamPut:
+		return fmt.Sprintf("%v %s %d", myCPPackage.Op, myCPPackage.DstPath, myCPPackage.Offset)
+	default:
+		return fmt.Sprintf("%v %s", myCPPackage.Op, myCPPackage.DstPath)
+	}
+}
+
+// Conns 返回所有未关闭的连接, 按 ID 排序
+func (server *Server) Conns() (infos []ConnInfo) {
+	server.connsMutex.Lock()
+	defer server.connsMutex.Unlock()
+	for serverConn, entry := range server.conns {
+		info := ConnInfo{
+			ID:         entry.id,
+			RemoteAddr: serverConn.RemoteAddr().String(),
+			StartTime:  serverConn.StartTime,
+			BytesIn:    serverConn.BytesIn(),
+			BytesOut:   serverConn.BytesOut(),
+			Active:     atomic.LoadInt64(&entry.activeCnt),
+			Op:         entry.op.Load().(string),
+		}
+		if sess, ok := serverConn.Session().(*session); ok {
+			info.User = sess.user
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+var errNoSuchConn = errors.New("no such conn")
+
+// KillConn 立即关闭 ID 为 id 的连接, 连接上正在处理的请求的 Context 被取消
+func (server *Server) KillConn(id uint64) (err error) {
+	server.connsMutex.Lock()
+	var target *serverconn.ServerConn
+	for serverConn, entry := range server.conns {
+		if entry.id == id {
+			target = serverConn
+			break
+		}
+	}
+	server.connsMutex.Unlock()
+	if target == nil {
+		return errNoSuchConn
+	}
+	mycplog.With("conn", id).Infof("kill conn. remote=>%v", target.RemoteAddr())
+	target.Close()
+	return nil
+}
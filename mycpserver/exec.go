@@ -0,0 +1,195 @@
+package mycpserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	execChunkSize         = 32 * 1024
+	execHeartbeatInterval = 10 * time.Second // 命令长时间没有输出 (或者推送时) 也要发中间响应, 避免客户端请求超时
+)
+
+// LoadExecAllowList 加载可执行文件所在路径下的 mycp_exec_allow.txt, 每行一个允许执行的命令,
+// 空行和 # 开头的行被忽略, * 表示允许任何命令. 文件不存在时不允许执行任何命令.
+func (server *Server) LoadExecAllowList() (err error) {
+	allowList, err := loadAllowList("mycp_exec_allow.txt")
+	if err != nil {
+		return err
+	}
+	server.ExecAllowList = allowList
+	return nil
+}
+
+// loadAllowList 读取可执行文件所在路径下的白名单文件 fileName, 每行一项, 空行和 # 开头的行被忽略.
+// 文件不存在时返回空的白名单.
+func loadAllowList(fileName string) (allowList []string, err error) {
+	allowFilePath, err := binFilePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	allowFile, err := os.Open(allowFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Open fail=>%w", err)
+	}
+	defer allowFile.Close()
+
+	scanner := bufio.NewScanner(allowFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allowList = append(allowList, line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("read allow list fail=>%w", err)
+	}
+	return allowList, nil
+}
+
+func (server *Server) execAllowed(program string) bool {
+	for _, allowed := range server.ExecAllowList {
+		if allowed == "*" || allowed == program {
+			return true
+		}
+	}
+	return false
+}
+
+// MyCPExec 在 myCPPackage.DstPath 下执行 myCPPackage.ExecArgs (不经过 shell), stdout 和 stderr
+// 在产生时以中间响应的形式发给客户端, 最终响应中带退出码. 连接断开时命令被 kill.
+func (server *Server) MyCPExec(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage, password string) {
+	logger := request.Logger()
+	args := myCPPackage.ExecArgs
+	myCPPackage.ExecArgs = nil
+	myCPPackage.ExitCode = -1
+	if len(args) == 0 {
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = "no command"
+		return
+	}
+	if !server.execAllowed(args[0]) {
+		logger.Warnf("exec not allowed=>%s", args[0])
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = fmt.Sprintf("command %q not in allow list", args[0])
+		return
+	}
+
+	dir := myCPPackage.DstPath
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		logger.Warnf("os.Stat fail=>%v", err)
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = err.Error()
+		return
+	}
+	if !dirInfo.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	logger.Infof("be to exec=>%q in %s", args, dir)
+	cmd := exec.CommandContext(request.Context(), args[0], args[1:]...)
+	cmd.Dir = dir
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = err.Error()
+		return
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = err.Error()
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		logger.Warnf("Start fail=>%v", err)
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = err.Error()
+		return
+	}
+
+	// 两个 pipe 的输出汇总到 outputCh, 由当前 goroutine 依次发送
+	outputCh := make(chan *mycpproto.MyCPPackage)
+	readPipe := func(pipe io.Reader, stream mycpproto.ExecStreamT) {
+		for {
+			buf := make([]byte, execChunkSize)
+			n, err := pipe.Read(buf)
+			if n > 0 {
+				outputCh <- &mycpproto.MyCPPackage{
+					Op:         mycpproto.MyCPOpExec,
+					Status:     mycpproto.MyCPPackageStatusSucc,
+					ExecStream: stream,
+					Data:       buf[:n],
+				}
+			}
+			if err != nil {
+				outputCh <- nil
+				return
+			}
+		}
+	}
+	go readPipe(stdoutPipe, mycpproto.ExecStreamStdout)
+	go readPipe(stderrPipe, mycpproto.ExecStreamStderr)
+
+	heartbeat := time.NewTicker(execHeartbeatInterval)
+	defer heartbeat.Stop()
+	var streaming = true
+	for pipeCnt := 2; pipeCnt > 0; {
+		var partial *mycpproto.MyCPPackage
+		select {
+		case partial = <-outputCh:
+			if partial == nil {
+				pipeCnt--
+				continue
+			}
+		case <-heartbeat.C:
+			partial = &mycpproto.MyCPPackage{
+				Op:         mycpproto.MyCPOpExec,
+				Status:     mycpproto.MyCPPackageStatusSucc,
+				ExecStream: mycpproto.ExecStreamNone,
+			}
+		}
+		if !streaming {
+			// 连接已断开, 只需要把 pipe 读完
+			continue
+		}
+		pkgEncoded, err := json.Marshal(partial)
+		if err != nil {
+			logger.Warnf("Marshal fail=>%v", err)
+			continue
+		}
+		streaming = request.Stream(util.Encrypt(pkgEncoded, password))
+	}
+
+	err = cmd.Wait()
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			myCPPackage.ExitCode = exitErr.ExitCode()
+		} else {
+			logger.Warnf("Wait fail=>%v", err)
+			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			myCPPackage.ErrMsg = err.Error()
+		}
+	} else {
+		myCPPackage.ExitCode = 0
+	}
+	logger.Infof("exec done. exitCode=>%d", myCPPackage.ExitCode)
+}
@@ -0,0 +1,115 @@
+package mycpserver
+
+import (
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"os"
+	"path/filepath"
+)
+
+// 以下是远端文件管理的操作, 失败时 Status 为 MyCPPackageStatusFail, 原因在 ErrMsg 中
+
+func myFileInfo(info os.FileInfo) mycpproto.MyFileInfo {
+	return mycpproto.MyFileInfo{
+		Name:    info.Name(),
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+}
+
+func fail(myCPPackage *mycpproto.MyCPPackage, err error) {
+	myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+	myCPPackage.ErrMsg = err.Error()
+	myCPPackage.ErrCode = mycpproto.ErrorCode(err)
+}
+
+func MyCPRemove(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) {
+	var err error
+	logger.Infof("be to remove=>%s, recursive=>%v", myCPPackage.DstPath, myCPPackage.Recursive)
+	if myCPPackage.Recursive {
+		err = os.RemoveAll(myCPPackage.DstPath)
+	} else {
+		err = os.Remove(myCPPackage.DstPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warnf("remove fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+func MyCPList(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) {
+	fileInfos, err := ioutil.ReadDir(myCPPackage.DstPath)
+	if err != nil {
+		logger.Warnf("ioutil.ReadDir fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.MyFileInfoSlice = make([]mycpproto.MyFileInfo, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		myCPPackage.MyFileInfoSlice = append(myCPPackage.MyFileInfoSlice, myFileInfo(info))
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+func MyCPStat(myCPPackage *mycpproto.MyCPPackage) {
+	info, err := os.Stat(myCPPackage.DstPath)
+	if err != nil {
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.MyFileInfoSlice = []mycpproto.MyFileInfo{myFileInfo(info)}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+func MyCPMkdir(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) {
+	var err error
+	logger.Infof("be to mkdir=>%s, parents=>%v", myCPPackage.DstPath, myCPPackage.Recursive)
+	if myCPPackage.Recursive {
+		err = os.MkdirAll(myCPPackage.DstPath, 0775)
+	} else {
+		err = os.Mkdir(myCPPackage.DstPath, 0775)
+	}
+	if err != nil {
+		logger.Warnf("mkdir fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+func MyCPRename(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) {
+	logger.Infof("be to rename=>%s to %s", myCPPackage.SrcPath, myCPPackage.DstPath)
+	err := os.Rename(myCPPackage.SrcPath, myCPPackage.DstPath)
+	if err != nil {
+		logger.Warnf("rename fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+// MyCPGlob 展开通配符 DstPath, 匹配到的完整路径按顺序放在 MyFileInfoSlice 的 Name 中
+func MyCPGlob(myCPPackage *mycpproto.MyCPPackage) {
+	matches, err := filepath.Glob(myCPPackage.DstPath)
+	if err != nil {
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.MyFileInfoSlice = make([]mycpproto.MyFileInfo, 0, len(matches))
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			// 展开后被删除
+			continue
+		}
+		myFileInfo := myFileInfo(info)
+		myFileInfo.Name = filepath.ToSlash(match)
+		myCPPackage.MyFileInfoSlice = append(myCPPackage.MyFileInfoSlice, myFileInfo)
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
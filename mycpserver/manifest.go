@@ -0,0 +1,492 @@
+package mycpserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	manifestChunkSize = 10000 // MyCPOpManifest 的一个中间响应中最多的项数
+
+	DefaultMaxManifests = 1000 // ManifestStore.MaxManifests 为 0 时最多保存的清单数
+)
+
+// ManifestEntry 是清单中的一个文件
+type ManifestEntry struct {
+	Path    string // 相对于树根的路径, 以 '/' 分隔
+	Size    int64
+	ModTime time.Time
+	SHA256  string // 文件内容的 sha256, hex
+}
+
+// manifestFile 是 ManifestStore.Dir 下一个清单文件的内容
+type manifestFile struct {
+	Root    string
+	Partial bool `json:",omitempty"` // 见 manifest.partial
+	Entries []*ManifestEntry
+}
+
+// manifest 是一棵树的清单
+type manifest struct {
+	root    string
+	partial bool // 只包含经由 mycp 写入的文件, 刷新时只检查已有的项, 不遍历整棵树
+
+	refreshMu sync.Mutex // 同一时刻只有一个 refresh, 遍历期间一直持有
+
+	mu       sync.Mutex // 保护以下字段, 不在遍历期间持有, Record 不用等刷新结束
+	entries  map[string]*ManifestEntry
+	dirty    bool                      // 有没有写入文件的改动
+	recorded map[string]*ManifestEntry // 刷新期间 Record 的项, 刷新结束时以它们为准; 不在刷新时为 nil
+	evicted  bool                      // 已经被 ManifestStore 删掉, 不再写入文件
+
+	lastUsed time.Time // 最近一次取清单或者 Record 的时间, 由 ManifestStore.mu 保护
+}
+
+// ManifestStore 为每棵同步过的目标树 (客户端取过清单的树) 保存一份清单: 每个文件的路径, 大小, 修改时间和 sha256.
+// 任何客户端都可以取得清单并由此算出需要发送的文件, 不依赖客户端本地保存的上次 mycp 时间.
+//
+// 清单相当于文件内容的 sha256 的缓存: 取清单时遍历整棵树, 大小和修改时间都没有变的文件沿用清单中的 sha256,
+// 其他文件重新计算, 所以树被 mycp 以外的方式修改之后清单仍然准确. 经由 mycp 写入的文件在写入时由 Record 记入清单,
+// 下次取清单时不用重新计算. 每个清单保存为 Dir 下的一个 json 文件, 文件名是树根的 sha256.
+//
+// 已经存在的树要遍历整棵树才能得到完整的清单, 所以只有调用方允许时才这样做, 否则只记录之后经由 mycp 写入的文件,
+// 见 Manifest. 最多保存 MaxManifests 个清单, 超过时删掉最久没有用过的.
+type ManifestStore struct {
+	Dir          string
+	MaxManifests int // 0 表示 DefaultMaxManifests
+
+	mu        sync.Mutex
+	manifests map[string]*manifest // key 是 filepath.Clean 之后的树根
+}
+
+// OpenManifestStore 打开保存在路径 dir 下的清单, dir 不存在时创建. 无法解析的清单文件被跳过.
+func OpenManifestStore(dir string) (store *ManifestStore, err error) {
+	err = os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Glob fail=>%w", err)
+	}
+	store = &ManifestStore{Dir: dir, manifests: make(map[string]*manifest)}
+	for _, file := range files {
+		m, err := loadManifest(file)
+		if err != nil {
+			mycplog.Warnf("skip manifest %s=>%v", file, err)
+			continue
+		}
+		store.manifests[m.root] = m
+	}
+	return store, nil
+}
+
+func loadManifest(file string) (m *manifest, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat fail=>%w", err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile fail=>%w", err)
+	}
+	content := &manifestFile{}
+	err = json.Unmarshal(data, content)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal fail=>%w", err)
+	}
+	if content.Root == "" {
+		return nil, errors.New("no root")
+	}
+	m = &manifest{root: filepath.Clean(content.Root), partial: content.Partial, entries: make(map[string]*ManifestEntry, len(content.Entries)), lastUsed: info.ModTime()}
+	for _, entry := range content.Entries {
+		m.entries[entry.Path] = entry
+	}
+	return m, nil
+}
+
+// file 返回树根 root 的清单文件
+func (store *ManifestStore) file(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(store.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// save 在清单有改动时写入清单文件, 调用时持有 m.mu
+func (store *ManifestStore) save(m *manifest) (err error) {
+	if !m.dirty || m.evicted {
+		return nil
+	}
+	data, err := json.Marshal(&manifestFile{Root: m.root, Partial: m.partial, Entries: m.sorted()})
+	if err != nil {
+		return fmt.Errorf("Marshal fail=>%w", err)
+	}
+	err = util.WriteFileAtomic(store.file(m.root), data, 0640)
+	if err != nil {
+		return fmt.Errorf("write manifest of %s fail=>%w", m.root, err)
+	}
+	m.dirty = false
+	return nil
+}
+
+// sorted 返回按路径排序的所有项, 调用时持有 m.mu
+func (m *manifest) sorted() (entries []*ManifestEntry) {
+	entries = make([]*ManifestEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// Manifest 刷新并返回以 root 为根的树的清单, 按路径排序. root 不存在时返回空的清单.
+// 第一次取 root 的清单之后, 开始为它保存清单. root 已经存在但还没有清单时, 只有 walk 为 true 才遍历整棵树,
+// 否则新建的清单是空的, 只记录之后经由 mycp 写入的文件, 不让客户端随便让服务端计算一棵大树 (比如 /) 中所有文件的 sha256.
+func (store *ManifestStore) Manifest(ctx context.Context, root string, walk bool) (entries []*ManifestEntry, err error) {
+	root = filepath.Clean(root)
+	m := store.get(root, walk)
+
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+	err = m.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = store.save(m)
+	if err != nil {
+		return nil, err
+	}
+	return m.sorted(), nil
+}
+
+// get 返回 root 的清单, 没有时新建, 清单太多时先删掉最久没有用过的. 见 Manifest 中的 walk
+func (store *ManifestStore) get(root string, walk bool) (m *manifest) {
+	partial := false
+	if !walk {
+		_, err := os.Lstat(root)
+		partial = !os.IsNotExist(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	m, ok := store.manifests[root]
+	if !ok {
+		store.evict()
+		m = &manifest{root: root, partial: partial, entries: make(map[string]*ManifestEntry), dirty: true}
+		store.manifests[root] = m
+	}
+	m.lastUsed = time.Now()
+	return m
+}
+
+// evict 删掉最久没有用过的清单, 直到能再放下一个. 调用时持有 store.mu
+func (store *ManifestStore) evict() {
+	max := store.MaxManifests
+	if max <= 0 {
+		max = DefaultMaxManifests
+	}
+	for len(store.manifests) >= max {
+		var oldest *manifest
+		for _, m := range store.manifests {
+			if oldest == nil || m.lastUsed.Before(oldest.lastUsed) {
+				oldest = m
+			}
+		}
+		delete(store.manifests, oldest.root)
+		oldest.mu.Lock()
+		oldest.evicted = true
+		oldest.mu.Unlock()
+		err := os.Remove(store.file(oldest.root))
+		if err != nil && !os.IsNotExist(err) {
+			mycplog.Warnf("remove manifest of %s fail=>%v", oldest.root, err)
+		}
+		mycplog.Infof("evict manifest of %s", oldest.root)
+	}
+}
+
+// refresh 遍历整棵树 (partial 时只检查已有的项), 让清单与树中的文件一致. 只计算新的, 或者大小和修改时间变了的文件的 sha256.
+// 遍历期间不持有 m.mu, 这期间 Record 的文件以 Record 的为准. 调用时持有 m.refreshMu
+func (m *manifest) refresh(ctx context.Context) (err error) {
+	m.mu.Lock()
+	old := make(map[string]*ManifestEntry, len(m.entries))
+	for rel, entry := range m.entries {
+		old[rel] = entry
+	}
+	m.recorded = make(map[string]*ManifestEntry)
+	m.mu.Unlock()
+
+	var entries map[string]*ManifestEntry
+	var changed bool
+	if m.partial {
+		entries, changed, err = checkManifest(ctx, m.root, old)
+	} else {
+		entries, changed, err = walkManifest(ctx, m.root, old)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recorded := m.recorded
+	m.recorded = nil
+	if err != nil {
+		return err
+	}
+	for rel, entry := range recorded {
+		entries[rel] = entry
+	}
+	m.entries = entries
+	if changed {
+		m.dirty = true
+	}
+	return nil
+}
+
+// walkManifest 遍历以 root 为根的树, 返回其中每个文件的项. 大小和修改时间与 old 中相同的文件沿用 old 中的项,
+// changed 表示结果与 old 是否不同. 跳过文件和路径以外的类型.
+func walkManifest(ctx context.Context, root string, old map[string]*ManifestEntry) (entries map[string]*ManifestEntry, changed bool, err error) {
+	entries = make(map[string]*ManifestEntry, len(old))
+	rootInfo, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		// 还没有同步过, 或者整棵树被删掉了
+		return entries, len(old) > 0, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("os.Stat fail=>%w", err)
+	}
+	if !rootInfo.IsDir() {
+		return nil, false, fmt.Errorf("%s is not a dir", root)
+	}
+
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		entry, ok := old[rel]
+		if ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			entries[rel] = entry
+			return nil
+		}
+		sum, err := fileSum(filePath)
+		if os.IsNotExist(err) {
+			// 遍历期间被删掉了
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entries[rel] = &ManifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("walk %s fail=>%w", root, err)
+	}
+	if len(entries) != len(old) {
+		changed = true
+	}
+	return entries, changed, nil
+}
+
+// checkManifest 与 walkManifest 相同, 但只检查 old 中的文件, 不在 old 中的文件不会加入清单
+func checkManifest(ctx context.Context, root string, old map[string]*ManifestEntry) (entries map[string]*ManifestEntry, changed bool, err error) {
+	entries = make(map[string]*ManifestEntry, len(old))
+	for rel, entry := range old {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		filePath := filepath.Join(root, filepath.FromSlash(rel))
+		info, err := os.Lstat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			// 被删掉了, 或者不再是文件
+			changed = true
+			continue
+		}
+		if entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			entries[rel] = entry
+			continue
+		}
+		sum, err := fileSum(filePath)
+		if os.IsNotExist(err) {
+			changed = true
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		entries[rel] = &ManifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+		changed = true
+	}
+	return entries, changed, nil
+}
+
+// fileSum 返回文件 filePath 的内容的 sha256, hex
+func fileSum(filePath string) (sum string, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hr := util.NewHashReader(file)
+	_, err = io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return "", fmt.Errorf("read %s fail=>%w", filePath, err)
+	}
+	return hex.EncodeToString(hr.Sum()), nil
+}
+
+// Record 在文件 filePath 所在的每个清单中记下它刚刚写入的内容的 sha256 sum, 大小和修改时间取自文件本身,
+// 所以要在设置修改时间之后调用. filePath 不在任何清单的树中, 或者 store 为 nil 时什么也不做.
+func (store *ManifestStore) Record(filePath string, sum string) {
+	if store == nil || sum == "" {
+		return
+	}
+	filePath = filepath.Clean(filePath)
+	var ms []*manifest
+	store.mu.Lock()
+	for root, m := range store.manifests {
+		if filePath != root && underPath(filePath, root) {
+			m.lastUsed = time.Now()
+			ms = append(ms, m)
+		}
+	}
+	store.mu.Unlock()
+	if len(ms) == 0 {
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	for _, m := range ms {
+		rel, err := filepath.Rel(m.root, filePath)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		entry := &ManifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+		m.mu.Lock()
+		m.entries[rel] = entry
+		if m.recorded != nil {
+			m.recorded[rel] = entry
+		}
+		m.dirty = true
+		m.mu.Unlock()
+	}
+}
+
+// Flush 把有改动的清单写入清单文件. Record 只修改内存中的清单, 需要在退出前调用 Flush;
+// 没来得及写入的改动只会让下次取清单时重新计算这些文件的 sha256.
+func (store *ManifestStore) Flush() (err error) {
+	store.mu.Lock()
+	ms := make([]*manifest, 0, len(store.manifests))
+	for _, m := range store.manifests {
+		ms = append(ms, m)
+	}
+	store.mu.Unlock()
+	for _, m := range ms {
+		m.mu.Lock()
+		saveErr := store.save(m)
+		m.mu.Unlock()
+		if saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// MyCPManifest 刷新并返回以 DstPath 为根的树的清单. 清单以中间响应的形式分段发出, 每段最多 manifestChunkSize 项,
+// 刷新期间 (可能要计算很多文件的 sha256) 定时发出不带清单的中间响应作为心跳. 最终响应不带清单.
+// 只有配置了 Root 的用户 (DstPath 已经被限制在 Root 下) 新建已经存在的树的清单时才遍历整棵树, 见 ManifestStore.Manifest.
+func (server *Server) MyCPManifest(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage, password string) {
+	logger := request.Logger()
+	if server.Manifests == nil {
+		fail(myCPPackage, errors.New("manifests are disabled on the server"))
+		return
+	}
+
+	sess := server.session(request)
+	walk := sess != nil && sess.root != ""
+	doneCh := make(chan error, 1)
+	var entries []*ManifestEntry
+	go func() {
+		var err error
+		entries, err = server.Manifests.Manifest(request.Context(), myCPPackage.DstPath, walk)
+		doneCh <- err
+	}()
+	heartbeat := time.NewTicker(execHeartbeatInterval)
+	defer heartbeat.Stop()
+	var err error
+	for waiting := true; waiting; {
+		select {
+		case err = <-doneCh:
+			waiting = false
+		case <-heartbeat.C:
+			streamManifest(request, password, nil)
+		}
+	}
+	if err != nil {
+		logger.Warnf("Manifest fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+
+	logger.Debugf("manifest of %s=>%d files", myCPPackage.DstPath, len(entries))
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > manifestChunkSize {
+			n = manifestChunkSize
+		}
+		infos := make([]mycpproto.MyFileInfo, 0, n)
+		for _, entry := range entries[:n] {
+			infos = append(infos, mycpproto.MyFileInfo{Name: entry.Path, Size: entry.Size, ModTime: entry.ModTime, SHA256: entry.SHA256})
+		}
+		entries = entries[n:]
+		if !streamManifest(request, password, infos) {
+			fail(myCPPackage, errStreamConnClosed)
+			return
+		}
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+// streamManifest 发出带有清单中的 infos 的中间响应, 连接已关闭时返回 false
+func streamManifest(request *serverconn.Request, password string, infos []mycpproto.MyFileInfo) (ok bool) {
+	pkgEncoded, err := json.Marshal(&mycpproto.MyCPPackage{
+		Op:              mycpproto.MyCPOpManifest,
+		Status:          mycpproto.MyCPPackageStatusSucc,
+		MyFileInfoSlice: infos,
+	})
+	if err != nil {
+		request.Logger().Warnf("Marshal fail=>%v", err)
+		return true
+	}
+	return request.Stream(util.Encrypt(pkgEncoded, password))
+}
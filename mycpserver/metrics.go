@@ -0,0 +1,226 @@
+package mycpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestDurationBuckets 是请求处理时间的直方图的上界, 单位秒
+var requestDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// metrics 是导出给 Prometheus 的计数. 连接数, 排队的请求数这样的当前值在 WriteMetrics 时再取
+type metrics struct {
+	connsAccepted    uint64
+	authFailures     uint64
+	droppedResponses uint64
+	auditFailures    uint64
+
+	// 已关闭的连接上收发的字节数, 加上未关闭的连接上的就是总数
+	closedBytesIn  uint64
+	closedBytesOut uint64
+
+	connsRejected   counterVec   // reason
+	requests        counterVec   // op, direction, status
+	requestDuration histogramVec // op
+}
+
+// counterVec 是带标签的计数, key 是格式化好的标签, 比如 `op="cp",status="succ"`
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (vec *counterVec) inc(labels string) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	if vec.values == nil {
+		vec.values = make(map[string]uint64)
+	}
+	vec.values[labels]++
+}
+
+func (vec *counterVec) write(w io.Writer, name string) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	for _, labels := range sortedKeys(vec.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, vec.values[labels])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶的计数, 不累加
+	sum    float64
+	count  uint64
+}
+
+// histogramVec 是带标签的直方图, 桶是 requestDurationBuckets
+type histogramVec struct {
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+func (vec *histogramVec) observe(labels string, value float64) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	if vec.histograms == nil {
+		vec.histograms = make(map[string]*histogram)
+	}
+	h, ok := vec.histograms[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(requestDurationBuckets))}
+		vec.histograms[labels] = h
+	}
+	for idx, bound := range requestDurationBuckets {
+		if value <= bound {
+			h.counts[idx]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (vec *histogramVec) write(w io.Writer, name string) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	var labelsList []string
+	for labels := range vec.histograms {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Strings(labelsList)
+	for _, labels := range labelsList {
+		h := vec.histograms[labels]
+		var cumulative uint64
+		for idx, bound := range requestDurationBuckets {
+			cumulative += h.counts[idx]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requestDirection 返回请求中数据流动的方向: get 是从服务端到客户端, put 是从客户端到服务端
+func requestDirection(myCPPackage *mycpproto.MyCPPackage) string {
+	switch myCPPackage.Op {
+	case mycpproto.MyCPOpCP:
+		if myCPPackage.Direction == mycpproto.DirectionRemoteIsSrc {
+			return "get"
+		}
+		return "put"
+	case mycpproto.MyCPOpStreamGet:
+		return "get"
+	case mycpproto.MyCPOpStreamPut:
+		return "put"
+	case mycpproto.MyCPOpPush:
+		return "push"
+	}
+	return "none"
+}
+
+// observeRequest 在请求处理完后记录结果和处理时间
+func (m *metrics) observeRequest(myCPPackage *mycpproto.MyCPPackage, start time.Time) {
+	op := myCPPackage.Op.String()
+	m.requests.inc(fmt.Sprintf("op=%q,direction=%q,status=%q", op, requestDirection(myCPPackage), myCPPackage.Status.String()))
+	m.requestDuration.observe(fmt.Sprintf("op=%q", op), time.Since(start).Seconds())
+}
+
+// WriteMetrics 以 Prometheus 的文本格式输出所有指标
+func (server *Server) WriteMetrics(out io.Writer) (err error) {
+	m := server.metrics
+	w := bufio.NewWriter(out)
+
+	var activeConns int
+	var bytesIn, bytesOut uint64
+	server.connsMutex.Lock()
+	for serverConn := range server.conns {
+		activeConns++
+		bytesIn += serverConn.BytesIn()
+		bytesOut += serverConn.BytesOut()
+	}
+	// 在锁内读, 这样连接关闭时不会被算两次或者漏算
+	bytesIn += atomic.LoadUint64(&m.closedBytesIn)
+	bytesOut += atomic.LoadUint64(&m.closedBytesOut)
+	server.connsMutex.Unlock()
+
+	writeHeader := func(name, metricType, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	}
+	writeHeader("mycp_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(w, "mycp_connections_accepted_total %d\n", atomic.LoadUint64(&m.connsAccepted))
+	writeHeader("mycp_connections_rejected_total", "counter", "Connections closed at once because of connection limits.")
+	m.connsRejected.write(w, "mycp_connections_rejected_total")
+	writeHeader("mycp_connections_active", "gauge", "Connections not closed yet.")
+	fmt.Fprintf(w, "mycp_connections_active %d\n", activeConns)
+	writeHeader("mycp_auth_failures_total", "counter", "Requests that could not be decrypted, usually a wrong password or an unknown user.")
+	fmt.Fprintf(w, "mycp_auth_failures_total %d\n", atomic.LoadUint64(&m.authFailures))
+	writeHeader("mycp_requests_total", "counter", "Requests processed, by op, direction of the data and status.")
+	m.requests.write(w, "mycp_requests_total")
+	writeHeader("mycp_request_duration_seconds", "histogram", "Time spent processing a request, by op.")
+	m.requestDuration.write(w, "mycp_request_duration_seconds")
+	writeHeader("mycp_bytes_received_total", "counter", "Bytes read from connections, including frame headers.")
+	fmt.Fprintf(w, "mycp_bytes_received_total %d\n", bytesIn)
+	writeHeader("mycp_bytes_sent_total", "counter", "Bytes written to connections, including frame headers.")
+	fmt.Fprintf(w, "mycp_bytes_sent_total %d\n", bytesOut)
+	writeHeader("mycp_responses_dropped_total", "counter", "Responses not sent because the connection was closed.")
+	fmt.Fprintf(w, "mycp_responses_dropped_total %d\n", atomic.LoadUint64(&m.droppedResponses))
+	writeHeader("mycp_queued_requests", "gauge", "Requests waiting for a worker.")
+	fmt.Fprintf(w, "mycp_queued_requests %d\n", server.sched.pending())
+	writeHeader("mycp_busy_workers", "gauge", "Workers processing a request.")
+	fmt.Fprintf(w, "mycp_busy_workers %d\n", atomic.LoadInt64(&server.activeCnt))
+	writeHeader("mycp_workers", "gauge", "Size of the worker pool.")
+	fmt.Fprintf(w, "mycp_workers %d\n", server.Workers)
+	if server.AuditLog != nil {
+		writeHeader("mycp_audit_write_failures_total", "counter", "Audit records that could not be written.")
+		fmt.Fprintf(w, "mycp_audit_write_failures_total %d\n", atomic.LoadUint64(&m.auditFailures))
+	}
+	if server.Blobs != nil {
+		blobCount, blobSize := server.Blobs.Stats()
+		writeHeader("mycp_blobs", "gauge", "Blobs in the deduplication store.")
+		fmt.Fprintf(w, "mycp_blobs %d\n", blobCount)
+		writeHeader("mycp_blob_bytes", "gauge", "Total size of the blobs in the deduplication store.")
+		fmt.Fprintf(w, "mycp_blob_bytes %d\n", blobSize)
+		writeHeader("mycp_blob_hits_total", "counter", "Files written from the deduplication store instead of being transferred.")
+		fmt.Fprintf(w, "mycp_blob_hits_total %d\n", atomic.LoadUint64(&server.Blobs.hits))
+		writeHeader("mycp_blob_misses_total", "counter", "Offered hashes not found in the deduplication store.")
+		fmt.Fprintf(w, "mycp_blob_misses_total %d\n", atomic.LoadUint64(&server.Blobs.misses))
+		writeHeader("mycp_blob_evictions_total", "counter", "Blobs removed because the deduplication store was full.")
+		fmt.Fprintf(w, "mycp_blob_evictions_total %d\n", atomic.LoadUint64(&server.Blobs.evictions))
+	}
+	return w.Flush()
+}
+
+// ListenMetrics 在 host 上以 HTTP 提供 /metrics, 直到 server 被 Close. 不需要认证, 不要监听公网地址
+func (server *Server) ListenMetrics(host string) (err error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := server.WriteMetrics(w)
+		if err != nil {
+			mycplog.Warnf("WriteMetrics fail=>%v", err)
+		}
+	})
+	err = server.serveHTTP(host, mux)
+	if err != nil {
+		return err
+	}
+	mycplog.Infof("metrics listening on %s", host)
+	return nil
+}
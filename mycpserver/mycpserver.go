@@ -2,11 +2,16 @@ package mycpserver
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"mycp/mycplog"
 	"mycp/mycpproto"
 	"mycp/serverconn"
 	"mycp/util"
@@ -14,18 +19,57 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	processCnt int
-	requestCh  chan *serverconn.Request
+	Workers           int // 处理请求的协程数, 在第一次 Serve 时启动
+	MaxWorkersPerConn int // 一个连接同时最多占用的处理协程数, 0 表示 Workers-1 (至少 1)
+	MaxConns          int // 最多同时有这么多个连接, 0 表示不限制
+	MaxConnsPerIP     int // 来自同一个 ip 的连接最多有这么多个, 0 表示不限制
+
+	sched     *scheduler
+	startOnce sync.Once
+
+	metrics *metrics
 
 	NeedAuth bool
-	Password string
+	Password string // 没有配置 Users 时所有客户端共用的密码
+
+	// 由 Password 得到的密钥. Password 是 16 字节时直接作为密钥, passwordSalt 为空
+	passwordKey        string
+	passwordSalt       []byte
+	passwordIterations int
+
+	Users       map[string]*User // 配置文件中的用户, 不为空时不使用 Password
+	Root        string           // 没有配置 Root 的用户只能访问这个路径下的文件, 为空表示不限制
+	TLSConfig   *tls.Config      // 不为 nil 时以 TLS 监听
+	helloSecret []byte           // 用于给不存在的用户生成假的盐
+
+	WrongPasswordTimes uint64       // 认证失败的总次数
+	authLimiter        *authLimiter // 认证失败太多的 ip 在一段时间内不能再连接和认证
+
+	ConnOptions *serverconn.Options
+
+	ExecAllowList []string // 允许 MyCPOpExec 执行的命令, 为空表示不允许执行任何命令
+	PushAllowList []string // 允许 MyCPOpPush 推送到的地址, 为空表示不允许推送
+
+	AuditLog *AuditLog // 不为 nil 时记录每个文件的读写, 创建路径等操作
+
+	Manifests *ManifestStore // 不为 nil 时为同步过的树保存清单, 见 mycpproto.MyCPOpManifest
+	Blobs     *BlobStore     // 不为 nil 时开启去重缓存
+
+	putStreams      map[string]*putStream // 正在上传的流, key 是 StreamID
+	putStreamsMutex sync.Mutex
 
-	WrongPasswordTimes uint64
+	listeners     map[net.Listener]struct{}
+	httpListeners []net.Listener                        // 管理接口和 metrics 的 listener, 关闭过程中仍然可用, Close 时才关闭
+	conns         map[*serverconn.ServerConn]*connEntry // 所有未关闭的连接
+	connsMutex    sync.Mutex
+	activeCnt     int64 // 正在处理的请求数
+	shuttingDown  uint64
 
 	StopCtx  context.Context
 	StopFunc context.CancelFunc
@@ -35,61 +79,115 @@ type Server struct {
 
 func NewServer() (server *Server) {
 	server = &Server{
-		processCnt: 4,
-		NeedAuth:   true,
+		Workers:     4,
+		sched:       newScheduler(1),
+		metrics:     &metrics{},
+		NeedAuth:    true,
+		ConnOptions: serverconn.DefaultOptions(),
+		putStreams:  make(map[string]*putStream),
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[*serverconn.ServerConn]*connEntry),
+		authLimiter: newAuthLimiter(),
 	}
+	server.helloSecret, _ = util.GenSalt(32)
 	server.StopCtx, server.StopFunc = context.WithCancel(context.Background())
-	server.requestCh = make(chan *serverconn.Request)
-	for idx := 0; idx < server.processCnt; idx++ {
+	return
+}
+
+// startWorkers 按 Workers 和 MaxWorkersPerConn 启动处理协程
+func (server *Server) startWorkers() {
+	if server.Workers < 1 {
+		server.Workers = 1
+	}
+	maxRunningPerConn := server.MaxWorkersPerConn
+	if maxRunningPerConn <= 0 {
+		maxRunningPerConn = server.Workers - 1
+	}
+	if maxRunningPerConn < 1 {
+		maxRunningPerConn = 1
+	}
+	server.sched.mu.Lock()
+	server.sched.maxRunningPerConn = maxRunningPerConn
+	server.sched.mu.Unlock()
+	mycplog.Infof("workers=>%d, max workers per conn=>%d", server.Workers, maxRunningPerConn)
+	for idx := 0; idx < server.Workers; idx++ {
 		go server.GoProcess(idx)
 	}
-	return
 }
 
 func (server *Server) GoProcess(goID int) {
 	defer server.Close()
-	var request *serverconn.Request
-	var ok bool
 	for !server.IsClosed() {
-		select {
-		case request, ok = <-server.requestCh:
-			if !ok {
-				log.Printf("requestCh closed, GoProcess(%d) end", goID)
-				return
-			}
-
-			dropped := MyCP(request, server)
-			if dropped {
-				continue
-			}
-
-			request.Done()
-		case <-server.StopCtx.Done():
+		request := server.sched.next()
+		if request == nil {
+			mycplog.Infof("server closed, GoProcess(%d) end", goID)
 			return
 		}
+		atomic.AddInt64(&server.activeCnt, 1)
+		dropped := MyCP(request, server)
+		if dropped {
+			request.Drop()
+		} else if !request.Done() {
+			atomic.AddUint64(&server.metrics.droppedResponses, 1)
+		}
+		server.sched.done(request)
+		atomic.AddInt64(&server.activeCnt, -1)
 	}
 }
 
 func (server *Server) Start(host string) (err error) {
-	var listener net.Listener
-	listener, err = net.Listen("tcp", host)
+	listener, err := server.Listen(host)
 	if err != nil {
-		log.Printf("Listen fail=>%v", err)
+		mycplog.Warnf("Listen fail=>%v", err)
 		return
 	}
-	log.Printf("listening on %s", host)
+	return server.Serve(listener)
+}
+
+// Listen 监听 host, 配置了 TLSConfig 时以 TLS 监听
+func (server *Server) Listen(host string) (listener net.Listener, err error) {
+	listener, err = net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if server.TLSConfig != nil {
+		listener = tls.NewListener(listener, server.TLSConfig)
+	}
+	mycplog.Infof("listening on %s, tls=>%v", host, server.TLSConfig != nil)
+	return listener, nil
+}
+
+// Serve 在 listener 上接受连接, 直到 server 开始关闭. 正常关闭时返回 nil
+func (server *Server) Serve(listener net.Listener) (err error) {
+	server.startOnce.Do(server.startWorkers)
+	server.connsMutex.Lock()
+	server.listeners[listener] = struct{}{}
+	server.connsMutex.Unlock()
+	defer func() {
+		server.connsMutex.Lock()
+		delete(server.listeners, listener)
+		server.connsMutex.Unlock()
+		_ = listener.Close()
+	}()
 
 	var conn net.Conn
-	for !server.IsClosed() {
+	for !server.IsShuttingDown() {
 		conn, err = listener.Accept()
 		if err != nil {
-			log.Printf("Accept fail=>%v", err)
+			if server.IsShuttingDown() {
+				break
+			}
+			mycplog.Warnf("Accept fail=>%v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		log.Printf("=============================")
-		log.Printf("new conn: local=>%v, remote=>%v", conn.LocalAddr(), conn.RemoteAddr())
-		_, _ = serverconn.NewServerConn(server.StopCtx, conn, server.requestCh) // ServerConn 是什么时候 gc 的?
+		mycplog.Debugf("=============================")
+		mycplog.Debugf("new conn: local=>%v, remote=>%v", conn.LocalAddr(), conn.RemoteAddr())
+		err = server.addConn(conn)
+		if err != nil {
+			mycplog.Warnf("reject conn=>%v", err)
+			_ = conn.Close()
+		}
 	}
 	return nil
 }
@@ -98,81 +196,261 @@ func (server *Server) IsClosed() bool {
 	return atomic.LoadUint64(&server.closed) == 1
 }
 
+// IsShuttingDown 在 Shutdown 或 Close 之后返回 true, 此时不再接受新的连接和请求
+func (server *Server) IsShuttingDown() bool {
+	return atomic.LoadUint64(&server.shuttingDown) == 1
+}
+
+// stopAccepting 标记开始关闭并关闭所有 listener, 让 Serve 返回
+func (server *Server) stopAccepting() {
+	atomic.StoreUint64(&server.shuttingDown, 1)
+	server.connsMutex.Lock()
+	defer server.connsMutex.Unlock()
+	for listener := range server.listeners {
+		_ = listener.Close()
+	}
+}
+
+// Close 立即关闭 server: 关闭所有 listener 和连接, 正在处理的请求的 Context 被取消
 func (server *Server) Close() {
+	server.stopAccepting()
 	if atomic.CompareAndSwapUint64(&server.closed, 0, 1) {
-		close(server.requestCh)
+		server.StopFunc()
+		server.sched.close()
+		server.connsMutex.Lock()
+		for _, listener := range server.httpListeners {
+			_ = listener.Close()
+		}
+		server.connsMutex.Unlock()
+	}
+}
+
+// Shutdown 优雅地关闭 server: 停止接受新连接, 拒绝新的请求, 等处理中的请求和上传中的流结束,
+// 发完响应后关闭所有连接. ctx 结束时不再等待, 直接 Close 并返回 ctx.Err().
+func (server *Server) Shutdown(ctx context.Context) (err error) {
+	server.stopAccepting()
+	defer server.Close()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !server.isIdle() {
+		select {
+		case <-ctx.Done():
+			mycplog.Warnf("shutdown timeout, %d requests still in process", atomic.LoadInt64(&server.activeCnt))
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	server.connsMutex.Lock()
+	var conns []*serverconn.ServerConn
+	for serverConn := range server.conns {
+		conns = append(conns, serverConn)
+	}
+	server.connsMutex.Unlock()
+	for _, serverConn := range conns {
+		serverConn.Shutdown()
+	}
+	for _, serverConn := range conns {
+		select {
+		case <-serverConn.StopCtx.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// isIdle 返回是否没有正在处理或排队的请求和上传中的流
+func (server *Server) isIdle() bool {
+	server.putStreamsMutex.Lock()
+	putStreamCnt := len(server.putStreams)
+	server.putStreamsMutex.Unlock()
+	return atomic.LoadInt64(&server.activeCnt) == 0 && server.sched.pending() == 0 && putStreamCnt == 0
+}
+
+// isStreamContinuation 判断请求是不是已经开始上传的流的后续部分, 关闭过程中仍然处理这样的请求
+func (server *Server) isStreamContinuation(myCPPackage *mycpproto.MyCPPackage) bool {
+	if myCPPackage.Op != mycpproto.MyCPOpStreamPut || (myCPPackage.Offset == 0 && !myCPPackage.Abort) {
+		return false
 	}
+	server.putStreamsMutex.Lock()
+	defer server.putStreamsMutex.Unlock()
+	_, ok := server.putStreams[myCPPackage.StreamID]
+	return ok
 }
 
-func (server *Server) LoadPassword() (err error) {
+// binFilePath 返回可执行文件所在路径下名为 fileName 的文件的路径
+func binFilePath(fileName string) (filePath string, err error) {
 	binDir, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("os.Executable fail=>%w", err)
+		return "", fmt.Errorf("os.Executable fail=>%w", err)
 	}
 	binDir, err = filepath.Abs(filepath.Dir(binDir))
 	if err != nil {
-		return fmt.Errorf("fail to get bin dir=>%w", err)
+		return "", fmt.Errorf("fail to get bin dir=>%w", err)
 	}
-	passwordFileName := "mycp_password.txt"
-	passwordFilePath := fmt.Sprintf("%s/%s", binDir, passwordFileName)
-	passwordFile, err := os.Open(passwordFilePath)
+	return fmt.Sprintf("%s/%s", binDir, fileName), nil
+}
+
+// LoadPassword 从可执行文件所在路径下的 mycp_password.txt 读密码 (去掉结尾的换行), 密码可以是任意长度.
+// 文件不存在或者为空时生成一个随机的 16 字节密码, 此时 generated 为 true. 只在没有配置 Users 时使用.
+func (server *Server) LoadPassword() (generated bool, err error) {
+	passwordFilePath, err := binFilePath("mycp_password.txt")
+	if err != nil {
+		return false, err
+	}
+	data, err := ioutil.ReadFile(passwordFilePath)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("Open fail=>%w", err)
+		return false, fmt.Errorf("ReadFile fail=>%w", err)
 	}
-	passwordLen := 16
-	var password string
-	if err == nil {
-		defer passwordFile.Close()
-		pwd := make([]byte, passwordLen)
-		n, err := passwordFile.Read(pwd)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("Read passwordFile fail=>%w", err)
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		password, generated = util.GenPassword(16), true
+	}
+	var salt []byte
+	if len(password) != 16 {
+		saltFilePath, err := binFilePath(PasswordSaltFileName)
+		if err != nil {
+			return false, err
 		}
-		if 0 < n && n < passwordLen {
-			return fmt.Errorf("len of password from password file is invalid. len=>%d, pwd=>%s", n, pwd)
+		salt, err = loadPasswordSalt(saltFilePath)
+		if err != nil {
+			return false, err
 		}
-		if n >= passwordLen {
-			password = string(pwd)
-		} else {
-			password = util.GenPassword(passwordLen)
+	}
+	err = server.SetPassword(password, salt)
+	if err != nil {
+		return false, err
+	}
+	return generated, nil
+}
+
+// PasswordSaltFileName 保存 mycp_password.txt 中的密码不是 16 字节时使用的盐 (hex), 与它在同一路径下.
+// 盐保存下来, 这样服务端重启后密钥不变, 客户端重连后重发的请求仍然能被解密
+var PasswordSaltFileName = "mycp_password_salt.txt"
+
+// loadPasswordSalt 读 saltFilePath 中的盐, 文件不存在时生成一个随机的盐并写入.
+// 写入失败时仍然使用生成的盐, 只是服务端重启后密钥会变
+func loadPasswordSalt(saltFilePath string) (salt []byte, err error) {
+	data, err := ioutil.ReadFile(saltFilePath)
+	if err == nil {
+		salt, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(salt) < util.SaltLen {
+			return nil, fmt.Errorf("bad salt in %s, want %d hex bytes", saltFilePath, util.SaltLen)
 		}
-	} else {
-		// 如果文件不存在
-		password = util.GenPassword(passwordLen)
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ReadFile fail=>%w", err)
 	}
+	salt, err = util.GenSalt(util.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	err = util.WriteFileAtomic(saltFilePath, []byte(hex.EncodeToString(salt)+"\n"), 0600)
+	if err != nil {
+		mycplog.Warnf("save password salt fail, the key will change after restart=>%v", err)
+	}
+	return salt, nil
+}
+
+// SetPassword 设置所有客户端共用的密码. 16 字节的密码直接作为密钥, 与以前的版本兼容, 不使用 salt;
+// 其他长度的密码由 salt 得到密钥, 客户端通过 Hello 取得这个盐. salt 为空时生成一个随机的盐.
+func (server *Server) SetPassword(password string, salt []byte) (err error) {
 	server.Password = password
+	if len(password) == 16 {
+		server.passwordKey, server.passwordSalt, server.passwordIterations = password, nil, 0
+		return nil
+	}
+	if len(salt) == 0 {
+		salt, err = util.GenSalt(util.SaltLen)
+		if err != nil {
+			return err
+		}
+	}
+	server.passwordSalt, server.passwordIterations = salt, util.DefaultIterations
+	server.passwordKey = util.DeriveKey(password, salt, util.DefaultIterations)
 	return nil
 }
 
+// authFailed 记一次密码错误并关闭连接. 同一个 ip 错误的次数太多时在一段时间内拒绝它, 不影响其他客户端
+func (server *Server) authFailed(request *serverconn.Request) (dropped bool) {
+	request.CloseConn()
+	atomic.AddUint64(&server.metrics.authFailures, 1)
+	wrongPasswordTimes := atomic.AddUint64(&server.WrongPasswordTimes, 1)
+	ip := remoteIP(request.Conn().RemoteAddr())
+	backoff := server.authLimiter.failed(ip)
+	if backoff > 0 {
+		request.Logger().Warnf("too many auth failures from %s, reject it for %v. wrongPasswordTimes=>%d", ip, backoff, wrongPasswordTimes)
+	} else {
+		request.Logger().Warnf("wrongPasswordTimes=>%d", wrongPasswordTimes)
+	}
+	return true
+}
+
 func MyCP(request *serverconn.Request, server *Server) (dropped bool) {
-	password := server.Password
+	if !request.Conn().IsAuthenticated() {
+		// 被拒绝之前已经建立的连接也不能再尝试认证
+		ip := remoteIP(request.Conn().RemoteAddr())
+		if backoff := server.authLimiter.blocked(ip); backoff > 0 {
+			request.Logger().Warnf("too many auth failures from %s, close conn. retry after=>%v", ip, backoff)
+			request.CloseConn()
+			return true
+		}
+	}
+	if isHello(request.Pkg) {
+		return server.MyCPHello(request)
+	}
+	logger := request.Logger()
+	sess := server.session(request)
+	if sess == nil {
+		logger.Warnf("fail=>no hello before the first request")
+		request.CloseConn()
+		return true
+	}
+	password := sess.key
+	if password == "" {
+		logger.Warnf("fail=>user %q has no stored key, the client is too old to log in", sess.user)
+		return server.authFailed(request)
+	}
 	// 解码
 	pkgDecryted, err := util.Decrypt(request.Pkg, password)
 	if err != nil {
-		log.Printf("Decrypt fail=>%v", err)
-		dropped = true
-		atomic.AddUint64(&server.WrongPasswordTimes, 1)
-		log.Printf("wrongPasswordTimes=>%d", atomic.LoadUint64(&server.WrongPasswordTimes))
-		wrongPasswordTimes := atomic.LoadUint64(&server.WrongPasswordTimes)
-		if wrongPasswordTimes >= 5 {
-			log.Fatalf("wrongPasswordTimes beyond max times, exit now.")
-		}
-		return
+		logger.Warnf("Decrypt fail=>%v", err)
+		return server.authFailed(request)
 	}
 	myCPPackage := &mycpproto.MyCPPackage{}
 	err = json.Unmarshal(pkgDecryted, myCPPackage)
 	if err != nil {
-		log.Printf("json.Unmarshal fail=>%v", err)
+		logger.Warnf("json.Unmarshal fail=>%v", err)
 		dropped = true
+		request.CloseConn()
 		return
 	}
+	if sess.verifier != nil && atomic.LoadUint32(&sess.proven) == 0 {
+		// 能解密只说明对方知道 Verifier, 还要出示 K
+		sum := sha256.Sum256(myCPPackage.AuthProof)
+		if myCPPackage.Op != mycpproto.MyCPOpAuth || subtle.ConstantTimeCompare(sum[:], sess.verifier) != 1 {
+			logger.Warnf("fail=>op %v without a valid AuthProof", myCPPackage.Op)
+			return server.authFailed(request)
+		}
+		atomic.StoreUint32(&sess.proven, 1)
+	}
+	myCPPackage.AuthProof = nil
+	request.SetAuthenticated()
+	defer func(start time.Time) {
+		logger.Debugf("op=>%v, src=>%s, dst=>%s, status=>%v, cost=>%v", myCPPackage.Op, myCPPackage.SrcPath, myCPPackage.DstPath, myCPPackage.Status, time.Since(start))
+	}(time.Now())
+	defer server.metrics.observeRequest(myCPPackage, time.Now())
+	defer server.trackOp(request, myCPPackage)()
 
 	// 编码
 	defer func() {
 		if !dropped {
 			pkgEncoded, err := json.Marshal(myCPPackage)
 			if err != nil {
-				log.Printf("Marshal fail=>%v", err)
+				logger.Warnf("Marshal fail=>%v", err)
 				dropped = true
 				return
 			}
@@ -180,27 +458,106 @@ func MyCP(request *serverconn.Request, server *Server) (dropped bool) {
 		}
 	}()
 
-	if myCPPackage.Direction == mycpproto.DirectionRemoteIsSrc {
-		MyCPFromRemoteToLocal(myCPPackage)
-	} else {
-		MyCPFromLocalToRemote(myCPPackage)
+	err = confinePaths(sess.root, myCPPackage)
+	if err != nil {
+		logger.Warnf("confinePaths fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+
+	if server.IsShuttingDown() && !server.isStreamContinuation(myCPPackage) {
+		logger.Warnf("server shutting down, reject op=>%v", myCPPackage.Op)
+		myCPPackage.Data = nil
+		myCPPackage.Status = mycpproto.MyCPPackageStatusShuttingDown
+		myCPPackage.ErrMsg = "server shutting down"
+		return
+	}
+
+	switch myCPPackage.Op {
+	case mycpproto.MyCPOpAuth:
+		// 能解密就说明密码正确
+		myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+	case mycpproto.MyCPOpExec:
+		server.MyCPExec(request, myCPPackage, password)
+	case mycpproto.MyCPOpRemove:
+		MyCPRemove(logger, myCPPackage)
+		server.audit(request, &AuditRecord{Op: AuditOpRemove, Path: myCPPackage.DstPath}, packageErr(myCPPackage))
+	case mycpproto.MyCPOpList:
+		MyCPList(logger, myCPPackage)
+	case mycpproto.MyCPOpStat:
+		MyCPStat(myCPPackage)
+	case mycpproto.MyCPOpMkdir:
+		MyCPMkdir(logger, myCPPackage)
+		server.audit(request, &AuditRecord{Op: AuditOpMkdir, Path: myCPPackage.DstPath}, packageErr(myCPPackage))
+	case mycpproto.MyCPOpRename:
+		MyCPRename(logger, myCPPackage)
+		server.audit(request, &AuditRecord{Op: AuditOpRename, Path: myCPPackage.SrcPath, To: myCPPackage.DstPath}, packageErr(myCPPackage))
+	case mycpproto.MyCPOpGlob:
+		MyCPGlob(myCPPackage)
+	case mycpproto.MyCPOpStreamPut:
+		server.MyCPStreamPut(request, myCPPackage)
+	case mycpproto.MyCPOpStreamGet:
+		server.MyCPStreamGet(request, myCPPackage, password)
+	case mycpproto.MyCPOpPush:
+		server.MyCPPush(request, myCPPackage, password)
+	case mycpproto.MyCPOpManifest:
+		server.MyCPManifest(request, myCPPackage, password)
+	default:
+		if myCPPackage.Direction == mycpproto.DirectionRemoteIsSrc {
+			MyCPFromRemoteToLocal(logger, myCPPackage)
+			// 路径只是列出其中的文件, 文件的内容由之后的请求读取
+			if !myCPPackage.SrcIsDir && myCPPackage.Status != mycpproto.MyCPPackageStatusNoNeedToCP {
+				server.audit(request, &AuditRecord{
+					Op:     AuditOpRead,
+					Path:   myCPPackage.SrcPath,
+					Bytes:  int64(len(myCPPackage.Data)),
+					SHA256: dataSum(myCPPackage),
+				}, packageErr(myCPPackage))
+			}
+		} else {
+			size, sum := int64(len(myCPPackage.Data)), dataSum(myCPPackage)
+			var realDst string
+			if !myCPPackage.SrcIsDir && myCPPackage.Data == nil && myCPPackage.BlobSHA256 != "" {
+				sum = myCPPackage.BlobSHA256
+				realDst, size = server.MyCPPutBlob(request, myCPPackage)
+				if myCPPackage.Status == mycpproto.MyCPPackageStatusNeedData {
+					// 客户端会再发一次带有内容的请求
+					return
+				}
+			} else {
+				realDst = MyCPFromLocalToRemote(logger, myCPPackage)
+			}
+			if realDst == "" {
+				realDst = myCPPackage.DstPath
+			}
+			if myCPPackage.SrcIsDir {
+				server.audit(request, &AuditRecord{Op: AuditOpMkdir, Path: realDst}, packageErr(myCPPackage))
+			} else {
+				server.audit(request, &AuditRecord{Op: AuditOpWrite, Path: realDst, Bytes: size, SHA256: sum, Deduped: myCPPackage.Deduped}, packageErr(myCPPackage))
+				if myCPPackage.Status == mycpproto.MyCPPackageStatusSucc {
+					myCPPackage.DstPath = realDst
+					server.Manifests.Record(realDst, sum)
+					server.addBlob(request, logger, realDst, sum, size)
+				}
+			}
+		}
 	}
 	return
 }
 
-func MyCPFromRemoteToLocal(myCPPackage *mycpproto.MyCPPackage) {
+func MyCPFromRemoteToLocal(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) {
 	srcFileInfo, err := os.Stat(myCPPackage.SrcPath)
 	if err != nil {
-		log.Printf("os.Stat fail=>%v", err)
-		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		logger.Warnf("os.Stat fail=>%v", err)
+		fail(myCPPackage, fmt.Errorf("os.Stat fail=>%w", err))
 		return
 	}
 	if !srcFileInfo.IsDir() {
 		// 如果 src 是 file, 则 copy 内容
 
 		if myCPPackage.OnlyModified {
-			if srcFileInfo.ModTime().Before(myCPPackage.LastMyCPTime.Add(-mycpproto.TimeAdvanced)) {
-				log.Printf("no need to cp because no modification")
+			if srcFileInfo.ModTime().Before(mycpproto.ModifiedAfter(myCPPackage.SrcLastMyCPTime())) {
+				logger.Debugf("no need to cp because no modification")
 				myCPPackage.Status = mycpproto.MyCPPackageStatusNoNeedToCP
 				return
 			}
@@ -209,8 +566,8 @@ func MyCPFromRemoteToLocal(myCPPackage *mycpproto.MyCPPackage) {
 		myCPPackage.SrcIsDir = false
 		inputFile, err := os.Open(myCPPackage.SrcPath)
 		if err != nil {
-			log.Printf("Open fail=>%v", err)
-			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			logger.Warnf("Open fail=>%v", err)
+			fail(myCPPackage, fmt.Errorf("Open fail=>%w", err))
 			return
 		}
 		defer inputFile.Close()
@@ -219,14 +576,14 @@ func MyCPFromRemoteToLocal(myCPPackage *mycpproto.MyCPPackage) {
 		n, err := inputFile.Read(myCPPackage.Data)
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Read fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+				logger.Warnf("Read fail=>%v", err)
+				fail(myCPPackage, fmt.Errorf("Read fail=>%w", err))
 				return
 			}
 		}
 		if n >= maxSize {
-			log.Printf("file larger than %d Bytes, filename=>%s", maxSize, srcFileInfo.Name())
-			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			logger.Warnf("file larger than %d Bytes, filename=>%s", maxSize, srcFileInfo.Name())
+			fail(myCPPackage, fmt.Errorf("%w, limit %d Bytes", mycpproto.ErrTooLarge, maxSize))
 			return
 		}
 		myCPPackage.Data = myCPPackage.Data[:n]
@@ -239,12 +596,12 @@ func MyCPFromRemoteToLocal(myCPPackage *mycpproto.MyCPPackage) {
 		myCPPackage.SrcIsDir = true
 		fileInfos, err := ioutil.ReadDir(myCPPackage.SrcPath)
 		if err != nil {
-			log.Printf("ioutil.ReadDir fail => %v", err)
-			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			logger.Warnf("ioutil.ReadDir fail => %v", err)
+			fail(myCPPackage, fmt.Errorf("ioutil.ReadDir fail=>%w", err))
 			return
 		}
 		for _, info := range fileInfos {
-			if !info.IsDir() && myCPPackage.OnlyModified && info.ModTime().Before(myCPPackage.LastMyCPTime.Add(-mycpproto.TimeAdvanced)) {
+			if !info.IsDir() && myCPPackage.OnlyModified && info.ModTime().Before(mycpproto.ModifiedAfter(myCPPackage.SrcLastMyCPTime())) {
 				continue
 			}
 			//if strings.HasPrefix(info.Name(), ".") {
@@ -264,110 +621,96 @@ func MyCPFromRemoteToLocal(myCPPackage *mycpproto.MyCPPackage) {
 	}
 }
 
-func MyCPFromLocalToRemote(myCPPackage *mycpproto.MyCPPackage) {
+// MyCPFromLocalToRemote 写入文件或创建路径, 返回实际写入的文件或创建的路径, 失败时可能为空
+func MyCPFromLocalToRemote(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage) (realDst string) {
+	return myCPFromLocalToRemote(logger, myCPPackage, func(realDstFile string) error {
+		err := util.WriteFileAtomic(realDstFile, myCPPackage.Data, 0664)
+		if err != nil {
+			return fmt.Errorf("WriteFileAtomic fail=>%w", err)
+		}
+		logger.Debugf("total write %d Bytes", len(myCPPackage.Data))
+		return nil
+	})
+}
+
+// myCPFromLocalToRemote 与 MyCPFromLocalToRemote 相同, 但源是文件时由 write 写入实际的目标文件
+func myCPFromLocalToRemote(logger *mycplog.Logger, myCPPackage *mycpproto.MyCPPackage, write func(realDstFile string) error) (realDst string) {
 	if !myCPPackage.SrcIsDir {
 		// 源是文件
 		dstPathInfo, err := os.Stat(myCPPackage.DstPath)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				log.Printf("os.Stat fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+				logger.Warnf("os.Stat fail=>%v", err)
+				fail(myCPPackage, fmt.Errorf("os.Stat fail=>%w", err))
 				return
 			}
 		}
 
+		var realDstFile string
 		if os.IsNotExist(err) {
 			// 如果 dst 不存在
 			// 如果 dst 以 / 结尾则当成是路径, 否则视为文件
 
-			log.Printf("myCPPackage.DstPath=>#%v#", myCPPackage.DstPath)
+			logger.Debugf("myCPPackage.DstPath=>#%v#", myCPPackage.DstPath)
 			realDstPath, _ := filepath.Split(myCPPackage.DstPath)
 			if realDstPath != "" {
 				err := os.MkdirAll(realDstPath, 0775)
 				if err != nil {
-					log.Printf("MkdirAll fail=>%v", err)
-					myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+					logger.Warnf("MkdirAll fail=>%v", err)
+					fail(myCPPackage, fmt.Errorf("MkdirAll fail=>%w", err))
 					return
 				}
 			}
-			var realDstFile = myCPPackage.DstPath
+			realDstFile = myCPPackage.DstPath
 			if len(realDstPath) == len(myCPPackage.DstPath) {
 				// 如果 dst 以 / 结尾, 则视为路径
 				_, realSrcFileName := filepath.Split(myCPPackage.SrcPath)
 				realDstFile = fmt.Sprintf("%s/%s", realDstPath, realSrcFileName)
 			}
-
-			log.Printf("be to write=>%s", realDstFile)
-			outputFile, err := os.OpenFile(realDstFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				log.Printf("OpenFile fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
-				return
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(myCPPackage.Data)
-			if err != nil {
-				log.Printf("write fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
-				return
-			}
-			log.Printf("total write %d Bytes", n)
-			myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
 		} else if !dstPathInfo.IsDir() {
 			// dst 存在且是文件
-			log.Printf("be to write=>%s", myCPPackage.DstPath)
-			outputFile, err := os.OpenFile(myCPPackage.DstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				log.Printf("OpenFile fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
-				return
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(myCPPackage.Data)
-			if err != nil {
-				log.Printf("write fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
-				return
-			}
-			log.Printf("total write %d Bytes", n)
-			myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+			realDstFile = myCPPackage.DstPath
 		} else {
 			// dst 存在且是路径
 			_, realSrcFileName := filepath.Split(myCPPackage.SrcPath)
-			dstFileName := fmt.Sprintf("%s/%s", myCPPackage.DstPath, realSrcFileName)
-			log.Printf("be to write=>%s", dstFileName)
-			outputFile, err := os.OpenFile(dstFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
-			if err != nil {
-				log.Printf("OpenFile fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
-				return
-			}
-			defer outputFile.Close()
-			n, err := outputFile.Write(myCPPackage.Data)
+			realDstFile = fmt.Sprintf("%s/%s", myCPPackage.DstPath, realSrcFileName)
+		}
+
+		// 先写临时文件再 rename, 不会留下写了一半的文件
+		realDst = realDstFile
+		logger.Debugf("be to write=>%s", realDstFile)
+		_, statErr := os.Stat(realDstFile)
+		err = write(realDstFile)
+		if err != nil {
+			logger.Warnf("write fail=>%v", err)
+			fail(myCPPackage, err)
+			return
+		}
+		if !myCPPackage.SrcModTime.IsZero() {
+			err = os.Chtimes(realDstFile, myCPPackage.SrcModTime, myCPPackage.SrcModTime)
 			if err != nil {
-				log.Printf("Write fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+				logger.Warnf("Chtimes fail=>%v", err)
+				fail(myCPPackage, fmt.Errorf("Chtimes fail=>%w", err))
 				return
 			}
-			//log.Printf("total write %d Bytes", n)
-			_ = n
-			myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
 		}
+		myCPPackage.Overwritten = statErr == nil
+		myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
 	} else {
 		// 源是路径
 
 		dstPathInfo, err := os.Stat(myCPPackage.DstPath)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				log.Printf("os.Stat fail=>%v", err)
-				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+				logger.Warnf("os.Stat fail=>%v", err)
+				fail(myCPPackage, fmt.Errorf("os.Stat fail=>%w", err))
 				return
 			}
 		}
 
 		if err == nil && !dstPathInfo.IsDir() {
-			log.Printf("fail=>src is dir but dst is file")
-			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			logger.Warnf("fail=>src is dir but dst is file")
+			fail(myCPPackage, errors.New("src is dir but dst is file"))
 			return
 		}
 
@@ -379,11 +722,12 @@ func MyCPFromLocalToRemote(myCPPackage *mycpproto.MyCPPackage) {
 		}
 		_, srcPathLast := filepath.Split(srcPathTrimmed)
 		realDstPath := fmt.Sprintf("%s/%s", myCPPackage.DstPath, srcPathLast)
+		realDst = realDstPath
 
 		err = os.MkdirAll(realDstPath, 0775)
 		if err != nil {
-			log.Printf("os.MkdirAll fail=>%v", err)
-			myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+			logger.Warnf("os.MkdirAll fail=>%v", err)
+			fail(myCPPackage, fmt.Errorf("os.MkdirAll fail=>%w", err))
 			return
 		}
 		myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
@@ -0,0 +1,86 @@
+package mycpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// startTestServer 在本机的随机端口上启动使用 config 的服务端, 测试结束时关闭
+func startTestServer(t *testing.T, config *Config) (server *Server, host string) {
+	server = NewServer()
+	if err := server.ApplyConfig(config); err != nil {
+		t.Fatalf("ApplyConfig fail=>%v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen fail=>%v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Close)
+	return server, listener.Addr().String()
+}
+
+func TestLoadPasswordSalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mycp-salt-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(dir)
+	saltFilePath := filepath.Join(dir, PasswordSaltFileName)
+
+	salt, err := loadPasswordSalt(saltFilePath)
+	if err != nil {
+		t.Fatalf("loadPasswordSalt fail=>%v", err)
+	}
+	if _, err := os.Stat(saltFilePath); err != nil {
+		t.Fatalf("salt not saved=>%v", err)
+	}
+	// 重启后读到同样的盐
+	loaded, err := loadPasswordSalt(saltFilePath)
+	if err != nil || !bytes.Equal(loaded, salt) {
+		t.Fatalf("loadPasswordSalt=>%x, %v, want %x", loaded, err, salt)
+	}
+	// 每次安装的盐都不同
+	other, err := loadPasswordSalt(filepath.Join(dir, "other"))
+	if err != nil || bytes.Equal(other, salt) {
+		t.Fatalf("loadPasswordSalt=>%x, %v", other, err)
+	}
+
+	for _, content := range []string{"", "xyz", "0102"} {
+		if err := ioutil.WriteFile(saltFilePath, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile fail=>%v", err)
+		}
+		if _, err := loadPasswordSalt(saltFilePath); err == nil {
+			t.Errorf("loadPasswordSalt(%q) succeeded", content)
+		}
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	server := NewServer()
+	if err := server.SetPassword("0123456789abcdef", nil); err != nil {
+		t.Fatalf("SetPassword fail=>%v", err)
+	}
+	if server.passwordKey != "0123456789abcdef" || server.passwordSalt != nil {
+		t.Fatalf("16 byte password=>%q, %x", server.passwordKey, server.passwordSalt)
+	}
+
+	salt := bytes.Repeat([]byte{1}, 16)
+	if err := server.SetPassword("long password", salt); err != nil {
+		t.Fatalf("SetPassword fail=>%v", err)
+	}
+	key := server.passwordKey
+	if !bytes.Equal(server.passwordSalt, salt) || key == "long password" {
+		t.Fatalf("salted password=>%q, %x", key, server.passwordSalt)
+	}
+	if err := server.SetPassword("long password", nil); err != nil {
+		t.Fatalf("SetPassword fail=>%v", err)
+	}
+	if len(server.passwordSalt) == 0 || bytes.Equal(server.passwordSalt, salt) || server.passwordKey == key {
+		t.Fatalf("random salt=>%x, key unchanged=>%v", server.passwordSalt, server.passwordKey == key)
+	}
+}
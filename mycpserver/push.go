@@ -0,0 +1,127 @@
+package mycpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"mycp/clientconn"
+	"mycp/mycpclient"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"net"
+	"time"
+)
+
+// LoadPushAllowList 加载可执行文件所在路径下的 mycp_push_allow.txt, 每行一个允许推送到的地址,
+// 格式同 pushAllowed. 文件不存在时不允许推送到任何地址.
+func (server *Server) LoadPushAllowList() (err error) {
+	allowList, err := loadAllowList("mycp_push_allow.txt")
+	if err != nil {
+		return err
+	}
+	server.PushAllowList = allowList
+	return nil
+}
+
+// pushAllowed 判断是否允许推送到 pushHost (host:port). 白名单中的一项可以是 host:port, host:* (任意端口)
+// 或者 * (任意地址). host 按字面比较, 不解析域名.
+func (server *Server) pushAllowed(pushHost string) bool {
+	host, _, err := net.SplitHostPort(pushHost)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range server.PushAllowList {
+		if allowed == "*" || allowed == pushHost {
+			return true
+		}
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err == nil && allowedPort == "*" && allowedHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// MyCPPush 以客户端的身份连接到 myCPPackage.PushHost, 把本地的 SrcPath 拷贝到它的 DstPath,
+// 拷贝规则与 mycp 从本地拷贝到远端相同. 数据不经过发起请求的客户端. 请求所在的连接断开时放弃拷贝.
+func (server *Server) MyCPPush(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage, password string) {
+	pushHost, pushPassword := myCPPackage.PushHost, myCPPackage.PushPassword
+	myCPPackage.PushPassword = ""
+	ctx := request.Context()
+	logger := request.Logger()
+	defer func() {
+		server.audit(request, &AuditRecord{Op: AuditOpPush, Path: myCPPackage.SrcPath, To: pushHost + ":" + myCPPackage.DstPath}, packageErr(myCPPackage))
+	}()
+
+	if !server.pushAllowed(pushHost) {
+		// 否则任何客户端都能让服务端连接它所在网络中的任意地址
+		logger.Warnf("push not allowed=>%s", pushHost)
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = fmt.Sprintf("push host %q not in allow list", pushHost)
+		return
+	}
+	logger.Infof("be to push=>%s to @%s:%s", myCPPackage.SrcPath, pushHost, myCPPackage.DstPath)
+	client, err := mycpclient.NewClientWithOptions(ctx, pushHost, pushPassword, &mycpclient.ClientOptions{
+		OnStateChange: func(state clientconn.ConnState) {
+			logger.Debugf("push connection state=>%v, host=>%s", state, pushHost)
+		},
+		TLSPin: myCPPackage.PushTLSPin,
+		User:   myCPPackage.PushUser,
+	})
+	if err != nil {
+		logger.Warnf("NewClient fail=>%v", err)
+		myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+		myCPPackage.ErrMsg = err.Error()
+		return
+	}
+	defer client.Close()
+
+	var opts = &mycpclient.MyCPOptions{
+		OnlyModified: myCPPackage.OnlyModified,
+		LastMyCPTime: myCPPackage.SrcLastMyCPTime(),
+		Exclude:      myCPPackage.Exclude,
+	}
+	if root := server.session(request).root; root != "" {
+		// confinePaths 只检查了 SrcPath 本身, 拷贝时会跟随路径下的软链接, 所以每一项都要检查
+		opts.Confine = func(srcPath string) (err error) {
+			_, err = confinePath(root, srcPath)
+			return err
+		}
+	}
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- client.MyCPFromLocalToRemote(ctx, myCPPackage.SrcPath, myCPPackage.DstPath, opts)
+	}()
+
+	// 推送期间定时发中间响应, 避免发起请求的客户端超时
+	heartbeat := time.NewTicker(execHeartbeatInterval)
+	defer heartbeat.Stop()
+	var streaming = true
+	for {
+		select {
+		case err = <-doneCh:
+			if err != nil {
+				logger.Warnf("push fail=>%v", err)
+				myCPPackage.Status = mycpproto.MyCPPackageStatusFail
+				myCPPackage.ErrMsg = err.Error()
+				return
+			}
+			logger.Infof("push done=>%s to @%s:%s", myCPPackage.SrcPath, pushHost, myCPPackage.DstPath)
+			myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+			return
+		case <-heartbeat.C:
+			if !streaming {
+				continue
+			}
+			pkgEncoded, err := json.Marshal(&mycpproto.MyCPPackage{
+				Op:     mycpproto.MyCPOpPush,
+				Status: mycpproto.MyCPPackageStatusSucc,
+			})
+			if err != nil {
+				logger.Warnf("Marshal fail=>%v", err)
+				continue
+			}
+			streaming = request.Stream(util.Encrypt(pkgEncoded, password))
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package mycpserver
+
+import (
+	"context"
+	"io/ioutil"
+	"mycp/mycpclient"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPushConfined 检查推送路径时不会跟随源路径下指向 Root 外的软链接
+func TestPushConfined(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "mycp-push-")
+	if err != nil {
+		t.Fatalf("TempDir fail=>%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	aliceRoot, bobRoot, outside := filepath.Join(tmp, "alice"), filepath.Join(tmp, "bob"), filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(aliceRoot, "dir", "sub"), bobRoot, filepath.Join(outside, "etc")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll fail=>%v", err)
+		}
+	}
+	for filePath, content := range map[string]string{
+		filepath.Join(aliceRoot, "dir", "ok.txt"):       "ok",
+		filepath.Join(aliceRoot, "dir", "sub", "a.txt"): "a",
+		filepath.Join(outside, "secret.txt"):            "secret",
+		filepath.Join(outside, "etc", "passwd"):         "root:x:0:0",
+	} {
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile fail=>%v", err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(aliceRoot, "dir", "secret.txt"): filepath.Join(outside, "secret.txt"),
+		filepath.Join(aliceRoot, "dir", "etc"):        filepath.Join(outside, "etc"),
+		filepath.Join(aliceRoot, "dir", "in.txt"):     "ok.txt",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Symlink fail=>%v", err)
+		}
+	}
+
+	config := &Config{
+		Users:     map[string]*User{},
+		PushAllow: []string{"*"},
+	}
+	for name, root := range map[string]string{"alice": aliceRoot, "bob": bobRoot} {
+		if err := config.SetPassword(name, name+"-password", 1); err != nil {
+			t.Fatalf("SetPassword fail=>%v", err)
+		}
+		config.Users[name].Root = root
+	}
+	_, host := startTestServer(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mycpclient.NewClientWithOptions(ctx, host, "alice-password", &mycpclient.ClientOptions{User: "alice"})
+	if err != nil {
+		t.Fatalf("NewClient fail=>%v", err)
+	}
+	defer client.Close()
+	err = client.MyCPFromRemoteToRemote(ctx, "dir", host, "bob-password", &mycpclient.ClientOptions{User: "bob"}, ".", nil)
+	if err == nil {
+		t.Fatalf("push with links to outside the root succeeded")
+	}
+
+	for _, name := range []string{"ok.txt", "in.txt", "sub/a.txt"} {
+		if _, err := os.Stat(filepath.Join(bobRoot, "dir", name)); err != nil {
+			t.Errorf("%s not pushed=>%v", name, err)
+		}
+	}
+	for _, name := range []string{"secret.txt", "etc"} {
+		if _, err := os.Lstat(filepath.Join(bobRoot, "dir", name)); !os.IsNotExist(err) {
+			t.Errorf("%s pushed, err=>%v", name, err)
+		}
+	}
+
+	// 软链接本身作为 SrcPath 时由 confinePaths 拒绝
+	err = client.MyCPFromRemoteToRemote(ctx, "dir/etc", host, "bob-password", &mycpclient.ClientOptions{User: "bob"}, ".", nil)
+	if err == nil {
+		t.Fatalf("push of a link to outside the root succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(bobRoot, "etc")); !os.IsNotExist(err) {
+		t.Errorf("etc pushed, err=>%v", err)
+	}
+}
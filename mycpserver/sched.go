@@ -0,0 +1,138 @@
+package mycpserver
+
+import (
+	"mycp/serverconn"
+	"sync"
+)
+
+// connQueue 是一个连接上等待处理的请求
+type connQueue struct {
+	requests []*serverconn.Request
+	running  int  // 这个连接上正在被处理的请求数
+	ready    bool // 是否在 scheduler.ready 中
+}
+
+// scheduler 在连接之间轮流分配处理协程: 每次取 ready 中第一个连接的第一个请求, 这个连接还有请求时排到队尾.
+// 一个连接同时最多占用 maxRunningPerConn 个处理协程, 所以一个连接上大量的或者很慢的请求不会让其他连接一直等待.
+type scheduler struct {
+	mu                sync.Mutex
+	cond              *sync.Cond
+	queues            map[*serverconn.ServerConn]*connQueue
+	ready             []*serverconn.ServerConn
+	pendingCnt        int
+	maxRunningPerConn int
+	closed            bool
+}
+
+func newScheduler(maxRunningPerConn int) *scheduler {
+	sched := &scheduler{
+		queues:            make(map[*serverconn.ServerConn]*connQueue),
+		maxRunningPerConn: maxRunningPerConn,
+	}
+	sched.cond = sync.NewCond(&sched.mu)
+	return sched
+}
+
+// push 把请求排到所在连接的队列中
+func (sched *scheduler) push(request *serverconn.Request) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	serverConn := request.Conn()
+	queue, ok := sched.queues[serverConn]
+	if !ok {
+		queue = &connQueue{}
+		sched.queues[serverConn] = queue
+	}
+	queue.requests = append(queue.requests, request)
+	sched.pendingCnt++
+	sched.markReady(serverConn, queue)
+}
+
+// markReady 在连接有请求并且没有占满处理协程时把它排到 ready 的队尾, 调用时需要持有 mu
+func (sched *scheduler) markReady(serverConn *serverconn.ServerConn, queue *connQueue) {
+	if queue.ready || len(queue.requests) == 0 || queue.running >= sched.maxRunningPerConn {
+		return
+	}
+	queue.ready = true
+	sched.ready = append(sched.ready, serverConn)
+	sched.cond.Signal()
+}
+
+// next 等待并返回下一个要处理的请求, 处理完后必须调用 done. scheduler 关闭后返回 nil
+func (sched *scheduler) next() (request *serverconn.Request) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	for len(sched.ready) == 0 && !sched.closed {
+		sched.cond.Wait()
+	}
+	if sched.closed {
+		return nil
+	}
+	serverConn := sched.ready[0]
+	sched.ready = sched.ready[1:]
+	queue := sched.queues[serverConn]
+	queue.ready = false
+	request = queue.requests[0]
+	queue.requests[0] = nil
+	queue.requests = queue.requests[1:]
+	queue.running++
+	sched.pendingCnt--
+	sched.markReady(serverConn, queue)
+	return request
+}
+
+// done 表示 next 返回的请求处理完了
+func (sched *scheduler) done(request *serverconn.Request) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	serverConn := request.Conn()
+	queue, ok := sched.queues[serverConn]
+	if !ok {
+		return
+	}
+	queue.running--
+	if queue.running == 0 && len(queue.requests) == 0 && serverConn.IsClosed() {
+		delete(sched.queues, serverConn)
+		return
+	}
+	sched.markReady(serverConn, queue)
+}
+
+// removeConn 丢弃已关闭的连接上还在排队的请求
+func (sched *scheduler) removeConn(serverConn *serverconn.ServerConn) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	queue, ok := sched.queues[serverConn]
+	if !ok {
+		return
+	}
+	sched.pendingCnt -= len(queue.requests)
+	queue.requests = nil
+	if queue.ready {
+		for idx, readyConn := range sched.ready {
+			if readyConn == serverConn {
+				sched.ready = append(sched.ready[:idx], sched.ready[idx+1:]...)
+				break
+			}
+		}
+		queue.ready = false
+	}
+	if queue.running == 0 {
+		delete(sched.queues, serverConn)
+	}
+}
+
+// pending 返回排队中的请求数
+func (sched *scheduler) pending() int {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	return sched.pendingCnt
+}
+
+// close 让所有等待在 next 中的处理协程返回
+func (sched *scheduler) close() {
+	sched.mu.Lock()
+	sched.closed = true
+	sched.mu.Unlock()
+	sched.cond.Broadcast()
+}
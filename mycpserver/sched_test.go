@@ -0,0 +1,158 @@
+package mycpserver
+
+import (
+	"context"
+	"mycp/clientconn"
+	"mycp/serverconn"
+	"net"
+	"testing"
+	"time"
+)
+
+// testRequests 建立 len(counts) 个连接, 在第 i 个连接上依次发送 counts[i] 个请求,
+// 返回服务端收到的请求, 第 i 组是第 i 个连接上的请求, 按发送的顺序. 测试结束时关闭所有连接
+func testRequests(t *testing.T, counts ...int) (requests [][]*serverconn.Request) {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	requestCh := make(chan *serverconn.Request, total)
+	opts := &serverconn.Options{MaxInFlight: total + 1, MaxFrameSize: 1 << 20, MaxPreAuthFrameSize: 1 << 20}
+	requests = make([][]*serverconn.Request, len(counts))
+	for connIdx, count := range counts {
+		clientSide, serverSide := net.Pipe()
+		serverConn, err := serverconn.NewServerConn(context.Background(), serverSide, requestCh, opts)
+		if err != nil {
+			t.Fatalf("NewServerConn fail=>%v", err)
+		}
+		clientConn, err := clientconn.NewClientConn(clientSide, &clientconn.Options{MaxFrameSize: 1 << 20, RequestTimeout: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("NewClientConn fail=>%v", err)
+		}
+		t.Cleanup(serverConn.Close)
+		t.Cleanup(clientConn.Close)
+
+		responseCh := make(chan *clientconn.Request, count)
+		for idx := 0; idx < count; idx++ {
+			clientConn.Send(&clientconn.Request{ResponseCh: responseCh, Pkg: []byte{byte(idx)}})
+		}
+		// 收完这个连接上的请求再建下一个连接, 所以收到的都是这个连接上的, 并且按发送的顺序
+		for idx := 0; idx < count; idx++ {
+			select {
+			case request := <-requestCh:
+				if request.Conn() != serverConn {
+					t.Fatalf("request from another conn")
+				}
+				requests[connIdx] = append(requests[connIdx], request)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("request not received")
+			}
+		}
+	}
+	return requests
+}
+
+// nextWithin 在 d 内返回 sched.next() 的结果, 超时返回 nil
+func nextWithin(sched *scheduler, d time.Duration) *serverconn.Request {
+	nextCh := make(chan *serverconn.Request, 1)
+	go func() {
+		nextCh <- sched.next()
+	}()
+	select {
+	case request := <-nextCh:
+		return request
+	case <-time.After(d):
+		// 让 next 返回, 不留下协程
+		sched.close()
+		<-nextCh
+		return nil
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	requests := testRequests(t, 3, 3, 1)
+	a, b, c := requests[0], requests[1], requests[2]
+	sched := newScheduler(10)
+	for _, group := range requests {
+		for _, request := range group {
+			sched.push(request)
+		}
+	}
+	if sched.pending() != 7 {
+		t.Fatalf("pending=>%d", sched.pending())
+	}
+	for idx, want := range []*serverconn.Request{a[0], b[0], c[0], a[1], b[1], a[2], b[2]} {
+		got := sched.next()
+		if got != want {
+			t.Fatalf("#%d: got seq %d of conn %d, want seq %d of conn %d", idx, got.Seq(), got.Conn().ID, want.Seq(), want.Conn().ID)
+		}
+	}
+	if sched.pending() != 0 {
+		t.Fatalf("pending=>%d", sched.pending())
+	}
+}
+
+func TestSchedulerMaxRunningPerConn(t *testing.T) {
+	requests := testRequests(t, 3, 1)
+	a, b := requests[0], requests[1]
+	sched := newScheduler(1)
+	for _, request := range a {
+		sched.push(request)
+	}
+	sched.push(b[0])
+
+	if got := sched.next(); got != a[0] {
+		t.Fatalf("got seq %d of conn %d, want a[0]", got.Seq(), got.Conn().ID)
+	}
+	if got := sched.next(); got != b[0] {
+		t.Fatalf("got seq %d of conn %d, want b[0]", got.Seq(), got.Conn().ID)
+	}
+	// a 已经占用了一个处理协程, 不能再取 a 的请求
+	sched.done(b[0])
+	if got := nextWithin(sched, 100*time.Millisecond); got != nil {
+		t.Fatalf("got seq %d of conn %d while a[0] is running", got.Seq(), got.Conn().ID)
+	}
+
+	sched = newScheduler(1)
+	for _, request := range a {
+		sched.push(request)
+	}
+	if got := sched.next(); got != a[0] {
+		t.Fatalf("got seq %d, want a[0]", got.Seq())
+	}
+	sched.done(a[0])
+	if got := nextWithin(sched, time.Second); got != a[1] {
+		t.Fatalf("got %v after done, want a[1]", got)
+	}
+}
+
+func TestSchedulerRemoveConnAndClose(t *testing.T) {
+	requests := testRequests(t, 2, 1)
+	a, b := requests[0], requests[1]
+	sched := newScheduler(10)
+	sched.push(a[0])
+	sched.push(a[1])
+	sched.push(b[0])
+
+	sched.removeConn(a[0].Conn())
+	if sched.pending() != 1 {
+		t.Fatalf("pending=>%d after removeConn", sched.pending())
+	}
+	if got := sched.next(); got != b[0] {
+		t.Fatalf("got seq %d of conn %d, want b[0]", got.Seq(), got.Conn().ID)
+	}
+
+	doneCh := make(chan *serverconn.Request, 1)
+	go func() {
+		doneCh <- sched.next()
+	}()
+	sched.close()
+	select {
+	case got := <-doneCh:
+		if got != nil {
+			t.Fatalf("next after close=>seq %d", got.Seq())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("next not returned after close")
+	}
+}
@@ -0,0 +1,389 @@
+package mycpserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mycp/mycplog"
+	"mycp/mycpproto"
+	"mycp/serverconn"
+	"mycp/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errStreamConnClosed = errors.New("conn of the stream closed")
+	errStreamAborted    = errors.New("stream aborted by client")
+	errStreamIdle       = errors.New("stream idle for too long")
+)
+
+// putStreamIdleTimeout 内没有收到流的下一段就放弃这个流. 客户端在等待输入时定时发送空的一段
+const putStreamIdleTimeout = time.Minute
+
+// putStream 是一个正在上传的流. 收到的 Data 按顺序写入 pw, 另一个 goroutine 从对应的 pipe 读出并写文件或解压
+type putStream struct {
+	id     string
+	logger *mycplog.Logger // 带有创建流的请求的连接 ID 和序号
+
+	mu     sync.Mutex
+	pw     *io.PipeWriter
+	offset int64 // 下一个请求应该带的 Offset
+
+	doneCh     chan error    // 写文件或解压的结果
+	finishedCh chan struct{} // 流结束 (完成或放弃) 时关闭
+	finishOnce sync.Once
+	activeCh   chan struct{} // 每收到一段就写入一次, 用于重新计算空闲时间
+	putting    int32         // 正在处理的段数, 不为 0 时不算空闲
+
+	// 在 doneCh 收到结果之前写好: 文件在写之前是否已经存在, tar 解压出的文件
+	overwritten bool
+	files       []mycpproto.MyFileInfo
+}
+
+// MyCPStreamPut 处理流的一段. Offset 为 0 时创建流; 客户端放弃, 流所在的连接断开,
+// 或者 putStreamIdleTimeout 内没有收到下一段时流被放弃.
+// 写文件时先写临时文件, 放弃的流不会留下写了一半的 DstPath.
+func (server *Server) MyCPStreamPut(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage) {
+	logger := request.Logger()
+	data := myCPPackage.Data
+	myCPPackage.Data = nil // 不要把数据原样发回去
+
+	if myCPPackage.Abort {
+		server.putStreamsMutex.Lock()
+		stream, ok := server.putStreams[myCPPackage.StreamID]
+		server.putStreamsMutex.Unlock()
+		if ok {
+			server.finishPutStream(stream, errStreamAborted)
+		}
+		myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+		return
+	}
+
+	stream, err := server.getPutStream(request, myCPPackage)
+	if err != nil {
+		logger.Warnf("getPutStream fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+
+	atomic.AddInt32(&stream.putting, 1)
+	defer atomic.AddInt32(&stream.putting, -1)
+	select {
+	case stream.activeCh <- struct{}{}:
+	default:
+	}
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if myCPPackage.Offset != stream.offset {
+		err = fmt.Errorf("unexpected offset %d, want %d", myCPPackage.Offset, stream.offset)
+		server.finishPutStream(stream, err)
+		fail(myCPPackage, err)
+		return
+	}
+	if len(data) > 0 {
+		_, err = stream.pw.Write(data)
+		if err != nil {
+			// 写文件或解压失败, 错误由 pipe 传回来
+			server.finishPutStream(stream, err)
+			fail(myCPPackage, err)
+			return
+		}
+		stream.offset += int64(len(data))
+	}
+	if myCPPackage.Final {
+		_ = stream.pw.Close()
+		err = <-stream.doneCh
+		server.finishPutStream(stream, nil)
+		if err != nil {
+			logger.Warnf("stream put fail=>%v", err)
+			fail(myCPPackage, err)
+			return
+		}
+		logger.Infof("stream put done=>%s, total %d Bytes", myCPPackage.DstPath, stream.offset)
+		myCPPackage.Overwritten = stream.overwritten
+		myCPPackage.MyFileInfoSlice = stream.files
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+func (server *Server) getPutStream(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage) (stream *putStream, err error) {
+	if myCPPackage.StreamID == "" {
+		return nil, errors.New("no stream id")
+	}
+	server.putStreamsMutex.Lock()
+	defer server.putStreamsMutex.Unlock()
+	stream, ok := server.putStreams[myCPPackage.StreamID]
+	if ok {
+		return stream, nil
+	}
+	if myCPPackage.Offset != 0 {
+		return nil, fmt.Errorf("unknown stream %s, maybe the conn was lost", myCPPackage.StreamID)
+	}
+
+	pr, pw := io.Pipe()
+	stream = &putStream{
+		id:         myCPPackage.StreamID,
+		logger:     request.Logger().With("stream", myCPPackage.StreamID),
+		pw:         pw,
+		doneCh:     make(chan error, 1),
+		finishedCh: make(chan struct{}),
+		activeCh:   make(chan struct{}, 1),
+	}
+	server.putStreams[stream.id] = stream
+
+	dstPath, isTar := myCPPackage.DstPath, myCPPackage.Tar
+	var confine func(target string) error
+	if sess := server.session(request); sess != nil && sess.root != "" {
+		root := sess.root
+		confine = func(target string) error {
+			_, err := confinePath(root, target)
+			return err
+		}
+	}
+	stream.logger.Infof("stream put start=>%s, tar=>%v", dstPath, isTar)
+	go func() {
+		var err error
+		if isTar {
+			auditEntry := server.auditTarEntry(request, AuditOpWrite)
+			err = util.ExtractTarConfined(pr, dstPath, confine, func(entry *util.TarEntry) {
+				auditEntry(entry)
+				if !entry.IsDir {
+					server.Manifests.Record(entry.Path, hex.EncodeToString(entry.SHA256))
+					server.addBlob(request, stream.logger, entry.Path, hex.EncodeToString(entry.SHA256), entry.Size)
+					stream.files = append(stream.files, mycpproto.MyFileInfo{Name: entry.Path, Size: entry.Size, Overwritten: entry.Existed})
+				}
+			})
+			if err != nil {
+				server.audit(request, &AuditRecord{Op: AuditOpWrite, Path: dstPath}, err)
+			}
+		} else {
+			hr := util.NewHashReader(pr)
+			_, statErr := os.Stat(dstPath)
+			stream.overwritten = statErr == nil
+			err = writeStreamFile(hr, dstPath)
+			server.audit(request, &AuditRecord{Op: AuditOpWrite, Path: dstPath, Bytes: hr.N, SHA256: hex.EncodeToString(hr.Sum())}, err)
+			if err == nil {
+				server.Manifests.Record(dstPath, hex.EncodeToString(hr.Sum()))
+				server.addBlob(request, stream.logger, dstPath, hex.EncodeToString(hr.Sum()), hr.N)
+			}
+		}
+		// 让还在写 pipe 的一方拿到错误
+		_ = pr.CloseWithError(err)
+		stream.doneCh <- err
+	}()
+	go server.watchPutStream(request, stream)
+	return stream, nil
+}
+
+// watchPutStream 在连接断开或者流空闲太久时放弃流
+func (server *Server) watchPutStream(request *serverconn.Request, stream *putStream) {
+	idleTimer := time.NewTimer(putStreamIdleTimeout)
+	defer idleTimer.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			server.finishPutStream(stream, errStreamConnClosed)
+			return
+		case <-stream.finishedCh:
+			return
+		case <-stream.activeCh:
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(putStreamIdleTimeout)
+		case <-idleTimer.C:
+			if atomic.LoadInt32(&stream.putting) > 0 {
+				// 正在写的一段 (比如磁盘很慢) 不算空闲
+				idleTimer.Reset(putStreamIdleTimeout)
+				continue
+			}
+			server.finishPutStream(stream, errStreamIdle)
+			return
+		}
+	}
+}
+
+// finishPutStream 结束流, err 不为 nil 时放弃这个流
+func (server *Server) finishPutStream(stream *putStream, err error) {
+	stream.finishOnce.Do(func() {
+		if err != nil {
+			stream.logger.Warnf("abort stream=>%v", err)
+			_ = stream.pw.CloseWithError(err)
+		}
+		close(stream.finishedCh)
+		server.putStreamsMutex.Lock()
+		delete(server.putStreams, stream.id)
+		server.putStreamsMutex.Unlock()
+	})
+}
+
+// writeStreamFile 把 r 的内容写入文件 dstPath, dstPath 不能是已存在的路径
+func writeStreamFile(r io.Reader, dstPath string) (err error) {
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a dir, need a file path", dstPath)
+	}
+	dir := filepath.Dir(dstPath)
+	err = os.MkdirAll(dir, 0775)
+	if err != nil {
+		return fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	perm := os.FileMode(0664)
+	if info, err := os.Stat(dstPath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return util.WriteFileAtomicFrom(dstPath, r, perm)
+}
+
+// partialWriter 把写入的数据攒够 StreamChunkSize 后作为一个中间响应发出
+type partialWriter struct {
+	request  *serverconn.Request
+	password string
+	buf      []byte
+
+	mu       sync.Mutex // Stream 可能同时被心跳调用
+	lastSend time.Time
+}
+
+func (w *partialWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		room := mycpproto.StreamChunkSize - len(w.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+		n += room
+		if len(w.buf) >= mycpproto.StreamChunkSize {
+			err = w.Flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush 把攒下的数据作为一个中间响应发出
+func (w *partialWriter) Flush() (err error) {
+	pkgEncoded, err := json.Marshal(&mycpproto.MyCPPackage{
+		Op:     mycpproto.MyCPOpStreamGet,
+		Status: mycpproto.MyCPPackageStatusSucc,
+		Data:   w.buf,
+	})
+	if err != nil {
+		return fmt.Errorf("Marshal fail=>%w", err)
+	}
+	w.buf = w.buf[:0]
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastSend = time.Now()
+	if !w.request.Stream(util.Encrypt(pkgEncoded, w.password)) {
+		return errStreamConnClosed
+	}
+	return nil
+}
+
+// heartbeat 在长时间没有发出数据时发出心跳, 直到 stopCh 关闭
+func (w *partialWriter) heartbeat(stopCh chan struct{}) {
+	ticker := time.NewTicker(execHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		w.mu.Lock()
+		idle := time.Since(w.lastSend) >= execHeartbeatInterval
+		w.mu.Unlock()
+		if !idle {
+			continue
+		}
+		pkgEncoded, err := json.Marshal(&mycpproto.MyCPPackage{
+			Op:     mycpproto.MyCPOpStreamGet,
+			Status: mycpproto.MyCPPackageStatusSucc,
+		})
+		if err != nil {
+			continue
+		}
+		w.request.Stream(util.Encrypt(pkgEncoded, w.password))
+	}
+}
+
+// MyCPStreamGet 以中间响应的形式发送文件 SrcPath 的内容, Tar 为 true 时发送 SrcPath 的 tar.
+// 最终响应不带数据.
+func (server *Server) MyCPStreamGet(request *serverconn.Request, myCPPackage *mycpproto.MyCPPackage, password string) {
+	logger := request.Logger()
+	w := &partialWriter{
+		request:  request,
+		password: password,
+		buf:      make([]byte, 0, mycpproto.StreamChunkSize),
+		lastSend: time.Now(),
+	}
+	stopCh := make(chan struct{})
+	heartbeatDoneCh := make(chan struct{})
+	go func() {
+		w.heartbeat(stopCh)
+		close(heartbeatDoneCh)
+	}()
+	defer func() {
+		close(stopCh)
+		<-heartbeatDoneCh
+	}()
+
+	var err error
+	if myCPPackage.Tar {
+		var modifiedAfter time.Time
+		if myCPPackage.OnlyModified {
+			modifiedAfter = mycpproto.ModifiedAfter(myCPPackage.SrcLastMyCPTime())
+		}
+		logger.Debugf("be to send tar of=>%s", myCPPackage.SrcPath)
+		err = util.WriteTar(w, myCPPackage.SrcPath, modifiedAfter, myCPPackage.Exclude, server.auditTarEntry(request, AuditOpRead))
+		if err == nil && len(w.buf) > 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			server.audit(request, &AuditRecord{Op: AuditOpRead, Path: myCPPackage.SrcPath}, err)
+		}
+	} else {
+		logger.Debugf("be to send content of=>%s", myCPPackage.SrcPath)
+		var n int64
+		var sum []byte
+		n, sum, err = sendFile(w, myCPPackage.SrcPath)
+		if err == nil && len(w.buf) > 0 {
+			err = w.Flush()
+		}
+		server.audit(request, &AuditRecord{Op: AuditOpRead, Path: myCPPackage.SrcPath, Bytes: n, SHA256: hex.EncodeToString(sum)}, err)
+	}
+	if err != nil {
+		logger.Warnf("stream get fail=>%v", err)
+		fail(myCPPackage, err)
+		return
+	}
+	myCPPackage.Status = mycpproto.MyCPPackageStatusSucc
+}
+
+// sendFile 把文件 srcPath 的内容写入 w, 返回写入的字节数和内容的 sha256
+func sendFile(w io.Writer, srcPath string) (n int64, sum []byte, err error) {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if info.IsDir() {
+		return 0, nil, fmt.Errorf("%s is a dir, use tar", srcPath)
+	}
+	hr := util.NewHashReader(file)
+	_, err = io.Copy(w, hr)
+	return hr.N, hr.Sum(), err
+}
@@ -3,68 +3,189 @@ package serverconn
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
+	"mycp/mycplog"
+	"mycp/mycpproto"
 	"net"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
+type Options struct {
+	PingInterval time.Duration // 发送 ping 的间隔, 0 表示不发送
+	IdleTimeout  time.Duration // 超过这个时间没有收到任何帧则认为对端已死并关闭连接, 0 表示不检测
+	MaxInFlight  int           // 每个连接同时处理中的请求数上限, 即授予客户端的额度
+
+	MaxFrameSize        uint64 // 认证后单个帧 body 的最大字节数
+	MaxPreAuthFrameSize uint64 // 认证前单个帧 body 的最大字节数
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		PingInterval: 5 * time.Second,
+		IdleTimeout:  20 * time.Second,
+		MaxInFlight:  256,
+
+		MaxFrameSize:        1 << 30, // 500MB 的文件经过 json + 加密后大约 900MB
+		MaxPreAuthFrameSize: 64 * 1024,
+	}
+}
+
+// Validate 检查参数. MaxInFlight 小于 1 时客户端拿不到额度, 所有请求都会等到超时
+func (opts *Options) Validate() (err error) {
+	if opts.MaxInFlight < 1 {
+		return fmt.Errorf("MaxInFlight must be at least 1, got %d", opts.MaxInFlight)
+	}
+	return nil
+}
+
+// lastID 用于给 ServerConn 分配 ID
+var lastID uint64
+
 type ServerConn struct {
-	conn   net.Conn
+	ID     uint64 // 进程内唯一, 从 1 开始. 服务端在 Hello 的响应中告诉客户端, 两边的日志中都以 conn 字段出现
+	logger *mycplog.Logger
+
+	conn   *countingConn
 	reader io.Reader
+	opts   *Options
 
 	RequestCh  chan *Request
 	responseCh chan *Request
+	pongCh     chan struct{}
+	shutdownCh chan struct{} // 关闭时 GoSend 发完 responseCh 中的响应后关闭连接
 
-	StopCtx  context.Context
+	StopCtx  context.Context // ServerConn 关闭时被 cancel
 	StopFunc context.CancelFunc
 
-	closed uint64
+	inFlight int64 // 已收到但还未响应的请求数, 不能超过 opts.MaxInFlight
+
+	authenticated uint64 // 收到过能正确解密的请求后置 1, 之后才允许大帧
+
+	session atomic.Value // 上层保存的这个连接的状态, 比如 Hello 中的用户
+
+	StartTime time.Time
+
+	shutdown uint64
+	closed   uint64
 }
 
 type Request struct {
 	serverConn *ServerConn
 	seq        uint64
 	Pkg        []byte
+
+	dropped bool // 不回响应, 只归还额度
+	partial bool // 中间响应, 不归还额度
 }
 
 func (serverConn *ServerConn) IsClosed() bool {
 	return atomic.LoadUint64(&serverConn.closed) == 1
 }
 
+func (serverConn *ServerConn) SetAuthenticated() {
+	atomic.StoreUint64(&serverConn.authenticated, 1)
+}
+
+func (serverConn *ServerConn) IsAuthenticated() bool {
+	return atomic.LoadUint64(&serverConn.authenticated) == 1
+}
+
+func (serverConn *ServerConn) maxBodyLen() uint64 {
+	if serverConn.IsAuthenticated() {
+		return serverConn.opts.MaxFrameSize
+	}
+	return serverConn.opts.MaxPreAuthFrameSize
+}
+
 func (serverConn *ServerConn) Close() {
 	//log.Printf("be to close ServerConn")
 	if atomic.CompareAndSwapUint64(&serverConn.closed, 0, 1) {
 		//close(serverConn.RequestCh)
-		close(serverConn.responseCh)
+		serverConn.StopFunc()
 		_ = serverConn.conn.Close()
-		log.Printf("success close ServerConn")
+		serverConn.logger.Infof("success close ServerConn")
 	}
 }
 
-func NewServerConn(ctx context.Context, conn net.Conn, requestCh chan *Request) (serverConn *ServerConn, err error) {
+// countingConn 统计收发的字节数
+type countingConn struct {
+	net.Conn
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (c *countingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	return n, err
+}
+
+// BytesIn 返回连接上收到的字节数, 包括帧头
+func (serverConn *ServerConn) BytesIn() uint64 {
+	return atomic.LoadUint64(&serverConn.conn.bytesIn)
+}
+
+// BytesOut 返回连接上发出的字节数, 包括帧头
+func (serverConn *ServerConn) BytesOut() uint64 {
+	return atomic.LoadUint64(&serverConn.conn.bytesOut)
+}
+
+func (serverConn *ServerConn) RemoteAddr() net.Addr {
+	return serverConn.conn.RemoteAddr()
+}
+
+// Session 返回上层通过 Request.SetSession 保存在连接上的状态, 没有时返回 nil
+func (serverConn *ServerConn) Session() interface{} {
+	return serverConn.session.Load()
+}
+
+// opts 为 nil 时使用 DefaultOptions()
+func NewServerConn(ctx context.Context, conn net.Conn, requestCh chan *Request, opts *Options) (serverConn *ServerConn, err error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	err = opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		err = tcpConn.SetKeepAlive(true)
 		if err != nil {
-			log.Printf("SetKeepAlive fail=>%v", err)
+			mycplog.Warnf("SetKeepAlive fail=>%v", err)
 			return
 		}
 		err = tcpConn.SetKeepAlivePeriod(10 * time.Second)
 		if err != nil {
-			log.Printf("SetKeepAlivePeriod fail=>%v", err)
+			mycplog.Warnf("SetKeepAlivePeriod fail=>%v", err)
 			return
 		}
 	}
 
+	counted := &countingConn{Conn: conn}
+	id := atomic.AddUint64(&lastID, 1)
 	serverConn = &ServerConn{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
+		ID:     id,
+		logger: mycplog.With("conn", id),
+		conn:   counted,
+		reader: bufio.NewReader(counted),
+		opts:   opts,
+
+		StartTime: time.Now(),
 
 		RequestCh:  requestCh,
-		responseCh: make(chan *Request, 4096),
+		responseCh: make(chan *Request, opts.MaxInFlight),
+		pongCh:     make(chan struct{}, 1),
+		shutdownCh: make(chan struct{}),
 	}
 	serverConn.StopCtx, serverConn.StopFunc = context.WithCancel(ctx)
 
@@ -75,20 +196,25 @@ func NewServerConn(ctx context.Context, conn net.Conn, requestCh chan *Request)
 }
 
 const (
-	HeadSize = 16
+	HeadSize = mycpproto.HeadSize
 )
 
+// refreshReadDeadline 在每次 Read 前调用, IdleTimeout 内读不到数据则 Read 返回超时错误
+func (serverConn *ServerConn) refreshReadDeadline() (err error) {
+	if serverConn.opts.IdleTimeout <= 0 {
+		return nil
+	}
+	return serverConn.conn.SetReadDeadline(time.Now().Add(serverConn.opts.IdleTimeout))
+}
+
 func (serverConn *ServerConn) GoReceive() {
 	//log.Printf("enter GoReceive")
 	defer serverConn.Close()
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("serverConn.RequestCh closed")
-		}
-	}()
 
 	var headPkg = make([]byte, HeadSize)
+	var frameType mycpproto.FrameType
 	var pkgLen int
+	var seq uint64
 	var totalCnt = 0
 	var thisCnt = 0
 	var err error
@@ -96,38 +222,82 @@ func (serverConn *ServerConn) GoReceive() {
 		// read head
 		totalCnt = 0
 		for totalCnt < HeadSize {
+			err = serverConn.refreshReadDeadline()
+			if err != nil {
+				serverConn.logger.Warnf("SetReadDeadline fail=>%v", err)
+				return
+			}
 			thisCnt, err = serverConn.reader.Read(headPkg[totalCnt:])
 			if err != nil {
 				if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
 					return
 				}
-				log.Printf("Read fail=>%v", err)
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					serverConn.logger.Warnf("no frame from peer in %v, close dead conn. remote=>%v", serverConn.opts.IdleTimeout, serverConn.conn.RemoteAddr())
+					return
+				}
+				serverConn.logger.Warnf("Read fail=>%v", err)
 				return
 			}
 			totalCnt += thisCnt
 		}
 		// read body
-		pkgLen = int(binary.BigEndian.Uint64(headPkg))
+		var bodyLen uint64
+		frameType, bodyLen, seq = mycpproto.ParseHead(headPkg)
+		err = mycpproto.CheckHead(frameType, bodyLen, serverConn.maxBodyLen())
+		if err != nil {
+			serverConn.logger.Warnf("bad frame, close conn. remote=>%v, authenticated=>%v, err=>%v", serverConn.conn.RemoteAddr(), serverConn.IsAuthenticated(), err)
+			return
+		}
+		pkgLen = int(bodyLen)
 		var pkg = make([]byte, pkgLen)
 		totalCnt = 0
 		for totalCnt < pkgLen {
+			err = serverConn.refreshReadDeadline()
+			if err != nil {
+				serverConn.logger.Warnf("SetReadDeadline fail=>%v", err)
+				return
+			}
 			thisCnt, err = serverConn.reader.Read(pkg[totalCnt:])
 			if err != nil {
-				log.Printf("Read fail=>%v", err)
+				serverConn.logger.Warnf("Read fail=>%v", err)
 				return
 			}
 			//log.Printf("%s", pkg)
 			totalCnt += thisCnt
 		}
+
+		switch frameType {
+		case mycpproto.FrameTypePing:
+			select {
+			case serverConn.pongCh <- struct{}{}:
+			default:
+				// 已经有一个 pong 待发送
+			}
+			continue
+		case mycpproto.FrameTypePong:
+			// 收到任何帧都已经刷新了 read deadline, 无需其他处理
+			continue
+		}
+
+		if atomic.AddInt64(&serverConn.inFlight, 1) > int64(serverConn.opts.MaxInFlight) {
+			serverConn.logger.Warnf("peer sent more than %d in-flight requests without credit, close conn. remote=>%v", serverConn.opts.MaxInFlight, serverConn.conn.RemoteAddr())
+			return
+		}
+
 		// 构造 Request
 		var request = &Request{
 			serverConn: serverConn,
-			seq:        binary.BigEndian.Uint64(headPkg[8:]),
+			seq:        seq,
 			Pkg:        pkg,
 		}
 		//log.Printf("got Request=>%#v", request)
 		//time.Sleep(5 * time.Second)
-		serverConn.RequestCh <- request
+		select {
+		case serverConn.RequestCh <- request:
+		case <-serverConn.StopCtx.Done():
+			return
+		}
 	}
 }
 
@@ -136,52 +306,179 @@ func (serverConn *ServerConn) GoSend() {
 	defer serverConn.Close()
 
 	var request *Request
-	var ok bool
-	var pkgLen int
-	var n int
 	var err error
 	var ticker100ms = time.NewTicker(100 * time.Millisecond)
+	defer ticker100ms.Stop()
+	var pingCh <-chan time.Time
+	if serverConn.opts.PingInterval > 0 {
+		pingTicker := time.NewTicker(serverConn.opts.PingInterval)
+		defer pingTicker.Stop()
+		pingCh = pingTicker.C
+	}
+	var controlPkg = make([]byte, HeadSize)
+
+	// 初始额度
+	mycpproto.PutHead(controlPkg, mycpproto.FrameTypeCredit, 0, uint64(serverConn.opts.MaxInFlight))
+	_, err = serverConn.conn.Write(controlPkg)
+	if err != nil {
+		serverConn.logger.Warnf("Write credit fail=>%v", err)
+		return
+	}
+
 	for !serverConn.IsClosed() {
 		select {
-		case request, ok = <-serverConn.responseCh:
-			if !ok {
-				//log.Printf("responseCh has closed. ServerConn close->GoSend End")
+		case request = <-serverConn.responseCh:
+			err = serverConn.writeResponse(request)
+			if err != nil {
+				serverConn.logger.Warnf("Write fail=>%v", err)
 				return
 			}
-
-			pkgLen = HeadSize + len(request.Pkg)
-			pkg := make([]byte, pkgLen)
-			n = 0
-			binary.BigEndian.PutUint64(pkg[n:], uint64(len(request.Pkg)))
-			n += 8
-			binary.BigEndian.PutUint64(pkg[n:], request.seq)
-			n += 8
-			copy(pkg[n:], request.Pkg)
-			_, err = serverConn.conn.Write(pkg)
+		case <-serverConn.shutdownCh:
+			// 发完已经交给 GoSend 的响应再关闭
+			for {
+				select {
+				case request = <-serverConn.responseCh:
+					err = serverConn.writeResponse(request)
+					if err != nil {
+						serverConn.logger.Warnf("Write fail=>%v", err)
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-serverConn.StopCtx.Done():
+			return
+		case <-pingCh:
+			mycpproto.PutHead(controlPkg, mycpproto.FrameTypePing, 0, 0)
+			_, err = serverConn.conn.Write(controlPkg)
+			if err != nil {
+				serverConn.logger.Warnf("Write ping fail=>%v", err)
+				return
+			}
+		case <-serverConn.pongCh:
+			mycpproto.PutHead(controlPkg, mycpproto.FrameTypePong, 0, 0)
+			_, err = serverConn.conn.Write(controlPkg)
 			if err != nil {
-				log.Printf("Write fail=>%v", err)
+				serverConn.logger.Warnf("Write pong fail=>%v", err)
 				return
 			}
 		case <-ticker100ms.C:
 			err = serverConn.conn.SetWriteDeadline(time.Now().Add(30_100 * time.Millisecond))
 			if err != nil {
-				log.Printf("SetWriteDeadline fail=>%v", err)
+				serverConn.logger.Warnf("SetWriteDeadline fail=>%v", err)
 				return
 			}
 		}
 	}
 }
 
-func (request *Request) Done() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("responseCh have closed so drop this rsp")
-		}
-	}()
+// writeResponse 发送一个响应. 最终响应后面紧跟着归还一个额度
+func (serverConn *ServerConn) writeResponse(request *Request) (err error) {
+	if request.partial {
+		pkg := make([]byte, HeadSize+len(request.Pkg))
+		mycpproto.PutHead(pkg, mycpproto.FrameTypeDataMore, len(request.Pkg), request.seq)
+		copy(pkg[HeadSize:], request.Pkg)
+		_, err = serverConn.conn.Write(pkg)
+		return err
+	}
 
+	var pkgLen int
+	if request.dropped {
+		pkgLen = HeadSize
+	} else {
+		pkgLen = HeadSize + len(request.Pkg) + HeadSize
+	}
+	pkg := make([]byte, pkgLen)
+	if !request.dropped {
+		mycpproto.PutHead(pkg, mycpproto.FrameTypeData, len(request.Pkg), request.seq)
+		copy(pkg[HeadSize:], request.Pkg)
+	}
+	mycpproto.PutHead(pkg[pkgLen-HeadSize:], mycpproto.FrameTypeCredit, 0, 1)
+	atomic.AddInt64(&serverConn.inFlight, -1)
+	_, err = serverConn.conn.Write(pkg)
+	return err
+}
+
+// Shutdown 让 GoSend 发完已经交给它的响应后关闭连接, 不等待连接关闭. 之后的响应会被放弃.
+// 调用者应该先等处理中的请求都已经 Done.
+func (serverConn *ServerConn) Shutdown() {
+	if atomic.CompareAndSwapUint64(&serverConn.shutdown, 0, 1) {
+		close(serverConn.shutdownCh)
+	}
+}
+
+// Done 把响应交给 GoSend. 客户端遵守额度时 responseCh 不会满, 这里只会在连接关闭时放弃响应.
+// 放弃响应时返回 false.
+func (request *Request) Done() (ok bool) {
 	select {
 	case request.serverConn.responseCh <- request:
-	default:
-		log.Printf("responseCh full so drop this rsp")
+		return true
+	case <-request.serverConn.StopCtx.Done():
+		request.Logger().Warnf("ServerConn closed so drop this rsp")
+		return false
+	}
+}
+
+// Drop 表示这个请求不回响应 (比如解密失败), 但仍然要把额度还给客户端
+func (request *Request) Drop() (ok bool) {
+	request.dropped = true
+	return request.Done()
+}
+
+// Stream 发送一个中间响应, 之后还必须调用 Done 发送最终响应.
+// GoSend 来不及发送时会阻塞; 连接已关闭时返回 false.
+func (request *Request) Stream(pkg []byte) (ok bool) {
+	var partial = &Request{
+		serverConn: request.serverConn,
+		seq:        request.seq,
+		Pkg:        pkg,
+		partial:    true,
 	}
+	select {
+	case request.serverConn.responseCh <- partial:
+		return true
+	case <-request.serverConn.StopCtx.Done():
+		return false
+	}
+}
+
+// Context 在请求所在的连接关闭时被取消
+func (request *Request) Context() context.Context {
+	return request.serverConn.StopCtx
+}
+
+// SetAuthenticated 表示这个请求已经通过认证, 它所在的连接之后允许接收大帧
+func (request *Request) SetAuthenticated() {
+	request.serverConn.SetAuthenticated()
+}
+
+// Session 返回 SetSession 保存在请求所在连接上的状态, 没有时返回 nil
+func (request *Request) Session() interface{} {
+	return request.serverConn.Session()
+}
+
+// Seq 返回请求的序号, 与客户端日志中的 seq 相同
+func (request *Request) Seq() uint64 {
+	return request.seq
+}
+
+// Logger 返回带有连接 ID 和请求序号的 Logger
+func (request *Request) Logger() *mycplog.Logger {
+	return request.serverConn.logger.With("seq", request.seq)
+}
+
+// Conn 返回请求所在的连接
+func (request *Request) Conn() *ServerConn {
+	return request.serverConn
+}
+
+// SetSession 在请求所在的连接上保存状态, 之后这个连接上的请求都能通过 Session 取到. 每次必须是同一种类型.
+func (request *Request) SetSession(session interface{}) {
+	request.serverConn.session.Store(session)
+}
+
+// CloseConn 关闭请求所在的连接, 用于收到无法解码的请求时
+func (request *Request) CloseConn() {
+	request.serverConn.Close()
 }
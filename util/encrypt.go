@@ -24,8 +24,16 @@ func Encrypt(orig []byte, key string) []byte {
 	return []byte(encrypted)
 }
 
+// Decrypt 对任意输入都不会 panic, 无法解密时返回错误
 func Decrypt(crypted []byte, key string) (origPlus []byte, err error) {
-	origPlus = []byte(AesDecrypt(string(crypted), key))
+	orig, err := AesDecrypt(string(crypted), key)
+	if err != nil {
+		return nil, err
+	}
+	origPlus = []byte(orig)
+	if len(origPlus) < RandomBytesLen+len(MagicBytes) {
+		return nil, fmt.Errorf("decrypted data too short. len=>%d", len(origPlus))
+	}
 	if bytes.Compare(origPlus[len(origPlus)-len(MagicBytes):], MagicBytes) != 0 {
 		return nil, fmt.Errorf("magic value not match")
 	}
@@ -51,14 +59,24 @@ func AesEncrypt(orig string, key string) string {
 	blockMode.CryptBlocks(cryted, origData)
 	return base64.StdEncoding.EncodeToString(cryted)
 }
-func AesDecrypt(cryted string, key string) string {
+func AesDecrypt(cryted string, key string) (string, error) {
 	// 转成字节数组
-	crytedByte, _ := base64.StdEncoding.DecodeString(cryted)
+	crytedByte, err := base64.StdEncoding.DecodeString(cryted)
+	if err != nil {
+		return "", fmt.Errorf("base64 decode fail=>%w", err)
+	}
 	k := []byte(key)
 	// 分组秘钥
-	block, _ := aes.NewCipher(k)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return "", fmt.Errorf("aes.NewCipher fail=>%w", err)
+	}
 	// 获取秘钥块的长度
 	blockSize := block.BlockSize()
+	// CryptBlocks 要求输入是块长度的整数倍, 否则会 panic
+	if len(crytedByte) == 0 || len(crytedByte)%blockSize != 0 {
+		return "", fmt.Errorf("invalid cipher text len=>%d", len(crytedByte))
+	}
 	// 加密模式
 	blockMode := cipher.NewCBCDecrypter(block, k[:blockSize])
 	// 创建数组
@@ -66,8 +84,11 @@ func AesDecrypt(cryted string, key string) string {
 	// 解密
 	blockMode.CryptBlocks(orig, crytedByte)
 	// 去补全码
-	orig = PKCS7UnPadding(orig)
-	return string(orig)
+	orig, err = PKCS7UnPadding(orig, blockSize)
+	if err != nil {
+		return "", err
+	}
+	return string(orig), nil
 }
 
 //补码
@@ -79,8 +100,19 @@ func PKCS7Padding(ciphertext []byte, blocksize int) []byte {
 }
 
 //去码
-func PKCS7UnPadding(origData []byte) []byte {
+func PKCS7UnPadding(origData []byte, blocksize int) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, fmt.Errorf("bad padding=>empty data")
+	}
 	unpadding := int(origData[length-1])
-	return origData[:(length - unpadding)]
+	if unpadding == 0 || unpadding > blocksize || unpadding > length {
+		return nil, fmt.Errorf("bad padding=>%d", unpadding)
+	}
+	for _, b := range origData[length-unpadding:] {
+		if int(b) != unpadding {
+			return nil, fmt.Errorf("bad padding=>%d", unpadding)
+		}
+	}
+	return origData[:(length - unpadding)], nil
 }
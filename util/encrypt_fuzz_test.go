@@ -0,0 +1,27 @@
+//go:build go1.18
+// +build go1.18
+
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecrypt(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("!!!!"))
+	f.Add(Encrypt([]byte(`{"Op":"hello"}`), testKey))
+	f.Add([]byte(AesEncrypt("tiny", testKey)))
+	f.Fuzz(func(t *testing.T, crypted []byte) {
+		// 不能 panic; 能解密的数据重新加密后仍然解密出同样的内容
+		decrypted, err := Decrypt(crypted, testKey)
+		if err != nil {
+			return
+		}
+		again, err := Decrypt(Encrypt(decrypted, testKey), testKey)
+		if err != nil || !bytes.Equal(again, decrypted) {
+			t.Fatalf("round trip of %q=>%q, %v", decrypted, again, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"testing"
+)
+
+const testKey = "abcdefghijklmnop"
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, orig := range [][]byte{{}, []byte("x"), []byte(`{"Op":"hello"}`), bytes.Repeat([]byte{0xff}, 1000)} {
+		decrypted, err := Decrypt(Encrypt(orig, testKey), testKey)
+		if err != nil {
+			t.Fatalf("Decrypt fail=>%v", err)
+		}
+		if !bytes.Equal(decrypted, orig) {
+			t.Fatalf("Decrypt(Encrypt(%q))=>%q", orig, decrypted)
+		}
+	}
+}
+
+// cbcEncryptRaw 不加补全码直接加密, 用于构造补全码错误的密文
+func cbcEncryptRaw(t *testing.T, data []byte, key string) []byte {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatalf("aes.NewCipher fail=>%v", err)
+	}
+	crypted := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, []byte(key)[:block.BlockSize()]).CryptBlocks(crypted, data)
+	return []byte(base64.StdEncoding.EncodeToString(crypted))
+}
+
+func TestDecryptBadInput(t *testing.T) {
+	badPadding := bytes.Repeat([]byte{'a'}, 32)
+	badPadding[31] = 17 // 超过块长度
+	zeroPadding := bytes.Repeat([]byte{'a'}, 32)
+	zeroPadding[31] = 0
+	mixedPadding := bytes.Repeat([]byte{'a'}, 32)
+	mixedPadding[31], mixedPadding[30] = 2, 3
+	cases := []struct {
+		name    string
+		crypted []byte
+		key     string
+	}{
+		{"empty", []byte{}, testKey},
+		{"not base64", []byte("!!!!"), testKey},
+		{"short", []byte(base64.StdEncoding.EncodeToString([]byte("short"))), testKey},
+		{"unaligned", []byte(base64.StdEncoding.EncodeToString(make([]byte, 17))), testKey},
+		{"bad padding", cbcEncryptRaw(t, badPadding, testKey), testKey},
+		{"zero padding", cbcEncryptRaw(t, zeroPadding, testKey), testKey},
+		{"mixed padding", cbcEncryptRaw(t, mixedPadding, testKey), testKey},
+		{"too short after padding", []byte(AesEncrypt("tiny", testKey)), testKey},
+		{"no magic", []byte(AesEncrypt(string(bytes.Repeat([]byte{'a'}, 40)), testKey)), testKey},
+		{"bad key length", Encrypt([]byte("x"), testKey), "short"},
+	}
+	for _, c := range cases {
+		_, err := Decrypt(c.crypted, c.key)
+		if err == nil {
+			t.Errorf("%s: Decrypt succ", c.name)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	crypted := Encrypt([]byte(`{"Op":"hello"}`), testKey)
+	decrypted, err := Decrypt(crypted, "ponmlkjihgfedcba")
+	if err == nil && bytes.Equal(decrypted, []byte(`{"Op":"hello"}`)) {
+		t.Fatalf("Decrypt with wrong key got the plain text")
+	}
+}
+
+func TestPKCS7UnPadding(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want []byte
+		ok   bool
+	}{
+		{[]byte{}, nil, false},
+		{[]byte{'a', 1}, []byte{'a'}, true},
+		{[]byte{'a', 2, 2}, []byte{'a'}, true},
+		{[]byte{2, 2}, []byte{}, true},
+		{[]byte{'a', 0}, nil, false},
+		{[]byte{'a', 3, 2}, nil, false},
+		{[]byte{'a', 3}, nil, false}, // 超过数据长度
+		{bytes.Repeat([]byte{17}, 17), nil, false},
+	}
+	for _, c := range cases {
+		got, err := PKCS7UnPadding(c.data, 16)
+		if (err == nil) != c.ok || (c.ok && !bytes.Equal(got, c.want)) {
+			t.Errorf("PKCS7UnPadding(%v)=>%v, %v", c.data, got, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// WriteFileAtomic 先写同目录下的临时文件再 rename, 失败时删除临时文件, 不会留下写了一半的 path.
+// path 已存在时保留它原来的权限.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	if info, statErr := os.Stat(path); statErr == nil {
+		perm = info.Mode().Perm()
+	}
+	return WriteFileAtomicFrom(path, bytes.NewReader(data), perm)
+}
+
+// WriteFileAtomicFrom 与 WriteFileAtomic 相同, 但内容从 r 读到 EOF 为止, 且总是使用 perm 作为权限
+func WriteFileAtomicFrom(path string, r io.Reader, perm os.FileMode) (err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmpFile, err := ioutil.TempFile(dir, "."+name+".mycp-tmp-")
+	if err != nil {
+		return fmt.Errorf("TempFile fail=>%w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	_, err = io.Copy(tmpFile, r)
+	if err != nil {
+		return fmt.Errorf("Write fail=>%w", err)
+	}
+	err = tmpFile.Chmod(perm)
+	if err != nil {
+		return fmt.Errorf("Chmod fail=>%w", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("Close fail=>%w", err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("Rename fail=>%w", err)
+	}
+	return nil
+}
+
+// HashReader 在读 r 的同时计算读到的内容的 sha256 和字节数
+type HashReader struct {
+	r io.Reader
+	h hash.Hash
+	N int64 // 已经读到的字节数
+}
+
+func NewHashReader(r io.Reader) *HashReader {
+	return &HashReader{r: r, h: sha256.New()}
+}
+
+func (hr *HashReader) Read(p []byte) (n int, err error) {
+	n, err = hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.N += int64(n)
+	return
+}
+
+// Sum 返回已经读到的内容的 sha256
+func (hr *HashReader) Sum() []byte {
+	return hr.h.Sum(nil)
+}
+
+// Excluded 判断文件名 name (不含路径) 是否与 patterns 中的某一个按 path.Match 匹配
+func Excluded(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
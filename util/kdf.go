@@ -0,0 +1,78 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	KeyLen            = 32     // DeriveKey 得到的密钥长度, 用作 AES-256 的密钥
+	SaltLen           = 16     // GenSalt 生成的盐的长度
+	NonceLen          = 16     // Hello 中交换的随机数的长度
+	DefaultIterations = 100000 // PBKDF2 的默认迭代次数
+)
+
+// PBKDF2 实现 RFC 8018 中的 PBKDF2-HMAC-SHA256
+func PBKDF2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// DeriveKey 由任意长度的密码和盐得到加密用的密钥, 可以直接作为 Encrypt 和 Decrypt 的 key
+func DeriveKey(password string, salt []byte, iterations int) string {
+	return string(PBKDF2([]byte(password), salt, iterations, KeyLen))
+}
+
+// KeyVerifier 返回 DeriveKey 得到的密钥的 sha256, 服务端只保存它. 由它可以得到 SessionKey,
+// 但得不到密钥本身, 而认证时要出示密钥, 所以读到它的人不能冒充用户.
+func KeyVerifier(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// SessionKey 由 KeyVerifier 和双方在 Hello 中交换的随机数得到一个连接上加解密用的密钥, 每个连接都不同
+func SessionKey(verifier, clientNonce, serverNonce []byte) string {
+	mac := hmac.New(sha256.New, verifier)
+	mac.Write([]byte("mycp session key"))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return string(mac.Sum(nil))
+}
+
+// GenSalt 用 crypto/rand 生成 n 字节的随机数
+func GenSalt(n int) (salt []byte, err error) {
+	salt = make([]byte, n)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("rand.Read fail=>%w", err)
+	}
+	return salt, nil
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// 前两个测试向量来自 RFC 7914 第 11 节, 第三个是常用的 RFC 6070 输入在 SHA-256 下的结果
+func TestPBKDF2(t *testing.T) {
+	for _, c := range []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		// keyLen 不是 sha256 长度的整数倍
+		{"passwd", "salt", 1, 20, "55ac046e56e3089fec1691c22544b605f9418521"},
+	} {
+		got := hex.EncodeToString(PBKDF2([]byte(c.password), []byte(c.salt), c.iterations, c.keyLen))
+		if got != c.want {
+			t.Errorf("PBKDF2(%q, %q, %d, %d)=>%s, want %s", c.password, c.salt, c.iterations, c.keyLen, got, c.want)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := DeriveKey("passwd", []byte("salt"), 1)
+	if len(key) != KeyLen {
+		t.Fatalf("len(DeriveKey)=>%d", len(key))
+	}
+	if key == DeriveKey("passwd", []byte("salt2"), 1) {
+		t.Fatalf("DeriveKey ignores the salt")
+	}
+	// 得到的密钥能直接用于加解密
+	decrypted, err := Decrypt(Encrypt([]byte("x"), key), key)
+	if err != nil || string(decrypted) != "x" {
+		t.Fatalf("Decrypt=>%q, %v", decrypted, err)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	verifier := KeyVerifier(DeriveKey("passwd", []byte("salt"), 1))
+	clientNonce, serverNonce := bytes.Repeat([]byte{1}, NonceLen), bytes.Repeat([]byte{2}, NonceLen)
+	key := SessionKey(verifier, clientNonce, serverNonce)
+	if len(key) != KeyLen {
+		t.Fatalf("len(SessionKey)=>%d", len(key))
+	}
+	if key != SessionKey(verifier, clientNonce, serverNonce) {
+		t.Fatalf("SessionKey is not deterministic")
+	}
+	for _, other := range []string{
+		SessionKey(verifier, serverNonce, clientNonce),
+		SessionKey(verifier, clientNonce, clientNonce),
+		SessionKey(KeyVerifier(DeriveKey("passwd2", []byte("salt"), 1)), clientNonce, serverNonce),
+	} {
+		if other == key {
+			t.Fatalf("different inputs give the same SessionKey")
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mycp/mycplog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TarEntry 是 WriteTar 或 ExtractTar 处理完的 tar 中的一个文件或路径
+type TarEntry struct {
+	Path    string // 本地的路径
+	IsDir   bool
+	Size    int64  // 文件内容的字节数, 路径为 0
+	SHA256  []byte // 文件内容的 sha256, 路径为 nil
+	Existed bool   // 只用于 ExtractTar: 写之前文件是否已经存在
+}
+
+// TarEntryFunc 在 WriteTar 或 ExtractTar 处理完 tar 中的一个文件或路径后被调用
+type TarEntryFunc func(entry *TarEntry)
+
+// WriteTar 把 srcPath (文件或路径) 以 tar 格式写入 w, tar 中的路径以 srcPath 的最后一级开头,
+// 与拷贝路径时 "将路径 srcPath 拷贝至 dstPath 下" 的规则一致.
+// modifiedAfter 不为零值时跳过修改时间早于它的文件, 路径不受限制. 暂不支持软链接, 遇到时跳过.
+// 跳过名字与 exclude 匹配的文件和路径, srcPath 本身除外. onEntry 可以为 nil.
+func WriteTar(w io.Writer, srcPath string, modifiedAfter time.Time, exclude []string, onEntry TarEntryFunc) (err error) {
+	srcPathTrimmed := strings.TrimSuffix(srcPath, "/")
+	for len(srcPathTrimmed) >= 2 && strings.HasSuffix(srcPathTrimmed, "/") {
+		srcPathTrimmed = strings.TrimSuffix(srcPathTrimmed, "/")
+	}
+	root := filepath.Dir(srcPathTrimmed)
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(srcPathTrimmed, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath != srcPathTrimmed && Excluded(info.Name(), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			mycplog.Debugf("skip non-regular file=>%s", filePath)
+			return nil
+		}
+		if !info.IsDir() && !modifiedAfter.IsZero() && info.ModTime().Before(modifiedAfter) {
+			return nil
+		}
+		name, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("FileInfoHeader fail=>%w", err)
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return fmt.Errorf("WriteHeader fail=>%w", err)
+		}
+		if info.IsDir() {
+			if onEntry != nil {
+				onEntry(&TarEntry{Path: filePath, IsDir: true})
+			}
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("Open fail=>%w", err)
+		}
+		defer file.Close()
+		hr := NewHashReader(file)
+		_, err = io.Copy(tw, hr)
+		if err != nil {
+			return fmt.Errorf("copy %s fail=>%w", filePath, err)
+		}
+		if onEntry != nil {
+			onEntry(&TarEntry{Path: filePath, Size: hr.N, SHA256: hr.Sum()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExtractTar 把 r 中的 tar 解压到路径 dstDir 下, dstDir 不存在时创建. 每个文件都是先写临时文件再 rename,
+// 并保留权限和修改时间. 拒绝绝对路径和包含 .. 的路径, 跳过文件和路径以外的类型.
+// 读到 tar 的结尾后会把 r 中剩余的数据 (比如结尾的填充) 读完, 这样写 r 的一方不会因为没人读而失败.
+// onEntry 可以为 nil.
+func ExtractTar(r io.Reader, dstDir string, onEntry TarEntryFunc) (err error) {
+	return ExtractTarConfined(r, dstDir, nil, onEntry)
+}
+
+// ExtractTarConfined 与 ExtractTar 相同, 但创建每个文件和路径之前先用 confine 检查它的路径, 返回错误时停止解压.
+// 用于 dstDir 下已经有指向外面的软链接的情况. confine 可以为 nil.
+func ExtractTarConfined(r io.Reader, dstDir string, confine func(target string) error, onEntry TarEntryFunc) (err error) {
+	err = os.MkdirAll(dstDir, 0775)
+	if err != nil {
+		return fmt.Errorf("MkdirAll fail=>%w", err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			_, err = io.Copy(ioutil.Discard, r)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("read tar fail=>%w", err)
+		}
+		name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || (len(name) >= 2 && name[1] == ':') {
+			return fmt.Errorf("bad path in tar=>%q", header.Name)
+		}
+		target := filepath.Join(dstDir, filepath.FromSlash(name))
+		if confine != nil && (header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg) {
+			err = confine(target)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0775)
+			if err != nil {
+				return fmt.Errorf("MkdirAll fail=>%w", err)
+			}
+			if onEntry != nil {
+				onEntry(&TarEntry{Path: target, IsDir: true})
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0775)
+			if err != nil {
+				return fmt.Errorf("MkdirAll fail=>%w", err)
+			}
+			_, statErr := os.Stat(target)
+			hr := NewHashReader(tr)
+			err = WriteFileAtomicFrom(target, hr, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return fmt.Errorf("write %s fail=>%w", target, err)
+			}
+			err = os.Chtimes(target, header.ModTime, header.ModTime)
+			if err != nil {
+				return fmt.Errorf("Chtimes fail=>%w", err)
+			}
+			if onEntry != nil {
+				onEntry(&TarEntry{Path: target, Size: hr.N, SHA256: hr.Sum(), Existed: statErr == nil})
+			}
+		default:
+			mycplog.Debugf("skip unsupported tar entry=>%s, type=>%c", header.Name, header.Typeflag)
+		}
+	}
+}